@@ -4,10 +4,14 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/umesh/ginapi/config"
+	"github.com/umesh/ginapi/controllers"
+	"github.com/umesh/ginapi/models"
 	"github.com/umesh/ginapi/routes"
+	"github.com/umesh/ginapi/utils"
 )
 
 func main() {
@@ -26,6 +30,38 @@ func main() {
 
 	defer config.DB.Close()
 
+	controllers.StartStockAlertChecker(durationFromEnv("STOCK_ALERT_INTERVAL", 15*time.Minute), utils.NewNotifierFromEnv("STOCK_ALERT"))
+	controllers.StartPriceScheduler(durationFromEnv("PRICE_SCHEDULER_INTERVAL", time.Minute))
+	controllers.StartReservationSweeper(durationFromEnv("RESERVATION_TTL", 15*time.Minute), durationFromEnv("RESERVATION_SWEEP_INTERVAL", time.Minute))
+	paymentProvider, err := utils.NewPaymentProviderFromEnv()
+	if err != nil {
+		log.Fatalf("Payment provider: %v", err)
+	}
+	controllers.SetPaymentProvider(paymentProvider)
+	controllers.StartRefundWorker(durationFromEnv("REFUND_INTERVAL", 30*time.Second))
+	controllers.SetInvoiceSeller(models.Seller{
+		Name:    os.Getenv("SELLER_NAME"),
+		Address: os.Getenv("SELLER_ADDRESS"),
+		Email:   os.Getenv("SELLER_EMAIL"),
+		TaxID:   os.Getenv("SELLER_TAX_ID"),
+	})
+	controllers.StartIdempotencyKeyCleaner(durationFromEnv("IDEMPOTENCY_KEY_TTL", 24*time.Hour), durationFromEnv("IDEMPOTENCY_CLEANUP_INTERVAL", time.Hour))
+	controllers.StartWebhookDispatcher(durationFromEnv("WEBHOOK_DISPATCH_INTERVAL", 5*time.Second))
+
 	router := routes.SetupRouter()
 	log.Fatal(router.Run(":8080"))
 }
+
+// Read a duration such as "15m" from the environment
+func durationFromEnv(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		log.Fatalf("Invalid %s: %q", name, value)
+	}
+	return duration
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
 
 	"github.com/joho/godotenv"
@@ -22,10 +23,59 @@ func main() {
 		creator func(*sql.DB) error
 	}{
 		{"users", createUsersTable},
+		{"usersColumns", alterUsersTable},
 		{"products", createProductsTable},
+		{"productsColumns", alterProductsTable},
+		{"productOptions", createProductOptionsTable},
+		{"productOptionValues", createProductOptionValuesTable},
+		{"productVariants", createProductVariantsTable},
+		{"productVariantsColumns", alterProductVariantsTable},
+		{"productVariantOptions", createProductVariantOptionsTable},
 		{"venues", createVenuesTable},
 		{"orders", createOrderTable},
+		{"ordersColumns", alterOrdersTable},
 		{"orderItmes", createOrderItemsTable},
+		{"orderItemsColumns", alterOrderItemsTable},
+		{"importJobs", createImportJobsTable},
+		{"inventoryMovements", createInventoryMovementsTable},
+		{"stockAlerts", createStockAlertsTable},
+		{"productPrices", createProductPricesTable},
+		{"productReviews", createProductReviewsTable},
+		{"reviewPhotos", createReviewPhotosTable},
+		{"reviewVotes", createReviewVotesTable},
+		{"promotions", createPromotionsTable},
+		{"promotionProducts", createPromotionProductsTable},
+		{"promotionCategories", createPromotionCategoriesTable},
+		{"orderDiscounts", createOrderDiscountsTable},
+		{"warehouses", createWarehousesTable},
+		{"warehouseStock", createWarehouseStockTable},
+		{"stockTransfers", createStockTransfersTable},
+		{"warehouseVariantKeys", alterWarehouseVariantKeys},
+		{"orderItemAllocations", createOrderItemAllocationsTable},
+		{"inventoryMovementsColumns", alterInventoryMovementsTable},
+		{"stockReservations", createStockReservationsTable},
+		{"stockReservationItems", createStockReservationItemsTable},
+		{"carts", createCartsTable},
+		{"cartItems", createCartItemsTable},
+		{"orderStatusHistory", createOrderStatusHistoryTable},
+		{"idempotencyKeys", createIdempotencyKeysTable},
+		{"payments", createPaymentsTable},
+		{"paymentRefunds", createPaymentRefundsTable},
+		{"paymentRefundsColumns", alterPaymentRefundsTable},
+		{"invoiceSequence", createInvoiceSequenceTable},
+		{"invoices", createInvoicesTable},
+		{"returns", createReturnsTable},
+		{"returnItems", createReturnItemsTable},
+		{"taxRates", createTaxRatesTable},
+		{"shippingZones", createShippingZonesTable},
+		{"shippingZoneRegions", createShippingZoneRegionsTable},
+		{"shippingMethods", createShippingMethodsTable},
+		{"shippingRates", createShippingRatesTable},
+		{"ordersShippingColumns", alterOrdersShippingColumns},
+		{"webhookSubscriptions", createWebhookSubscriptionsTable},
+		{"webhookSubscriptionEvents", createWebhookSubscriptionEventsTable},
+		{"webhookDeliveries", createWebhookDeliveriesTable},
+		{"webhookAttempts", createWebhookAttemptsTable},
 	}
 
 	for _, table := range tables {
@@ -45,6 +95,7 @@ func createUsersTable(db *sql.DB) error {
 		name VARCHAR(255) NOT NULL,
 		email VARCHAR(255) NOT NULL UNIQUE,
 		password VARCHAR(255) NOT NULL,
+		role VARCHAR(20) NOT NULL DEFAULT 'customer',
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
 	)`
@@ -53,17 +104,34 @@ func createUsersTable(db *sql.DB) error {
 	return err
 }
 
+// Bring users tables created before roles existed up to date
+func alterUsersTable(db *sql.DB) error {
+	if err := addColumn(db, "users", "role", "VARCHAR(20) NOT NULL DEFAULT 'customer' AFTER password"); err != nil {
+		return err
+	}
+	//Admin order search matches customers by name or email
+	return addIndex(db, "users", "ft_users_name_email", "FULLTEXT INDEX ft_users_name_email (name, email)")
+}
+
 // Create the product table
 func createProductsTable(db *sql.DB) error {
 	createTableSQL := `
 	CREATE TABLE IF NOT EXISTS products (
 		id INT AUTO_INCREMENT PRIMARY KEY,
 		name VARCHAR(255) NOT NULL,
+		sku VARCHAR(100) NULL UNIQUE,
+		category VARCHAR(100) NULL,
 		price DECIMAL(10,2) NOT NULL,
 		quantity INT NOT NULL,
 		image VARCHAR(255),
 		sales_rate DECIMAL(10,2),
 		purchase_rate DECIMAL(10,2) NOT NULL,
+		reorder_point INT NULL,
+		reorder_quantity INT NULL,
+		deleted_at TIMESTAMP NULL,
+		version INT NOT NULL DEFAULT 1,
+		rating_average DECIMAL(3,2) NOT NULL DEFAULT 0,
+		rating_count INT NOT NULL DEFAULT 0,
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
 	)`
@@ -74,6 +142,31 @@ func createProductsTable(db *sql.DB) error {
 	return nil
 }
 
+// Bring products tables created before later features up to date
+func alterProductsTable(db *sql.DB) error {
+	columns := []struct{ name, definition string }{
+		{"sku", "VARCHAR(100) NULL UNIQUE AFTER name"},
+		{"reorder_point", "INT NULL"},
+		{"reorder_quantity", "INT NULL"},
+		{"deleted_at", "TIMESTAMP NULL"},
+		{"version", "INT NOT NULL DEFAULT 1"},
+		{"rating_average", "DECIMAL(3,2) NOT NULL DEFAULT 0"},
+		{"rating_count", "INT NOT NULL DEFAULT 0"},
+		{"category", "VARCHAR(100) NULL AFTER sku"},
+		{"tax_class", "VARCHAR(50) NOT NULL DEFAULT 'standard'"},
+		{"weight", "DECIMAL(10,3) NULL"},
+		{"length", "DECIMAL(10,2) NULL"},
+		{"width", "DECIMAL(10,2) NULL"},
+		{"height", "DECIMAL(10,2) NULL"},
+	}
+	for _, column := range columns {
+		if err := addColumn(db, "products", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Create the venue table
 func createVenuesTable(db *sql.DB) error {
 	createTableSQL := `
@@ -96,6 +189,7 @@ func createOrderTable(db *sql.DB) error {
     id INT AUTO_INCREMENT PRIMARY KEY,
     user_id INT NOT NULL,
     total_amount DECIMAL(10,2) NOT NULL,
+    discount_amount DECIMAL(10,2) NOT NULL DEFAULT 0,
     status VARCHAR(50) DEFAULT 'pending',
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
@@ -112,13 +206,954 @@ func createOrderItemsTable(db *sql.DB) error {
     id INT AUTO_INCREMENT PRIMARY KEY,
     order_id INT NOT NULL,
     product_id INT NOT NULL,
+    variant_id INT NULL,
     quantity INT NOT NULL,
     unit_price DECIMAL(10,2) NOT NULL,
     total_price DECIMAL(10,2) NOT NULL,
+    discount_amount DECIMAL(10,2) NOT NULL DEFAULT 0,
+    unit_cost DECIMAL(10,2) NULL,
     FOREIGN KEY (order_id) REFERENCES orders(id),
-    FOREIGN KEY (product_id) REFERENCES products(id)
+    FOREIGN KEY (product_id) REFERENCES products(id),
+    FOREIGN KEY (variant_id) REFERENCES product_variants(id)
 )`
 
 	_, err := db.Exec(createTableSQL)
 	return err
 }
+
+// Bring orders tables created before later features up to date
+func alterOrdersTable(db *sql.DB) error {
+	columns := []struct{ name, definition string }{
+		{"discount_amount", "DECIMAL(10,2) NOT NULL DEFAULT 0 AFTER total_amount"},
+		{"cancel_reason", "VARCHAR(255) NULL"},
+		{"cancelled_at", "TIMESTAMP NULL"},
+		{"refunded_amount", "DECIMAL(10,2) NOT NULL DEFAULT 0 AFTER discount_amount"},
+		{"subtotal", "DECIMAL(10,2) NULL AFTER user_id"},
+		{"tax_amount", "DECIMAL(10,2) NOT NULL DEFAULT 0 AFTER discount_amount"},
+		{"tax_region", "VARCHAR(50) NOT NULL DEFAULT '' AFTER tax_amount"},
+	}
+	for _, column := range columns {
+		if err := addColumn(db, "orders", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+
+	//Orders placed before tax was added were charged their subtotal less discounts
+	_, err := db.Exec("UPDATE orders SET subtotal = total_amount + discount_amount WHERE subtotal IS NULL")
+	return err
+}
+
+// Bring order_items tables created before later features up to date
+func alterOrderItemsTable(db *sql.DB) error {
+	columns := []struct{ name, definition string }{
+		{"variant_id", "INT NULL, ADD FOREIGN KEY (variant_id) REFERENCES product_variants(id)"},
+		{"discount_amount", "DECIMAL(10,2) NOT NULL DEFAULT 0"},
+		{"unit_cost", "DECIMAL(10,2) NULL"},
+		{"tax_class", "VARCHAR(50) NOT NULL DEFAULT 'standard'"},
+		{"tax_rate", "DECIMAL(6,3) NOT NULL DEFAULT 0"},
+		{"tax_amount", "DECIMAL(10,2) NOT NULL DEFAULT 0"},
+		{"tax_inclusive", "BOOLEAN NOT NULL DEFAULT FALSE"},
+	}
+	for _, column := range columns {
+		if err := addColumn(db, "order_items", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Options such as size or color that a product is sold in
+func createProductOptionsTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS product_options (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		product_id INT NOT NULL,
+		name VARCHAR(100) NOT NULL,
+		UNIQUE KEY uq_product_option (product_id, name),
+		FOREIGN KEY (product_id) REFERENCES products(id)
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+func createProductOptionValuesTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS product_option_values (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		option_id INT NOT NULL,
+		value VARCHAR(100) NOT NULL,
+		UNIQUE KEY uq_option_value (option_id, value),
+		FOREIGN KEY (option_id) REFERENCES product_options(id)
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+// A NULL price means the variant sells at the product price
+func createProductVariantsTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS product_variants (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		product_id INT NOT NULL,
+		sku VARCHAR(100) NOT NULL UNIQUE,
+		barcode VARCHAR(100),
+		price DECIMAL(10,2) NULL,
+		quantity INT NOT NULL DEFAULT 0,
+		deleted_at TIMESTAMP NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		FOREIGN KEY (product_id) REFERENCES products(id)
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+// Deleted variants are archived so their orders and stock ledger keep them
+func alterProductVariantsTable(db *sql.DB) error {
+	return addColumn(db, "product_variants", "deleted_at", "TIMESTAMP NULL AFTER quantity")
+}
+
+func createProductVariantOptionsTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS product_variant_options (
+		variant_id INT NOT NULL,
+		option_value_id INT NOT NULL,
+		PRIMARY KEY (variant_id, option_value_id),
+		FOREIGN KEY (variant_id) REFERENCES product_variants(id) ON DELETE CASCADE,
+		FOREIGN KEY (option_value_id) REFERENCES product_option_values(id)
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+// Background product imports and their progress
+func createImportJobsTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS import_jobs (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		user_id INT NOT NULL,
+		filename VARCHAR(255) NOT NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'queued',
+		dry_run BOOLEAN NOT NULL DEFAULT FALSE,
+		total_rows INT NOT NULL DEFAULT 0,
+		processed_rows INT NOT NULL DEFAULT 0,
+		created_count INT NOT NULL DEFAULT 0,
+		updated_count INT NOT NULL DEFAULT 0,
+		failed_count INT NOT NULL DEFAULT 0,
+		errors JSON NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		finished_at TIMESTAMP NULL,
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+// Ledger of every stock change. quantity_after is the stock level right after
+// the change and unit_cost is the product purchase_rate at that moment.
+func createInventoryMovementsTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS inventory_movements (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		product_id INT NOT NULL,
+		variant_id INT NULL,
+		quantity_change INT NOT NULL,
+		quantity_after INT NOT NULL,
+		reason VARCHAR(20) NOT NULL,
+		reference VARCHAR(100),
+		unit_cost DECIMAL(10,2) NOT NULL,
+		user_id INT NULL,
+		note VARCHAR(255),
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_movements_product_time (product_id, created_at),
+		FOREIGN KEY (product_id) REFERENCES products(id),
+		FOREIGN KEY (variant_id) REFERENCES product_variants(id),
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+func createStockAlertsTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS stock_alerts (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		product_id INT NOT NULL,
+		quantity INT NOT NULL,
+		reorder_point INT NOT NULL,
+		reorder_quantity INT NOT NULL DEFAULT 0,
+		status VARCHAR(20) NOT NULL DEFAULT 'open',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		resolved_at TIMESTAMP NULL,
+		INDEX idx_stock_alerts_status (status),
+		FOREIGN KEY (product_id) REFERENCES products(id)
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+// Price history and scheduled price changes. applied_at and expired_at record
+// when the scheduler copied the entry onto products or rolled it back.
+func createProductPricesTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS product_prices (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		product_id INT NOT NULL,
+		price DECIMAL(10,2) NOT NULL,
+		sales_rate DECIMAL(10,2) NULL,
+		purchase_rate DECIMAL(10,2) NULL,
+		starts_at TIMESTAMP NOT NULL,
+		ends_at TIMESTAMP NULL,
+		applied_at TIMESTAMP NULL,
+		expired_at TIMESTAMP NULL,
+		created_by INT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_product_prices_product_start (product_id, starts_at),
+		FOREIGN KEY (product_id) REFERENCES products(id),
+		FOREIGN KEY (created_by) REFERENCES users(id)
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+// Product reviews. Only approved reviews are public and count towards the
+// rating_average and rating_count kept on products.
+func createProductReviewsTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS product_reviews (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		product_id INT NOT NULL,
+		user_id INT NOT NULL,
+		rating TINYINT NOT NULL,
+		title VARCHAR(255) NOT NULL,
+		body TEXT,
+		status VARCHAR(20) NOT NULL DEFAULT 'pending',
+		moderation_note VARCHAR(255) NULL,
+		moderated_by INT NULL,
+		moderated_at TIMESTAMP NULL,
+		helpful_count INT NOT NULL DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		UNIQUE KEY uq_product_reviews_product_user (product_id, user_id),
+		INDEX idx_product_reviews_product_status (product_id, status),
+		FOREIGN KEY (product_id) REFERENCES products(id),
+		FOREIGN KEY (user_id) REFERENCES users(id),
+		FOREIGN KEY (moderated_by) REFERENCES users(id)
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+func createReviewPhotosTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS review_photos (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		review_id INT NOT NULL,
+		filename VARCHAR(255) NOT NULL,
+		position INT NOT NULL DEFAULT 0,
+		FOREIGN KEY (review_id) REFERENCES product_reviews(id) ON DELETE CASCADE
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+// One helpful vote per user and review
+func createReviewVotesTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS review_votes (
+		review_id INT NOT NULL,
+		user_id INT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (review_id, user_id),
+		FOREIGN KEY (review_id) REFERENCES product_reviews(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+// Coupons and automatic promotions. A promotion without a code applies to
+// every qualifying order; used_count backs the global usage limit.
+func createPromotionsTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS promotions (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		code VARCHAR(50) NULL UNIQUE,
+		name VARCHAR(255) NOT NULL,
+		type VARCHAR(20) NOT NULL,
+		value DECIMAL(10,2) NOT NULL DEFAULT 0,
+		buy_quantity INT NULL,
+		get_quantity INT NULL,
+		min_spend DECIMAL(10,2) NULL,
+		usage_limit INT NULL,
+		per_user_limit INT NULL,
+		used_count INT NOT NULL DEFAULT 0,
+		starts_at TIMESTAMP NULL,
+		ends_at TIMESTAMP NULL,
+		active BOOLEAN NOT NULL DEFAULT TRUE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+// A promotion scoped to products or categories only discounts matching items
+func createPromotionProductsTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS promotion_products (
+		promotion_id INT NOT NULL,
+		product_id INT NOT NULL,
+		PRIMARY KEY (promotion_id, product_id),
+		FOREIGN KEY (promotion_id) REFERENCES promotions(id) ON DELETE CASCADE,
+		FOREIGN KEY (product_id) REFERENCES products(id)
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+func createPromotionCategoriesTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS promotion_categories (
+		promotion_id INT NOT NULL,
+		category VARCHAR(100) NOT NULL,
+		PRIMARY KEY (promotion_id, category),
+		FOREIGN KEY (promotion_id) REFERENCES promotions(id) ON DELETE CASCADE
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+// Discount lines applied to an order; their sum is orders.discount_amount
+func createOrderDiscountsTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS order_discounts (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		order_id INT NOT NULL,
+		promotion_id INT NOT NULL,
+		code VARCHAR(50) NULL,
+		description VARCHAR(255) NOT NULL,
+		amount DECIMAL(10,2) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_order_discounts_promotion (promotion_id),
+		FOREIGN KEY (order_id) REFERENCES orders(id),
+		FOREIGN KEY (promotion_id) REFERENCES promotions(id)
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+// Locations stock is held in. Coordinates are used to find the nearest one.
+func createWarehousesTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS warehouses (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		code VARCHAR(50) NOT NULL UNIQUE,
+		name VARCHAR(255) NOT NULL,
+		address VARCHAR(255),
+		latitude DECIMAL(9,6) NULL,
+		longitude DECIMAL(9,6) NULL,
+		active BOOLEAN NOT NULL DEFAULT TRUE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+// Stock of a product or variant at one warehouse. The total on products and
+// product_variants includes it; stock not held at any warehouse is unassigned.
+func createWarehouseStockTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS warehouse_stock (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		warehouse_id INT NOT NULL,
+		product_id INT NOT NULL,
+		variant_id INT NULL,
+		variant_key INT AS (COALESCE(variant_id, 0)) STORED,
+		quantity INT NOT NULL DEFAULT 0,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		UNIQUE KEY uq_warehouse_stock (warehouse_id, product_id, variant_key),
+		INDEX idx_warehouse_stock_product (product_id, variant_key),
+		FOREIGN KEY (warehouse_id) REFERENCES warehouses(id),
+		FOREIGN KEY (product_id) REFERENCES products(id),
+		FOREIGN KEY (variant_id) REFERENCES product_variants(id)
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+// Moves of stock between warehouses. A NULL side is the unassigned stock.
+func createStockTransfersTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS stock_transfers (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		product_id INT NOT NULL,
+		variant_id INT NULL,
+		from_warehouse_id INT NULL,
+		to_warehouse_id INT NULL,
+		quantity INT NOT NULL,
+		user_id INT NULL,
+		note VARCHAR(255),
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_stock_transfers_product (product_id, created_at),
+		FOREIGN KEY (product_id) REFERENCES products(id),
+		FOREIGN KEY (variant_id) REFERENCES product_variants(id),
+		FOREIGN KEY (from_warehouse_id) REFERENCES warehouses(id),
+		FOREIGN KEY (to_warehouse_id) REFERENCES warehouses(id),
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+// Warehouse stock and its transfers keep their variants, which are archived
+// rather than deleted
+func alterWarehouseVariantKeys(db *sql.DB) error {
+	if err := restrictForeignKey(db, "warehouse_stock", "variant_id", "product_variants"); err != nil {
+		return err
+	}
+	return restrictForeignKey(db, "stock_transfers", "variant_id", "product_variants")
+}
+
+// Where the units of an order item were taken from. A NULL warehouse means
+// unassigned stock.
+func createOrderItemAllocationsTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS order_item_allocations (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		order_item_id INT NOT NULL,
+		warehouse_id INT NULL,
+		quantity INT NOT NULL,
+		FOREIGN KEY (order_item_id) REFERENCES order_items(id),
+		FOREIGN KEY (warehouse_id) REFERENCES warehouses(id)
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+// Bring inventory_movements tables created before warehouses up to date
+func alterInventoryMovementsTable(db *sql.DB) error {
+	err := addColumn(db, "inventory_movements", "warehouse_id",
+		"INT NULL AFTER variant_id, ADD FOREIGN KEY (warehouse_id) REFERENCES warehouses(id)")
+	if err != nil {
+		return err
+	}
+	//The ledger outlives its variants; they are archived rather than deleted
+	return restrictForeignKey(db, "inventory_movements", "variant_id", "product_variants")
+}
+
+// Stock held for a customer during checkout. Reservations only count while
+// active and unexpired; the sweeper marks expired ones.
+func createStockReservationsTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS stock_reservations (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		user_id INT NOT NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'active',
+		expires_at TIMESTAMP NOT NULL,
+		order_id INT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		INDEX idx_stock_reservations_status_expiry (status, expires_at),
+		FOREIGN KEY (user_id) REFERENCES users(id),
+		FOREIGN KEY (order_id) REFERENCES orders(id)
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+func createStockReservationItemsTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS stock_reservation_items (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		reservation_id INT NOT NULL,
+		product_id INT NOT NULL,
+		variant_id INT NULL,
+		quantity INT NOT NULL,
+		INDEX idx_reservation_items_product (product_id, variant_id),
+		FOREIGN KEY (reservation_id) REFERENCES stock_reservations(id) ON DELETE CASCADE,
+		FOREIGN KEY (product_id) REFERENCES products(id),
+		FOREIGN KEY (variant_id) REFERENCES product_variants(id) ON DELETE CASCADE
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+// A cart belongs to a user, or to a guest who holds its token until login
+func createCartsTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS carts (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		user_id INT NULL,
+		token VARCHAR(64) NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		UNIQUE KEY uq_carts_user (user_id),
+		UNIQUE KEY uq_carts_token (token),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+func createCartItemsTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS cart_items (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		cart_id INT NOT NULL,
+		product_id INT NOT NULL,
+		variant_id INT NULL,
+		variant_key INT AS (COALESCE(variant_id, 0)) STORED,
+		quantity INT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE KEY uq_cart_items (cart_id, product_id, variant_key),
+		FOREIGN KEY (cart_id) REFERENCES carts(id) ON DELETE CASCADE,
+		FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE,
+		FOREIGN KEY (variant_id) REFERENCES product_variants(id) ON DELETE CASCADE
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+// Every status an order has been through, starting with the one it was placed in
+func createOrderStatusHistoryTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS order_status_history (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		order_id INT NOT NULL,
+		from_status VARCHAR(50) NULL,
+		to_status VARCHAR(50) NOT NULL,
+		note VARCHAR(255) NULL,
+		user_id INT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_order_status_history_order (order_id, created_at),
+		FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+// Responses of requests sent with an Idempotency-Key, replayed on retries
+func createIdempotencyKeysTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS idempotency_keys (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		user_id INT NOT NULL,
+		idem_key VARCHAR(255) NOT NULL,
+		fingerprint CHAR(64) NOT NULL,
+		status_code INT NULL,
+		response MEDIUMBLOB NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL,
+		UNIQUE KEY uq_idempotency_keys (user_id, idem_key),
+		INDEX idx_idempotency_keys_expires (expires_at),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+// Payments taken for orders through a payment provider
+func createPaymentsTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS payments (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		order_id INT NOT NULL,
+		provider VARCHAR(50) NOT NULL,
+		provider_ref VARCHAR(255) NOT NULL,
+		amount DECIMAL(10,2) NOT NULL,
+		refunded_amount DECIMAL(10,2) NOT NULL DEFAULT 0,
+		status VARCHAR(20) NOT NULL,
+		failure_reason VARCHAR(255) NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		UNIQUE KEY uq_payments_provider_ref (provider, provider_ref),
+		INDEX idx_payments_order (order_id),
+		FOREIGN KEY (order_id) REFERENCES orders(id)
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+func createPaymentRefundsTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS payment_refunds (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		payment_id INT NOT NULL,
+		provider_ref VARCHAR(255) NULL,
+		amount DECIMAL(10,2) NOT NULL,
+		reason VARCHAR(255) NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'pending',
+		attempts INT NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMP NULL,
+		failure_reason VARCHAR(500) NULL,
+		user_id INT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		INDEX idx_payment_refunds_due (status, next_attempt_at),
+		FOREIGN KEY (payment_id) REFERENCES payments(id),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+// Refunds are recorded first and sent to the provider by the refund worker.
+// Refunds from before the queue were sent at once, so they count as succeeded.
+func alterPaymentRefundsTable(db *sql.DB) error {
+	if _, err := db.Exec("ALTER TABLE payment_refunds MODIFY provider_ref VARCHAR(255) NULL"); err != nil {
+		return err
+	}
+	columns := []struct{ name, definition string }{
+		{"status", "VARCHAR(20) NOT NULL DEFAULT 'succeeded' AFTER reason"},
+		{"attempts", "INT NOT NULL DEFAULT 0 AFTER status"},
+		{"next_attempt_at", "TIMESTAMP NULL AFTER attempts"},
+		{"failure_reason", "VARCHAR(500) NULL AFTER next_attempt_at"},
+		{"updated_at", "TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP AFTER created_at"},
+	}
+	for _, column := range columns {
+		if err := addColumn(db, "payment_refunds", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+	if _, err := db.Exec("ALTER TABLE payment_refunds ALTER COLUMN status SET DEFAULT 'pending'"); err != nil {
+		return err
+	}
+	return addIndex(db, "payment_refunds", "idx_payment_refunds_due", "INDEX idx_payment_refunds_due (status, next_attempt_at)")
+}
+
+// Single row counter for invoice numbers. It is only advanced in the
+// transaction that stores the invoice, so numbers have no gaps.
+func createInvoiceSequenceTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS invoice_sequence (
+		id TINYINT PRIMARY KEY,
+		next_number INT NOT NULL
+	)`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		return err
+	}
+	_, err := db.Exec("INSERT IGNORE INTO invoice_sequence (id, next_number) VALUES (1, 1)")
+	return err
+}
+
+func createInvoicesTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS invoices (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		order_id INT NOT NULL,
+		invoice_number VARCHAR(50) NOT NULL,
+		issued_at TIMESTAMP NOT NULL,
+		pdf MEDIUMBLOB NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE KEY uq_invoices_order (order_id),
+		UNIQUE KEY uq_invoices_number (invoice_number),
+		FOREIGN KEY (order_id) REFERENCES orders(id)
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+// Return requests (RMAs) against delivered orders
+func createReturnsTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS returns (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		order_id INT NOT NULL,
+		user_id INT NOT NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'requested',
+		reason VARCHAR(255) NOT NULL,
+		admin_note VARCHAR(255) NULL,
+		refund_amount DECIMAL(10,2) NULL,
+		refunded_amount DECIMAL(10,2) NOT NULL DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		INDEX idx_returns_status (status, created_at),
+		FOREIGN KEY (order_id) REFERENCES orders(id),
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+func createReturnItemsTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS return_items (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		return_id INT NOT NULL,
+		order_item_id INT NOT NULL,
+		quantity INT NOT NULL,
+		reason VARCHAR(255) NULL,
+		item_condition VARCHAR(20) NULL,
+		refund_amount DECIMAL(10,2) NULL,
+		FOREIGN KEY (return_id) REFERENCES returns(id) ON DELETE CASCADE,
+		FOREIGN KEY (order_item_id) REFERENCES order_items(id)
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+// Tax rates by region and product tax class; region * holds the fallback rates
+func createTaxRatesTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS tax_rates (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		region VARCHAR(50) NOT NULL,
+		tax_class VARCHAR(50) NOT NULL,
+		name VARCHAR(100) NOT NULL,
+		rate DECIMAL(6,3) NOT NULL,
+		inclusive BOOLEAN NOT NULL DEFAULT FALSE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE KEY uq_tax_rate (region, tax_class)
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+// Destination zones for shipping rates; a region is listed by one zone only
+func createShippingZonesTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS shipping_zones (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		name VARCHAR(100) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+func createShippingZoneRegionsTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS shipping_zone_regions (
+		zone_id INT NOT NULL,
+		region VARCHAR(50) NOT NULL,
+		PRIMARY KEY (region),
+		INDEX idx_shipping_zone_regions_zone (zone_id),
+		FOREIGN KEY (zone_id) REFERENCES shipping_zones(id) ON DELETE CASCADE
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+func createShippingMethodsTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS shipping_methods (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		code VARCHAR(50) NOT NULL UNIQUE,
+		name VARCHAR(100) NOT NULL,
+		active BOOLEAN NOT NULL DEFAULT TRUE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+// Weight and order value bands of a shipping method in a zone
+func createShippingRatesTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS shipping_rates (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		method_id INT NOT NULL,
+		zone_id INT NOT NULL,
+		min_weight DECIMAL(10,3) NOT NULL DEFAULT 0,
+		max_weight DECIMAL(10,3) NULL,
+		min_value DECIMAL(10,2) NOT NULL DEFAULT 0,
+		max_value DECIMAL(10,2) NULL,
+		fee DECIMAL(10,2) NOT NULL,
+		fee_per_kg DECIMAL(10,2) NOT NULL DEFAULT 0,
+		FOREIGN KEY (method_id) REFERENCES shipping_methods(id) ON DELETE CASCADE,
+		FOREIGN KEY (zone_id) REFERENCES shipping_zones(id)
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+// Shipping columns of orders, added once shipping_methods exists
+func alterOrdersShippingColumns(db *sql.DB) error {
+	columns := []struct{ name, definition string }{
+		{"shipping_method_id", "INT NULL, ADD FOREIGN KEY (shipping_method_id) REFERENCES shipping_methods(id)"},
+		{"shipping_method", "VARCHAR(100) NULL"},
+		{"shipping_amount", "DECIMAL(10,2) NOT NULL DEFAULT 0 AFTER tax_region"},
+	}
+	for _, column := range columns {
+		if err := addColumn(db, "orders", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func createWebhookSubscriptionsTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		url VARCHAR(500) NOT NULL,
+		secret VARCHAR(255) NOT NULL,
+		active BOOLEAN NOT NULL DEFAULT TRUE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+func createWebhookSubscriptionEventsTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS webhook_subscription_events (
+		subscription_id INT NOT NULL,
+		event_type VARCHAR(50) NOT NULL,
+		PRIMARY KEY (subscription_id, event_type),
+		INDEX idx_webhook_subscription_events_type (event_type),
+		FOREIGN KEY (subscription_id) REFERENCES webhook_subscriptions(id) ON DELETE CASCADE
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+// Outbound webhook deliveries, written in the same transaction as the change
+// they announce and sent by the dispatcher
+func createWebhookDeliveriesTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		subscription_id INT NOT NULL,
+		event_id VARCHAR(64) NOT NULL,
+		event_type VARCHAR(50) NOT NULL,
+		payload MEDIUMTEXT NOT NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'pending',
+		attempts INT NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMP NULL DEFAULT CURRENT_TIMESTAMP,
+		delivered_at TIMESTAMP NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_webhook_deliveries_due (status, next_attempt_at),
+		INDEX idx_webhook_deliveries_subscription (subscription_id, created_at),
+		FOREIGN KEY (subscription_id) REFERENCES webhook_subscriptions(id) ON DELETE CASCADE
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+func createWebhookAttemptsTable(db *sql.DB) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS webhook_attempts (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		delivery_id INT NOT NULL,
+		status_code INT NULL,
+		error VARCHAR(500) NULL,
+		duration_ms INT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (delivery_id) REFERENCES webhook_deliveries(id) ON DELETE CASCADE
+	)`
+
+	_, err := db.Exec(createTableSQL)
+	return err
+}
+
+// addColumn adds a column to an existing table unless it is already there,
+// since CREATE TABLE IF NOT EXISTS leaves older tables untouched
+func addColumn(db *sql.DB, table, column, definition string) error {
+	var count int
+	err := db.QueryRow(`
+		SELECT COUNT(*) FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?`,
+		table, column,
+	).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// addIndex adds an index to an existing table unless one with the name exists
+func addIndex(db *sql.DB, table, index, definition string) error {
+	var count int
+	err := db.QueryRow(`
+		SELECT COUNT(*) FROM information_schema.STATISTICS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND INDEX_NAME = ?`,
+		table, index,
+	).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD %s", table, definition))
+	return err
+}
+
+// restrictForeignKey turns a foreign key that cascades deletes into one that
+// refuses them, for tables created before the cascade was dropped
+func restrictForeignKey(db *sql.DB, table, column, referenced string) error {
+	var name, rule string
+	err := db.QueryRow(`
+		SELECT k.CONSTRAINT_NAME, r.DELETE_RULE
+		FROM information_schema.KEY_COLUMN_USAGE k
+		JOIN information_schema.REFERENTIAL_CONSTRAINTS r
+		  ON r.CONSTRAINT_SCHEMA = k.CONSTRAINT_SCHEMA AND r.CONSTRAINT_NAME = k.CONSTRAINT_NAME
+		WHERE k.TABLE_SCHEMA = DATABASE() AND k.TABLE_NAME = ? AND k.COLUMN_NAME = ?
+		  AND k.REFERENCED_TABLE_NAME = ?`,
+		table, column, referenced,
+	).Scan(&name, &rule)
+	if err != nil {
+		return err
+	}
+	if rule != "CASCADE" {
+		return nil
+	}
+
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s DROP FOREIGN KEY %s", table, name)); err != nil {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf(
+		"ALTER TABLE %s ADD CONSTRAINT %s FOREIGN KEY (%s) REFERENCES %s(id)",
+		table, name, column, referenced,
+	))
+	return err
+}
@@ -0,0 +1,342 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/umesh/ginapi/config"
+	"github.com/umesh/ginapi/models"
+)
+
+var adminOrderCSVHeader = []string{
+	"id", "created_at", "status", "customer_id", "customer_name", "customer_email",
+	"subtotal", "discount", "tax", "shipping", "total", "refunded",
+}
+
+// Turn free text into a boolean full-text query that needs every word, each
+// matched as a prefix. Words shorter than the full-text minimum are dropped.
+func fullTextQuery(text string) string {
+	var terms []string
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, word := range words {
+		if utf8.RuneCountInString(word) >= 3 {
+			terms = append(terms, "+"+word+"*")
+		}
+	}
+	return strings.Join(terms, " ")
+}
+
+// Conditions for the admin order filters, on orders o joined to users u
+func adminOrderFilters(c *gin.Context) (where string, args []interface{}, ok bool) {
+	conditions, args, ok := reportDateRange(c)
+	if !ok {
+		return "", nil, false
+	}
+	if value := c.Query("user_id"); value != "" {
+		userID, err := strconv.Atoi(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user_id"})
+			return "", nil, false
+		}
+		conditions, args = append(conditions, "o.user_id = ?"), append(args, userID)
+	}
+	if value := c.Query("status"); value != "" {
+		statuses := strings.Split(value, ",")
+		conditions = append(conditions, "o.status IN (?"+strings.Repeat(", ?", len(statuses)-1)+")")
+		for _, status := range statuses {
+			args = append(args, strings.TrimSpace(status))
+		}
+	}
+	for param, condition := range map[string]string{"min_total": "o.total_amount >= ?", "max_total": "o.total_amount <= ?"} {
+		value := c.Query(param)
+		if value == "" {
+			continue
+		}
+		amount, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + param})
+			return "", nil, false
+		}
+		conditions, args = append(conditions, condition), append(args, amount)
+	}
+	if value := c.Query("product_id"); value != "" {
+		productID, err := strconv.Atoi(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid product_id"})
+			return "", nil, false
+		}
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM order_items oi WHERE oi.order_id = o.id AND oi.product_id = ?)")
+		args = append(args, productID)
+	}
+	//Customer name or email; an email prefix still matches when the words are too short to index
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		if terms := fullTextQuery(q); terms != "" {
+			conditions = append(conditions, "(MATCH(u.name, u.email) AGAINST (? IN BOOLEAN MODE) OR u.email LIKE ?)")
+			args = append(args, terms, q+"%")
+		} else {
+			conditions = append(conditions, "(u.name LIKE ? OR u.email LIKE ?)")
+			args = append(args, "%"+q+"%", "%"+q+"%")
+		}
+	}
+
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+	return where, args, true
+}
+
+// Orders of every customer, newest first, as JSON pages or one CSV export
+func GetAdminOrders(c *gin.Context) {
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "csv" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or csv"})
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+	offset := (page - 1) * limit
+
+	where, args, ok := adminOrderFilters(c)
+	if !ok {
+		return
+	}
+
+	var total int
+	if format == "json" {
+		err := config.DB.QueryRow("SELECT COUNT(*) FROM orders o JOIN users u ON u.id = o.user_id "+where, args...).Scan(&total)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	query := `
+		SELECT o.id, o.user_id, o.subtotal, o.discount_amount, o.tax_amount, o.tax_region, COALESCE(o.shipping_method, ''), o.shipping_amount,
+		       o.total_amount, o.refunded_amount, o.status, o.created_at, o.cancel_reason, o.cancelled_at,
+		       u.id, u.name, u.email
+		FROM orders o
+		JOIN users u ON u.id = o.user_id
+		` + where + `
+		ORDER BY o.created_at DESC, o.id DESC`
+	//The export holds every matching order
+	if format == "json" {
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, limit, offset)
+	}
+
+	rows, err := config.DB.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	if format == "csv" {
+		streamAdminOrdersCSV(c, rows)
+		return
+	}
+
+	orders := []models.Order{}
+	for rows.Next() {
+		order, err := scanAdminOrder(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		orders = append(orders, order)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	rows.Close()
+
+	for _, include := range strings.Split(c.Query("include"), ",") {
+		if strings.TrimSpace(include) == "items" {
+			if err := loadOrderItems(orders); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": orders,
+		"pagination": gin.H{
+			"total":       total,
+			"page":        page,
+			"limit":       limit,
+			"total_pages": (total + limit - 1) / limit,
+		},
+	})
+}
+
+// Scan one row of the admin order query, with its customer
+func scanAdminOrder(rows *sql.Rows) (models.Order, error) {
+	var order models.Order
+	var customer models.OrderCustomer
+	err := rows.Scan(
+		&order.ID,
+		&order.UserID,
+		&order.Subtotal,
+		&order.DiscountAmount,
+		&order.TaxAmount,
+		&order.TaxRegion,
+		&order.ShippingMethod,
+		&order.ShippingAmount,
+		&order.TotalAmount,
+		&order.RefundedAmount,
+		&order.Status,
+		&order.CreatedAt,
+		&order.CancelReason,
+		&order.CancelledAt,
+		&customer.ID,
+		&customer.Name,
+		&customer.Email,
+	)
+	order.RefundStatus = refundStatus(order.TotalAmount, order.RefundedAmount)
+	order.Customer = &customer
+	return order, err
+}
+
+// Write each order as it is read, so the export never holds every order at once
+func streamAdminOrdersCSV(c *gin.Context, rows *sql.Rows) {
+	filename := fmt.Sprintf("orders_%s.csv", time.Now().Format("20060102_150405"))
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Header("Content-Type", "text/csv")
+	c.Status(http.StatusOK)
+
+	// Once streaming has started the status is sent, so failures can only be logged
+	writer := csv.NewWriter(c.Writer)
+	if err := writer.Write(adminOrderCSVHeader); err != nil {
+		log.Printf("order export: %v", err)
+		return
+	}
+	for rows.Next() {
+		order, err := scanAdminOrder(rows)
+		if err != nil {
+			log.Printf("order export: %v", err)
+			return
+		}
+		err = writer.Write([]string{
+			strconv.FormatUint(uint64(order.ID), 10),
+			order.CreatedAt.Format(time.RFC3339),
+			order.Status,
+			strconv.FormatUint(uint64(order.Customer.ID), 10),
+			order.Customer.Name,
+			order.Customer.Email,
+			strconv.FormatFloat(order.Subtotal, 'f', 2, 64),
+			strconv.FormatFloat(order.DiscountAmount, 'f', 2, 64),
+			strconv.FormatFloat(order.TaxAmount, 'f', 2, 64),
+			strconv.FormatFloat(order.ShippingAmount, 'f', 2, 64),
+			strconv.FormatFloat(order.TotalAmount, 'f', 2, 64),
+			strconv.FormatFloat(order.RefundedAmount, 'f', 2, 64),
+		})
+		if err != nil {
+			log.Printf("order export: %v", err)
+			return
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("order export: %v", err)
+		return
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		log.Printf("order export: %v", err)
+	}
+}
+
+// Move one order for a bulk update, in a transaction of its own
+func bulkTransitionOrder(orderID uint, to string, adminID uint, note string) (from string, err error) {
+	tx, err := config.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	_, from, err = lockOrder(tx, int64(orderID))
+	if err != nil {
+		return "", err
+	}
+	//Both check the move is allowed from the status the order is in now
+	if to == models.OrderCancelled {
+		err = cancelOrder(tx, int64(orderID), from, &adminID, note)
+	} else {
+		err = transitionOrder(tx, int64(orderID), from, to, &adminID, note)
+	}
+	if err != nil {
+		return from, err
+	}
+	if err := tx.Commit(); err != nil {
+		return from, err
+	}
+	if to == models.OrderCancelled {
+		wakeRefundWorker()
+	}
+	return from, nil
+}
+
+// Move many orders to one status. Orders that cannot make the move are
+// reported and left as they are.
+func BulkUpdateOrderStatus(c *gin.Context) {
+	var req models.BulkOrderStatusRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	adminID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	results := []models.BulkOrderStatusResult{}
+	updated := 0
+	seen := map[uint]bool{}
+	for _, orderID := range req.OrderIDs {
+		if seen[orderID] {
+			continue
+		}
+		seen[orderID] = true
+
+		result := models.BulkOrderStatusResult{OrderID: orderID}
+		from, err := bulkTransitionOrder(orderID, req.Status, adminID, req.Note)
+		result.From = from
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			result.Error = "order not found"
+		case err != nil:
+			result.Error = err.Error()
+		default:
+			result.Status = req.Status
+			updated++
+		}
+		results = append(results, result)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":    results,
+		"updated": updated,
+		"failed":  len(results) - updated,
+	})
+}
@@ -5,8 +5,10 @@ import (
 	"database/sql"
 	"encoding/hex"
 	"errors"
+	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -29,6 +31,7 @@ func GenerateJWT(user models.User) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 		"user_id": user.ID,
 		"email":   user.Email,
+		"role":    user.Role,
 		"exp":     time.Now().Add(time.Hour * 24).Unix(),
 	})
 
@@ -46,11 +49,11 @@ func Login(c *gin.Context) {
 	hashedPassword := hashPassword(loginReq.Password)
 
 	err := config.DB.QueryRow(`
-        SELECT id, name, email, created_at, updated_at 
+        SELECT id, name, email, role, created_at, updated_at 
         FROM users 
         WHERE email = ? AND password = ?`,
 		loginReq.Email, hashedPassword,
-	).Scan(&user.ID, &user.Name, &user.Email, &user.CreatedAt, &user.UpdatedAt)
+	).Scan(&user.ID, &user.Name, &user.Email, &user.Role, &user.CreatedAt, &user.UpdatedAt)
 
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -67,12 +70,70 @@ func Login(c *gin.Context) {
 		return
 	}
 
+	//A cart filled in as a guest carries over to the account
+	cartToken := loginReq.CartToken
+	if cartToken == "" {
+		cartToken = c.GetHeader(cartTokenHeader)
+	}
+	if cartToken != "" {
+		if err := mergeGuestCart(user.ID, cartToken); err != nil {
+			log.Printf("merging guest cart into cart of user %d failed: %v", user.ID, err)
+		}
+	}
+
 	c.JSON(http.StatusOK, models.AuthResponse{
 		Token: token,
 		User:  user,
 	})
 }
 
+// Read the user id that AuthMiddleware stored from the token claims
+func currentUserID(c *gin.Context) (uint, bool) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+		return 0, false
+	}
+
+	switch v := userID.(type) {
+	case float64:
+		return uint(v), true
+	case int:
+		return uint(v), true
+	case int64:
+		return uint(v), true
+	case uint:
+		return v, true
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid user ID type"})
+		return 0, false
+	}
+}
+
+// Read the claims of the bearer token in the Authorization header
+func parseToken(authHeader string) (jwt.MapClaims, error) {
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		return nil, errors.New("invalid token")
+	}
+	tokenString := authHeader[len("Bearer "):]
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		return jwtSecret, nil
+	})
+
+	if err != nil || !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, errors.New("invalid token claims")
+	}
+	return claims, nil
+}
+
 // Middleware to validate the every protected api
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -83,28 +144,55 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		tokenString := authHeader[len("Bearer "):]
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, jwt.ErrSignatureInvalid
-			}
-			return jwtSecret, nil
-		})
-
-		if err != nil || !token.Valid {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+		claims, err := parseToken(authHeader)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
 			c.Abort()
 			return
 		}
 
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid token claims"})
+		c.Set("userID", claims["user_id"])
+		c.Set("role", claims["role"])
+		c.Next()
+	}
+}
+
+// Middleware for routes open to guests that behave differently for signed-in
+// users; a missing token lets the request through as a guest
+func OptionalAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		authHeader := c.GetHeader("Authorization")
+		if authHeader == "" {
+			c.Next()
+			return
+		}
+
+		claims, err := parseToken(authHeader)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
 			c.Abort()
 			return
 		}
 
 		c.Set("userID", claims["user_id"])
+		c.Set("role", claims["role"])
+		c.Next()
+	}
+}
+
+func isAdmin(c *gin.Context) bool {
+	role, _ := c.Get("role")
+	return role == models.RoleAdmin
+}
+
+// Middleware for routes that only admins may use, placed after AuthMiddleware
+func AdminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !isAdmin(c) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "admin access required"})
+			c.Abort()
+			return
+		}
 		c.Next()
 	}
 }
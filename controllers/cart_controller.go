@@ -0,0 +1,503 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/umesh/ginapi/config"
+	"github.com/umesh/ginapi/models"
+)
+
+// Guests name their cart with this header; the token is handed out when the
+// first item is added
+const cartTokenHeader = "X-Cart-Token"
+
+// An item that cannot go in the cart, with the status to answer with
+type cartError struct {
+	status  int
+	message string
+}
+
+func (e cartError) Error() string {
+	return e.message
+}
+
+func newCartToken() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Create the cart of a user, or return the one they already have
+func userCart(q execer, userID uint) (uint, error) {
+	result, err := q.Exec(
+		"INSERT INTO carts (user_id) VALUES (?) ON DUPLICATE KEY UPDATE id = LAST_INSERT_ID(id)",
+		userID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return uint(id), err
+}
+
+// Find the cart of the signed-in user, or the guest cart named by the cart
+// token header. With create set a cart is made when there is none; the token
+// returned is only set for guest carts.
+func findCart(c *gin.Context, create bool) (uint, string, error) {
+	if _, signedIn := c.Get("userID"); signedIn {
+		userID, ok := currentUserID(c)
+		if !ok {
+			return 0, "", errors.New("invalid user ID type")
+		}
+		if create {
+			id, err := userCart(config.DB, userID)
+			return id, "", err
+		}
+
+		var id uint
+		err := config.DB.QueryRow("SELECT id FROM carts WHERE user_id = ?", userID).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, "", nil
+		}
+		return id, "", err
+	}
+
+	token := c.GetHeader(cartTokenHeader)
+	if token != "" {
+		var id uint
+		err := config.DB.QueryRow("SELECT id FROM carts WHERE token = ? AND user_id IS NULL", token).Scan(&id)
+		if err == nil {
+			return id, token, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return 0, "", err
+		}
+	}
+	if !create {
+		return 0, "", nil
+	}
+
+	//Unknown tokens, e.g. of a cart merged at login, get a fresh cart
+	token, err := newCartToken()
+	if err != nil {
+		return 0, "", err
+	}
+	result, err := config.DB.Exec("INSERT INTO carts (token) VALUES (?)", token)
+	if err != nil {
+		return 0, "", err
+	}
+	id, err := result.LastInsertId()
+	return uint(id), token, err
+}
+
+// Check that quantity units of a product can go in a cart at today's stock
+func checkCartQuantity(productID uint, variantID *uint, quantity int) error {
+	var stock int
+	err := config.DB.QueryRow(
+		"SELECT quantity FROM products WHERE id = ? AND deleted_at IS NULL",
+		productID,
+	).Scan(&stock)
+	if errors.Is(err, sql.ErrNoRows) {
+		return cartError{http.StatusNotFound, "product not found"}
+	}
+	if err != nil {
+		return err
+	}
+
+	if variantID != nil {
+		err := config.DB.QueryRow(
+			"SELECT quantity FROM product_variants WHERE id = ? AND product_id = ? AND deleted_at IS NULL",
+			*variantID, productID,
+		).Scan(&stock)
+		if errors.Is(err, sql.ErrNoRows) {
+			return cartError{http.StatusNotFound, "variant not found"}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	reserved, err := reservedStock(config.DB, productID, variantID, nil)
+	if err != nil {
+		return err
+	}
+	if available := stock - reserved; available < quantity {
+		return cartError{http.StatusConflict, fmt.Sprintf("insufficient stock (available: %d, requested: %d)", available, quantity)}
+	}
+	return nil
+}
+
+func respondCartError(c *gin.Context, err error) {
+	var invalid cartError
+	if errors.As(err, &invalid) {
+		c.JSON(invalid.status, gin.H{"error": invalid.message})
+	} else {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// Load a cart with the current prices and stock of its items
+func loadCart(cartID uint) (models.Cart, error) {
+	cart := models.Cart{ID: cartID, Items: []models.CartItem{}, Valid: true}
+	var token sql.NullString
+	err := config.DB.QueryRow("SELECT token, updated_at FROM carts WHERE id = ?", cartID).Scan(&token, &cart.UpdatedAt)
+	if err != nil {
+		return cart, err
+	}
+	cart.Token = token.String
+
+	rows, err := config.DB.Query(`
+		SELECT ci.id, ci.product_id, ci.variant_id, ci.quantity, p.name, v.sku,
+		       COALESCE(v.price, p.price), COALESCE(v.quantity, p.quantity),
+		       p.deleted_at IS NOT NULL, ci.variant_id IS NOT NULL AND (v.id IS NULL OR v.deleted_at IS NOT NULL)
+		FROM cart_items ci
+		JOIN products p ON p.id = ci.product_id
+		LEFT JOIN product_variants v ON v.id = ci.variant_id
+		WHERE ci.cart_id = ?
+		ORDER BY ci.id`,
+		cartID,
+	)
+	if err != nil {
+		return cart, err
+	}
+	defer rows.Close()
+
+	var stock []int
+	var unavailable []bool
+	for rows.Next() {
+		var item models.CartItem
+		var sku sql.NullString
+		var quantity int
+		var deleted, variantGone bool
+		if err := rows.Scan(
+			&item.ID,
+			&item.ProductID,
+			&item.VariantID,
+			&item.Quantity,
+			&item.Name,
+			&sku,
+			&item.UnitPrice,
+			&quantity,
+			&deleted,
+			&variantGone,
+		); err != nil {
+			return cart, err
+		}
+		if sku.Valid {
+			item.Name = fmt.Sprintf("%s (%s)", item.Name, sku.String)
+		}
+		item.LineTotal = roundMoney(item.UnitPrice * float64(item.Quantity))
+		switch {
+		case deleted:
+			item.Problem = "product is no longer available"
+		case variantGone:
+			item.Problem = "variant is no longer available"
+		}
+		cart.Items = append(cart.Items, item)
+		stock = append(stock, quantity)
+		unavailable = append(unavailable, deleted || variantGone)
+	}
+	if err := rows.Err(); err != nil {
+		return cart, err
+	}
+
+	for i := range cart.Items {
+		item := &cart.Items[i]
+		if unavailable[i] {
+			cart.Valid = false
+			continue
+		}
+		reserved, err := reservedStock(config.DB, item.ProductID, item.VariantID, nil)
+		if err != nil {
+			return cart, err
+		}
+		item.Available = stock[i] - reserved
+		if item.Available < item.Quantity {
+			item.Problem = fmt.Sprintf("only %d available", max(item.Available, 0))
+			cart.Valid = false
+		}
+		cart.Subtotal = roundMoney(cart.Subtotal + item.LineTotal)
+	}
+
+	return cart, nil
+}
+
+func respondWithCart(c *gin.Context, status int, cartID uint, token string) {
+	cart, err := loadCart(cartID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if token != "" {
+		c.Header(cartTokenHeader, token)
+	}
+	c.JSON(status, cart)
+}
+
+func GetCart(c *gin.Context) {
+	cartID, token, err := findCart(c, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if cartID == 0 {
+		c.JSON(http.StatusOK, models.Cart{Items: []models.CartItem{}, Valid: true})
+		return
+	}
+
+	respondWithCart(c, http.StatusOK, cartID, token)
+}
+
+// Add an item, or more of one already in the cart
+func AddCartItem(c *gin.Context) {
+	var req models.CartItemRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	cartID, token, err := findCart(c, true)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var inCart int
+	err = config.DB.QueryRow(`
+		SELECT COALESCE(SUM(quantity), 0) FROM cart_items
+		WHERE cart_id = ? AND product_id = ? AND variant_id <=> ?`,
+		cartID, req.ProductID, req.VariantID,
+	).Scan(&inCart)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := checkCartQuantity(req.ProductID, req.VariantID, inCart+req.Quantity); err != nil {
+		respondCartError(c, err)
+		return
+	}
+
+	_, err = config.DB.Exec(`
+		INSERT INTO cart_items (cart_id, product_id, variant_id, quantity)
+		VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE quantity = quantity + VALUES(quantity)`,
+		cartID, req.ProductID, req.VariantID, req.Quantity,
+	)
+	if err == nil {
+		_, err = config.DB.Exec("UPDATE carts SET updated_at = NOW() WHERE id = ?", cartID)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	respondWithCart(c, http.StatusCreated, cartID, token)
+}
+
+// Set the quantity of an item in the cart
+func UpdateCartItem(c *gin.Context) {
+	var req models.UpdateCartItemRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	cartID, token, err := findCart(c, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var productID uint
+	var variantID *uint
+	err = config.DB.QueryRow(
+		"SELECT product_id, variant_id FROM cart_items WHERE id = ? AND cart_id = ?",
+		c.Param("itemId"), cartID,
+	).Scan(&productID, &variantID)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "cart item not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := checkCartQuantity(productID, variantID, req.Quantity); err != nil {
+		respondCartError(c, err)
+		return
+	}
+
+	_, err = config.DB.Exec("UPDATE cart_items SET quantity = ? WHERE id = ?", req.Quantity, c.Param("itemId"))
+	if err == nil {
+		_, err = config.DB.Exec("UPDATE carts SET updated_at = NOW() WHERE id = ?", cartID)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	respondWithCart(c, http.StatusOK, cartID, token)
+}
+
+func RemoveCartItem(c *gin.Context) {
+	cartID, token, err := findCart(c, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := config.DB.Exec("DELETE FROM cart_items WHERE id = ? AND cart_id = ?", c.Param("itemId"), cartID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if affected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "cart item not found"})
+		return
+	}
+
+	respondWithCart(c, http.StatusOK, cartID, token)
+}
+
+// Turn the user's cart into an order. The order goes through placeOrder like
+// CreateOrder, and the cart is emptied in the same transaction.
+func CheckoutCart(c *gin.Context) {
+	var req models.CheckoutRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	cartID, err := userCart(tx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	rows, err := tx.Query(
+		"SELECT product_id, variant_id, quantity FROM cart_items WHERE cart_id = ? ORDER BY id FOR UPDATE",
+		cartID,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	orderReq := models.CreateOrderRequest{
+		CouponCode:     req.CouponCode,
+		Region:         req.Region,
+		ShippingMethod: req.ShippingMethod,
+		ReservationID:  req.ReservationID,
+		Allocation:     req.Allocation,
+		Latitude:       req.Latitude,
+		Longitude:      req.Longitude,
+	}
+	for rows.Next() {
+		var item models.OrderItemRequest
+		if err := rows.Scan(&item.ProductID, &item.VariantID, &item.Quantity); err != nil {
+			rows.Close()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		orderReq.Items = append(orderReq.Items, item)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(orderReq.Items) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cart is empty"})
+		return
+	}
+
+	order, err := placeOrder(tx, userID, orderReq)
+	if err != nil {
+		respondOrderError(c, err)
+		return
+	}
+
+	if _, err := tx.Exec("DELETE FROM cart_items WHERE cart_id = ?", cartID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	orderPlaced(order)
+
+	c.JSON(http.StatusCreated, order)
+}
+
+// Move the items of a guest cart into the user's cart, adding up quantities
+// of items in both, and drop the guest cart
+func mergeGuestCart(userID uint, token string) error {
+	tx, err := config.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var guestCartID uint
+	err = tx.QueryRow("SELECT id FROM carts WHERE token = ? AND user_id IS NULL FOR UPDATE", token).Scan(&guestCartID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	cartID, err := userCart(tx, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO cart_items (cart_id, product_id, variant_id, quantity)
+		SELECT ?, g.product_id, g.variant_id, g.quantity
+		FROM (SELECT product_id, variant_id, quantity FROM cart_items WHERE cart_id = ?) g
+		ON DUPLICATE KEY UPDATE quantity = cart_items.quantity + g.quantity`,
+		cartID, guestCartID,
+	)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM carts WHERE id = ?", guestCartID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,58 @@
+package controllers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Products carry a version that every write increments; the ETag is derived from it
+func productETag(version int) string {
+	return fmt.Sprintf(`"v%d"`, version)
+}
+
+// Report whether an If-Match or If-None-Match header lists the ETag.
+// Weak validators never match, as If-Match requires strong comparison.
+func etagListed(header, etag string, allowWeak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.HasPrefix(candidate, "W/") {
+			if !allowWeak {
+				continue
+			}
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Require an If-Match header naming the current version of the product.
+// Responds with 428 when the header is missing and 412 when it is stale.
+func checkIfMatch(c *gin.Context, version int) bool {
+	header := c.GetHeader("If-Match")
+	if header == "" {
+		c.JSON(http.StatusPreconditionRequired, gin.H{"error": "If-Match header is required"})
+		return false
+	}
+	if !etagListed(header, productETag(version), false) {
+		c.Header("ETag", productETag(version))
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": "product has been modified, reload it and try again"})
+		return false
+	}
+	return true
+}
+
+// Mark a product as changed when something shown on it, such as a variant, changes
+func bumpProductVersion(tx *sql.Tx, productID uint) error {
+	_, err := tx.Exec("UPDATE products SET version = version + 1 WHERE id = ?", productID)
+	return err
+}
@@ -0,0 +1,127 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-sql-driver/mysql"
+	"github.com/umesh/ginapi/config"
+)
+
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// How long a key is remembered after its first use
+var idempotencyTTL = 24 * time.Hour
+
+// MySQL error number for a duplicate unique key
+const errDuplicateEntry = 1062
+
+// A response stored under an idempotency key
+type idempotentResponse struct {
+	fingerprint string
+	statusCode  int
+	body        []byte
+}
+
+// Fingerprint of the bound request, so that reformatting the JSON of a retry
+// does not count as a different request
+func requestFingerprint(c *gin.Context, req interface{}) (string, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(append([]byte(c.Request.Method+" "+c.FullPath()+"\n"), body...))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Claim a key inside the transaction that does the work, so the key and its
+// response are stored together or not at all. A concurrent request with the
+// same key waits on the row lock until this transaction ends. Returns false
+// with no error when the key is already taken.
+func claimIdempotencyKey(tx *sql.Tx, userID uint, key, fingerprint string) (int64, bool, error) {
+	result, err := tx.Exec(`
+		INSERT INTO idempotency_keys (user_id, idem_key, fingerprint, expires_at)
+		VALUES (?, ?, ?, DATE_ADD(NOW(), INTERVAL ? SECOND))`,
+		userID, key, fingerprint, int(idempotencyTTL.Seconds()),
+	)
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == errDuplicateEntry {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	id, err := result.LastInsertId()
+	return id, true, err
+}
+
+func storeIdempotentResponse(tx *sql.Tx, id int64, statusCode int, response interface{}) error {
+	body, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		"UPDATE idempotency_keys SET status_code = ?, response = ? WHERE id = ?",
+		statusCode, body, id,
+	)
+	return err
+}
+
+// Look up the response stored under a key. Expired keys are removed and
+// reported as missing so the request can run again.
+func findIdempotentResponse(userID uint, key string) (*idempotentResponse, error) {
+	var stored idempotentResponse
+	var expired bool
+	err := config.DB.QueryRow(`
+		SELECT fingerprint, status_code, response, expires_at <= NOW()
+		FROM idempotency_keys WHERE user_id = ? AND idem_key = ?`,
+		userID, key,
+	).Scan(&stored.fingerprint, &stored.statusCode, &stored.body, &expired)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if expired {
+		_, err := config.DB.Exec("DELETE FROM idempotency_keys WHERE user_id = ? AND idem_key = ?", userID, key)
+		return nil, err
+	}
+	return &stored, nil
+}
+
+// Answer a retry with the stored response, or with 422 when the key was
+// first used for a different request
+func replayIdempotentResponse(c *gin.Context, stored *idempotentResponse, fingerprint string) {
+	if stored.fingerprint != fingerprint {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key was already used with a different request"})
+		return
+	}
+	c.Header("Idempotent-Replayed", "true")
+	c.Data(stored.statusCode, "application/json; charset=utf-8", stored.body)
+}
+
+// StartIdempotencyKeyCleaner sets how long keys are kept and removes expired
+// keys on the given interval
+func StartIdempotencyKeyCleaner(ttl, interval time.Duration) {
+	idempotencyTTL = ttl
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if _, err := config.DB.Exec("DELETE FROM idempotency_keys WHERE expires_at <= NOW()"); err != nil {
+				log.Printf("idempotency key cleanup failed: %v", err)
+			}
+			<-ticker.C
+		}
+	}()
+}
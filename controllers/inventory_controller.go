@@ -0,0 +1,380 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/umesh/ginapi/config"
+	"github.com/umesh/ginapi/models"
+)
+
+// Write a ledger row for a stock change that has already been applied in tx.
+// The resulting stock level and the purchase_rate are read from the product or
+// variant row, so this must run after the quantity update.
+func recordMovement(tx *sql.Tx, movement models.InventoryMovement) error {
+	if movement.QuantityChange == 0 {
+		return nil
+	}
+
+	var result sql.Result
+	var err error
+	if movement.VariantID != nil {
+		result, err = tx.Exec(`
+			INSERT INTO inventory_movements
+				(product_id, variant_id, warehouse_id, quantity_change, quantity_after, reason, reference, unit_cost, user_id, note)
+			SELECT p.id, v.id, ?, ?, v.quantity, ?, ?, p.purchase_rate, ?, ?
+			FROM product_variants v
+			JOIN products p ON p.id = v.product_id
+			WHERE v.id = ?`,
+			movement.WarehouseID, movement.QuantityChange, movement.Reason, nullableString(movement.Reference),
+			movement.UserID, nullableString(movement.Note), *movement.VariantID,
+		)
+	} else {
+		result, err = tx.Exec(`
+			INSERT INTO inventory_movements
+				(product_id, warehouse_id, quantity_change, quantity_after, reason, reference, unit_cost, user_id, note)
+			SELECT id, ?, ?, quantity, ?, ?, purchase_rate, ?, ?
+			FROM products
+			WHERE id = ?`,
+			movement.WarehouseID, movement.QuantityChange, movement.Reason, nullableString(movement.Reference),
+			movement.UserID, nullableString(movement.Note), movement.ProductID,
+		)
+	}
+	if err != nil {
+		return err
+	}
+
+	//Every ledger row is a stock change webhook subscribers hear about
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	var quantityAfter int
+	if err := tx.QueryRow("SELECT quantity_after FROM inventory_movements WHERE id = ?", id).Scan(&quantityAfter); err != nil {
+		return err
+	}
+	return emitEvent(tx, models.EventProductStockChanged, gin.H{
+		"movement_id":     id,
+		"product_id":      movement.ProductID,
+		"variant_id":      movement.VariantID,
+		"warehouse_id":    movement.WarehouseID,
+		"quantity_change": movement.QuantityChange,
+		"quantity_after":  quantityAfter,
+		"reason":          movement.Reason,
+		"reference":       movement.Reference,
+	})
+}
+
+// Accept either a full RFC3339 timestamp or a plain date
+func parseTimeParam(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, errors.New("invalid time " + strconv.Quote(value) + ", expected RFC3339 or YYYY-MM-DD")
+	}
+	return t, nil
+}
+
+// Record a manual restock, adjustment or customer return
+func CreateInventoryMovement(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	var req models.CreateMovementRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Reason != models.MovementAdjustment && req.QuantityChange < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "only adjustments can reduce stock"})
+		return
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	var quantity int
+	if req.VariantID != nil {
+		err = tx.QueryRow(
+			"SELECT quantity FROM product_variants WHERE id = ? AND product_id = ? FOR UPDATE",
+			*req.VariantID, req.ProductID,
+		).Scan(&quantity)
+	} else {
+		err = tx.QueryRow("SELECT quantity FROM products WHERE id = ? FOR UPDATE", req.ProductID).Scan(&quantity)
+	}
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "product not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	if quantity+req.QuantityChange < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "stock cannot go below zero"})
+		return
+	}
+
+	//Stock taken from a warehouse comes out of that location, otherwise only
+	//the stock not held at any warehouse can be reduced
+	if req.WarehouseID != nil {
+		exists, err := activeWarehouseExists(tx, *req.WarehouseID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "warehouse not found"})
+			return
+		}
+		err = changeWarehouseStock(tx, *req.WarehouseID, req.ProductID, req.VariantID, req.QuantityChange)
+		if errors.Is(err, errInsufficientLocationStock) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "stock at the warehouse cannot go below zero"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	} else if req.QuantityChange < 0 {
+		assigned, err := assignedStock(tx, req.ProductID, req.VariantID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if quantity-assigned+req.QuantityChange < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("only %d units are not held at a warehouse, give the warehouse_id to take stock from", quantity-assigned),
+			})
+			return
+		}
+	}
+
+	if req.VariantID != nil {
+		_, err = tx.Exec("UPDATE product_variants SET quantity = quantity + ? WHERE id = ?", req.QuantityChange, *req.VariantID)
+		if err == nil {
+			err = bumpProductVersion(tx, req.ProductID)
+		}
+	} else {
+		_, err = tx.Exec("UPDATE products SET quantity = quantity + ?, version = version + 1 WHERE id = ?", req.QuantityChange, req.ProductID)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = recordMovement(tx, models.InventoryMovement{
+		ProductID:      req.ProductID,
+		VariantID:      req.VariantID,
+		WarehouseID:    req.WarehouseID,
+		QuantityChange: req.QuantityChange,
+		Reason:         req.Reason,
+		Reference:      req.Reference,
+		UserID:         &userID,
+		Note:           req.Note,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":  "Stock movement recorded",
+		"quantity": quantity + req.QuantityChange,
+	})
+}
+
+func GetInventoryMovements(c *gin.Context) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit < 1 {
+		limit = 20
+	}
+
+	var conditions []string
+	var args []interface{}
+	if productID := c.Query("product_id"); productID != "" {
+		conditions, args = append(conditions, "product_id = ?"), append(args, productID)
+	}
+	if variantID := c.Query("variant_id"); variantID != "" {
+		conditions, args = append(conditions, "variant_id = ?"), append(args, variantID)
+	}
+	if warehouseID := c.Query("warehouse_id"); warehouseID != "" {
+		conditions, args = append(conditions, "warehouse_id = ?"), append(args, warehouseID)
+	}
+	if reason := c.Query("reason"); reason != "" {
+		conditions, args = append(conditions, "reason = ?"), append(args, reason)
+	}
+	if from := c.Query("from"); from != "" {
+		t, err := parseTimeParam(from)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		conditions, args = append(conditions, "created_at >= ?"), append(args, t)
+	}
+	if to := c.Query("to"); to != "" {
+		t, err := parseTimeParam(to)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		conditions, args = append(conditions, "created_at <= ?"), append(args, t)
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var total int
+	err = config.DB.QueryRow("SELECT COUNT(*) FROM inventory_movements "+where, args...).Scan(&total)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	rows, err := config.DB.Query(`
+		SELECT id, product_id, variant_id, warehouse_id, quantity_change, quantity_after, reason,
+		       COALESCE(reference, ''), unit_cost, user_id, COALESCE(note, ''), created_at
+		FROM inventory_movements `+where+`
+		ORDER BY created_at DESC, id DESC
+		LIMIT ? OFFSET ?`,
+		append(args, limit, (page-1)*limit)...,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	movements := []models.InventoryMovement{}
+	for rows.Next() {
+		var movement models.InventoryMovement
+		if err := rows.Scan(
+			&movement.ID,
+			&movement.ProductID,
+			&movement.VariantID,
+			&movement.WarehouseID,
+			&movement.QuantityChange,
+			&movement.QuantityAfter,
+			&movement.Reason,
+			&movement.Reference,
+			&movement.UnitCost,
+			&movement.UserID,
+			&movement.Note,
+			&movement.CreatedAt,
+		); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		movements = append(movements, movement)
+	}
+
+	if err = rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": movements,
+		"pagination": gin.H{
+			"total":       total,
+			"page":        page,
+			"limit":       limit,
+			"total_pages": int(math.Ceil(float64(total) / float64(limit))),
+		},
+	})
+}
+
+// Reconstruct the stock level at a point in time by rolling the current
+// quantity back through every movement recorded after it
+func GetStockAt(c *gin.Context) {
+	productID, ok := parseProductID(c)
+	if !ok {
+		return
+	}
+
+	at := time.Now()
+	if value := c.Query("at"); value != "" {
+		t, err := parseTimeParam(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		at = t
+	}
+
+	snapshot := models.StockSnapshot{ProductID: productID, At: at}
+
+	var err error
+	var laterChanges int
+	if value := c.Query("variant_id"); value != "" {
+		variantID, convErr := strconv.Atoi(value)
+		if convErr != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid variant ID"})
+			return
+		}
+		id := uint(variantID)
+		snapshot.VariantID = &id
+
+		err = config.DB.QueryRow(
+			"SELECT quantity FROM product_variants WHERE id = ? AND product_id = ?",
+			variantID, productID,
+		).Scan(&snapshot.Quantity)
+		if err == nil {
+			err = config.DB.QueryRow(`
+				SELECT COALESCE(SUM(quantity_change), 0)
+				FROM inventory_movements
+				WHERE variant_id = ? AND created_at > ?`,
+				variantID, at,
+			).Scan(&laterChanges)
+		}
+	} else {
+		err = config.DB.QueryRow("SELECT quantity FROM products WHERE id = ?", productID).Scan(&snapshot.Quantity)
+		if err == nil {
+			err = config.DB.QueryRow(`
+				SELECT COALESCE(SUM(quantity_change), 0)
+				FROM inventory_movements
+				WHERE product_id = ? AND variant_id IS NULL AND created_at > ?`,
+				productID, at,
+			).Scan(&laterChanges)
+		}
+	}
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "variant not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	snapshot.Quantity -= laterChanges
+	c.JSON(http.StatusOK, snapshot)
+}
@@ -0,0 +1,331 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/umesh/ginapi/config"
+	"github.com/umesh/ginapi/models"
+	"github.com/umesh/ginapi/utils"
+)
+
+var invoiceSeller models.Seller
+
+// SetInvoiceSeller sets the seller details printed on new invoices
+func SetInvoiceSeller(seller models.Seller) {
+	invoiceSeller = seller
+}
+
+// Orders get an invoice once they have been paid
+var invoicedOrderStatuses = map[string]bool{
+	models.OrderPaid:       true,
+	models.OrderProcessing: true,
+	models.OrderShipped:    true,
+	models.OrderDelivered:  true,
+	models.OrderRefunded:   true,
+}
+
+// Everything printed on an invoice besides the seller
+type invoiceData struct {
+	invoice  models.Invoice
+	order    models.Order
+	customer models.User
+	// Item names with the variant SKU, by order item ID
+	names map[uint]string
+	paid  float64
+}
+
+// Take the next invoice number. The row lock is held until tx ends, so a
+// rolled back invoice gives its number back.
+func nextInvoiceNumber(tx *sql.Tx) (string, error) {
+	var next int
+	if err := tx.QueryRow("SELECT next_number FROM invoice_sequence WHERE id = 1 FOR UPDATE").Scan(&next); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec("UPDATE invoice_sequence SET next_number = next_number + 1 WHERE id = 1"); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("INV-%06d", next), nil
+}
+
+func loadInvoiceData(tx *sql.Tx, orderID int64) (invoiceData, error) {
+	data := invoiceData{names: map[uint]string{}}
+	order := &data.order
+	err := tx.QueryRow(`
+		SELECT o.id, o.user_id, o.subtotal, o.discount_amount, o.tax_amount, o.shipping_amount, o.total_amount, o.status, o.created_at, u.name, u.email
+		FROM orders o
+		JOIN users u ON u.id = o.user_id
+		WHERE o.id = ?`,
+		orderID,
+	).Scan(
+		&order.ID,
+		&order.UserID,
+		&order.Subtotal,
+		&order.DiscountAmount,
+		&order.TaxAmount,
+		&order.ShippingAmount,
+		&order.TotalAmount,
+		&order.Status,
+		&order.CreatedAt,
+		&data.customer.Name,
+		&data.customer.Email,
+	)
+	if err != nil {
+		return data, err
+	}
+
+	rows, err := tx.Query(`
+		SELECT oi.id, oi.product_id, oi.variant_id, oi.quantity, oi.unit_price, oi.total_price, oi.discount_amount,
+		       oi.tax_amount, oi.tax_inclusive, p.name, v.sku
+		FROM order_items oi
+		JOIN products p ON p.id = oi.product_id
+		LEFT JOIN product_variants v ON v.id = oi.variant_id
+		WHERE oi.order_id = ?
+		ORDER BY oi.id`,
+		orderID,
+	)
+	if err != nil {
+		return data, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item models.OrderItem
+		var name string
+		var sku sql.NullString
+		if err := rows.Scan(
+			&item.ID,
+			&item.ProductID,
+			&item.VariantID,
+			&item.Quantity,
+			&item.UnitPrice,
+			&item.TotalPrice,
+			&item.DiscountAmount,
+			&item.TaxAmount,
+			&item.TaxInclusive,
+			&name,
+			&sku,
+		); err != nil {
+			return data, err
+		}
+		if sku.Valid {
+			name = fmt.Sprintf("%s (%s)", name, sku.String)
+		}
+		data.names[item.ID] = name
+		order.OrderItems = append(order.OrderItems, item)
+	}
+	if err := rows.Err(); err != nil {
+		return data, err
+	}
+
+	err = tx.QueryRow(
+		"SELECT COALESCE(SUM(amount), 0) FROM payments WHERE order_id = ? AND status IN (?, ?)",
+		orderID, models.PaymentSucceeded, models.PaymentRefunded,
+	).Scan(&data.paid)
+	return data, err
+}
+
+func formatMoney(amount float64) string {
+	return fmt.Sprintf("%.2f", amount)
+}
+
+// Cut text to fit a column, marking the cut
+func truncateText(text string, max int) string {
+	runes := []rune(text)
+	if len(runes) <= max {
+		return text
+	}
+	return string(runes[:max-3]) + "..."
+}
+
+func renderInvoice(data invoiceData, seller models.Seller) []byte {
+	const (
+		left       = 50.0
+		right      = utils.PDFPageWidth - 50
+		top        = utils.PDFPageHeight - 50
+		bottom     = 80.0
+		lineHeight = 16.0
+	)
+	pdf := utils.NewPDF()
+	order := data.order
+
+	y := top
+	pdf.Text(left, y, 20, true, "INVOICE")
+	pdf.TextRight(right, y, 12, true, seller.Name)
+	y -= 24
+	for _, line := range []string{seller.Address, seller.Email, taxIDLine(seller.TaxID)} {
+		if line != "" {
+			pdf.TextRight(right, y, 9, false, line)
+			y -= 12
+		}
+	}
+
+	y = top - 40
+	for _, line := range [][2]string{
+		{"Invoice number", data.invoice.Number},
+		{"Invoice date", data.invoice.IssuedAt.Format("2006-01-02")},
+		{"Order", fmt.Sprintf("#%d", order.ID)},
+		{"Order date", order.CreatedAt.Format("2006-01-02")},
+	} {
+		pdf.Text(left, y, 10, true, line[0])
+		pdf.Text(left+100, y, 10, false, line[1])
+		y -= 14
+	}
+
+	y -= 10
+	pdf.Text(left, y, 10, true, "Bill to")
+	y -= 14
+	pdf.Text(left, y, 10, false, data.customer.Name)
+	y -= 14
+	pdf.Text(left, y, 10, false, data.customer.Email)
+	y -= 30
+
+	tableHeader := func() {
+		pdf.Text(left, y, 10, true, "Item")
+		pdf.TextRight(330, y, 10, true, "Qty")
+		pdf.TextRight(410, y, 10, true, "Unit price")
+		pdf.TextRight(480, y, 10, true, "Discount")
+		pdf.TextRight(right, y, 10, true, "Amount")
+		y -= 6
+		pdf.Line(left, y, right, y)
+		y -= lineHeight
+	}
+	tableHeader()
+
+	var includedTax float64
+	for _, item := range order.OrderItems {
+		if y < bottom {
+			pdf.AddPage()
+			y = top
+			tableHeader()
+		}
+		pdf.Text(left, y, 10, false, truncateText(data.names[item.ID], 45))
+		pdf.TextRight(330, y, 10, false, strconv.Itoa(item.Quantity))
+		pdf.TextRight(410, y, 10, false, formatMoney(item.UnitPrice))
+		pdf.TextRight(480, y, 10, false, formatMoney(item.DiscountAmount))
+		pdf.TextRight(right, y, 10, false, formatMoney(item.TotalPrice-item.DiscountAmount))
+		if item.TaxInclusive {
+			includedTax += item.TaxAmount
+		}
+		y -= lineHeight
+	}
+
+	//Tax already in the prices is shown under the total instead of being added to it
+	includedTax = roundMoney(includedTax)
+	totals := [][2]string{
+		{"Subtotal", formatMoney(order.Subtotal)},
+		{"Discounts", "-" + formatMoney(order.DiscountAmount)},
+		{"Shipping", formatMoney(order.ShippingAmount)},
+		{"Tax", formatMoney(roundMoney(order.TaxAmount - includedTax))},
+		{"Total", formatMoney(order.TotalAmount)},
+	}
+	if includedTax > 0 {
+		totals = append(totals, [2]string{"Includes tax", formatMoney(includedTax)})
+	}
+	totals = append(totals,
+		[2]string{"Amount paid", formatMoney(data.paid)},
+		[2]string{"Balance due", formatMoney(roundMoney(order.TotalAmount - data.paid))},
+	)
+
+	if y < bottom+float64(len(totals))*lineHeight {
+		pdf.AddPage()
+		y = top
+	}
+	pdf.Line(left, y+lineHeight-6, right, y+lineHeight-6)
+	y -= 4
+	for _, line := range totals {
+		bold := line[0] == "Total" || line[0] == "Balance due"
+		pdf.TextRight(460, y, 10, bold, line[0])
+		pdf.TextRight(right, y, 10, bold, line[1])
+		y -= lineHeight
+	}
+
+	return pdf.Bytes()
+}
+
+func taxIDLine(taxID string) string {
+	if taxID == "" {
+		return ""
+	}
+	return "Tax ID: " + taxID
+}
+
+// Download the invoice of an order. It is numbered and rendered on the first
+// download and the stored PDF is served from then on.
+func GetOrderInvoice(c *gin.Context) {
+	orderID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order ID"})
+		return
+	}
+
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	//Locking the order keeps two first downloads from issuing two invoices
+	owner, status, err := lockOrder(tx, orderID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && owner != userID && !isAdmin(c)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var number string
+	var pdf []byte
+	err = tx.QueryRow("SELECT invoice_number, pdf FROM invoices WHERE order_id = ?", orderID).Scan(&number, &pdf)
+	if errors.Is(err, sql.ErrNoRows) {
+		if !invoicedOrderStatuses[status] {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("order is %s; invoices are issued once an order is paid", status)})
+			return
+		}
+
+		data, err := loadInvoiceData(tx, orderID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		number, err = nextInvoiceNumber(tx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		data.invoice = models.Invoice{
+			OrderID:  uint(orderID),
+			Number:   number,
+			IssuedAt: time.Now().Truncate(time.Second),
+		}
+		pdf = renderInvoice(data, invoiceSeller)
+
+		_, err = tx.Exec(
+			"INSERT INTO invoices (order_id, invoice_number, issued_at, pdf) VALUES (?, ?, ?, ?)",
+			orderID, number, data.invoice.IssuedAt, pdf,
+		)
+		if err == nil {
+			err = tx.Commit()
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf(`inline; filename="%s.pdf"`, number))
+	c.Data(http.StatusOK, "application/pdf", pdf)
+}
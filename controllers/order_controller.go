@@ -1,9 +1,13 @@
 package controllers
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/umesh/ginapi/config"
@@ -18,237 +22,557 @@ func CreateOrder(c *gin.Context) {
 	}
 
 	//Here the user id isnot given from the header it is get through the auth token
-	userID, exists := c.Get("userID")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+	userIDUint, ok := currentUserID(c)
+	if !ok {
 		return
 	}
 
-	//convert the user id in the int type from the hash to the normal key using the secret key
-	var userIDUint uint
-	switch v := userID.(type) {
-	case float64:
-		userIDUint = uint(v)
-	case int:
-		userIDUint = uint(v)
-	case int64:
-		userIDUint = uint(v)
-	case uint:
-		userIDUint = v
-	default:
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid user ID type"})
-		return
+	//A retry with the same Idempotency-Key gets the first response instead of a second order
+	key := c.GetHeader(idempotencyKeyHeader)
+	var fingerprint string
+	if key != "" {
+		if len(key) > 255 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key must be at most 255 characters"})
+			return
+		}
+		var err error
+		fingerprint, err = requestFingerprint(c, req)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		stored, err := findIdempotentResponse(userIDUint, key)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if stored != nil {
+			replayIdempotentResponse(c, stored, fingerprint)
+			return
+		}
 	}
 
-	fmt.Println("-----------Begin Transaction---------------")
 	tx, err := config.DB.Begin()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	defer func() {
-		if r := recover(); r != nil {
+	defer tx.Rollback()
+
+	var keyID int64
+	if key != "" {
+		id, claimed, err := claimIdempotencyKey(tx, userIDUint, key, fingerprint)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		//Another request with the key finished while this one waited for it
+		if !claimed {
 			tx.Rollback()
+			stored, err := findIdempotentResponse(userIDUint, key)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if stored == nil {
+				c.JSON(http.StatusConflict, gin.H{"error": "a request with this Idempotency-Key is in progress"})
+				return
+			}
+			replayIdempotentResponse(c, stored, fingerprint)
+			return
 		}
-	}()
+		keyID = id
+	}
+
+	order, err := placeOrder(tx, userIDUint, req)
+	if err != nil {
+		respondOrderError(c, err)
+		return
+	}
+
+	if key != "" {
+		if err := storeIdempotentResponse(tx, keyID, http.StatusCreated, order); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	orderPlaced(order)
+
+	c.JSON(http.StatusCreated, order)
+}
+
+// A problem with the order request itself, shown to the customer as a 400
+type orderError struct {
+	message string
+}
+
+func (e orderError) Error() string {
+	return e.message
+}
+
+func respondOrderError(c *gin.Context, err error) {
+	var invalid orderError
+	if errors.As(err, &invalid) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	} else {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// placeOrder checks stock, allocates warehouses, applies promotions, tax and
+// shipping and writes the order inside tx. Both CreateOrder and cart checkout go through here.
+func placeOrder(tx *sql.Tx, userID uint, req models.CreateOrderRequest) (models.Order, error) {
+	var order models.Order
+
+	strategy := req.Allocation
+	if strategy == "" {
+		strategy = models.AllocateMostStock
+	}
+	if strategy == models.AllocateNearest && (req.Latitude == nil || req.Longitude == nil) {
+		return order, orderError{"latitude and longitude are required for nearest allocation"}
+	}
+
+	//A reservation's own hold does not count against the stock it is used for
+	if req.ReservationID != nil {
+		if err := lockReservation(tx, *req.ReservationID, userID); err != nil {
+			var invalid reservationError
+			if errors.As(err, &invalid) {
+				return order, orderError{err.Error()}
+			}
+			return order, err
+		}
+	}
 
-	var totalAmount float64
+	var subtotal float64
+	var parcel shippingParcel
 	var orderItems []models.OrderItem
+	categories := make(map[uint]string)
+	taxClasses := make(map[uint]string)
 
-	fmt.Println("-----------------Loop-Begin-Product---------------")
-	//bsjfdtgf
-	fmt.Println("Loop go through the all elements on the list")
 	for _, item := range req.Items {
 		var product models.Product
 		err := tx.QueryRow(`
-			SELECT id, name, price, quantity 
+			SELECT id, name, COALESCE(category, ''), price, quantity, purchase_rate, tax_class, weight, length, width, height 
 			FROM products 
-			WHERE id = ? FOR UPDATE`,
+			WHERE id = ? AND deleted_at IS NULL FOR UPDATE`,
 			item.ProductID,
-		).Scan(&product.ID, &product.Name, &product.Price, &product.Quantity)
+		).Scan(
+			&product.ID, &product.Name, &product.Category, &product.Price, &product.Quantity, &product.PurchaseRate,
+			&product.TaxClass, &product.Weight, &product.Length, &product.Width, &product.Height,
+		)
 		if err != nil {
-			tx.Rollback()
-			c.JSON(http.StatusBadRequest, gin.H{"error": "product not found"})
-			return
+			return order, orderError{"product not found"}
+		}
+
+		//Variant items lock the variant row and take their stock and price from it
+		if item.VariantID != nil {
+			var sku string
+			var variantPrice sql.NullFloat64
+			err := tx.QueryRow(`
+				SELECT sku, price, quantity 
+				FROM product_variants 
+				WHERE id = ? AND product_id = ? AND deleted_at IS NULL FOR UPDATE`,
+				*item.VariantID, product.ID,
+			).Scan(&sku, &variantPrice, &product.Quantity)
+			if err != nil {
+				return order, orderError{"variant not found"}
+			}
+			product.Name = fmt.Sprintf("%s (%s)", product.Name, sku)
+			if variantPrice.Valid {
+				product.Price = variantPrice.Float64
+			}
+		}
+
+		//Stock held by other customers' reservations cannot be sold
+		reserved, err := reservedStock(tx, product.ID, item.VariantID, req.ReservationID)
+		if err != nil {
+			return order, err
 		}
 
 		//If the request quantity is grater than available then order cannot be placed
-		if product.Quantity < item.Quantity {
-			tx.Rollback()
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": fmt.Sprintf("insufficient stock for product %s (available: %d, requested: %d)",
-					product.Name, product.Quantity, item.Quantity),
-			})
-			return
+		if available := product.Quantity - reserved; available < item.Quantity {
+			return order, orderError{fmt.Sprintf("insufficient stock for product %s (available: %d, requested: %d)",
+				product.Name, available, item.Quantity)}
+		}
+
+		//Pick the warehouses the item ships from
+		allocations, err := allocateStock(tx, product.ID, item.VariantID, product.Quantity, item.Quantity, strategy, req.Latitude, req.Longitude)
+		if errors.Is(err, errInsufficientLocationStock) {
+			return order, orderError{fmt.Sprintf("insufficient stock for product %s at active warehouses", product.Name)}
+		}
+		if err != nil {
+			return order, err
 		}
 
 		itemTotal := product.Price * float64(item.Quantity)
-		totalAmount += itemTotal
+		subtotal += itemTotal
+		parcel.weight += chargeableWeight(product) * float64(item.Quantity)
+		categories[product.ID] = product.Category
+		taxClasses[product.ID] = product.TaxClass
 
 		orderItems = append(orderItems, models.OrderItem{
-			ProductID:  product.ID,
-			Quantity:   item.Quantity,
-			UnitPrice:  product.Price,
-			TotalPrice: itemTotal,
+			ProductID:   product.ID,
+			VariantID:   item.VariantID,
+			Quantity:    item.Quantity,
+			UnitPrice:   product.Price,
+			TotalPrice:  itemTotal,
+			UnitCost:    product.PurchaseRate,
+			Allocations: allocations,
 		})
 	}
-	fmt.Println("-----------------Loop-End-Product---------------")
-	//fgdfgdfgdfgfdg
+
+	//Automatic promotions and the coupon are taken off the total and shared out over the items
+	discounts, err := applyPromotions(tx, userID, req.CouponCode, orderItems, categories)
+	if err != nil {
+		var invalidCoupon couponError
+		if errors.As(err, &invalidCoupon) {
+			return order, orderError{err.Error()}
+		}
+		return order, err
+	}
+	var discountAmount float64
+	for _, discount := range discounts {
+		discountAmount = roundMoney(discountAmount + discount.Amount)
+	}
+	subtotal = roundMoney(subtotal)
+
+	//Tax is worked out per line after discounts; only exclusive tax adds to the total
+	region := normalizeRegion(req.Region)
+	addedTax, taxAmount, err := applyTax(tx, region, orderItems, taxClasses)
+	if err != nil {
+		return order, err
+	}
+
+	//The chosen shipping method must be one quoted for this parcel and region
+	var shipping *models.ShippingQuote
+	if req.ShippingMethod != "" {
+		if region == "" {
+			return order, orderError{"region is required to choose a shipping method"}
+		}
+		parcel.value = subtotal
+		quotes, err := quoteShipping(tx, region, parcel)
+		if err != nil {
+			return order, err
+		}
+		for i := range quotes {
+			if quotes[i].Code == req.ShippingMethod {
+				shipping = &quotes[i]
+			}
+		}
+		if shipping == nil {
+			return order, orderError{fmt.Sprintf("shipping method %s is not available for this order", req.ShippingMethod)}
+		}
+	}
+
+	totalAmount := roundMoney(subtotal - discountAmount + addedTax)
+	var shippingMethodID *uint
+	var shippingMethod string
+	var shippingAmount float64
+	if shipping != nil {
+		shippingMethodID, shippingMethod, shippingAmount = &shipping.MethodID, shipping.Name, shipping.Fee
+		totalAmount = roundMoney(totalAmount + shippingAmount)
+	}
+
 	result, err := tx.Exec(`
-		INSERT INTO orders (user_id, total_amount) 
-		VALUES (?, ?)`,
-		userIDUint, totalAmount,
+		INSERT INTO orders (user_id, subtotal, total_amount, discount_amount, tax_amount, tax_region,
+		                    shipping_method_id, shipping_method, shipping_amount) 
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		userID, subtotal, totalAmount, discountAmount, taxAmount, region,
+		shippingMethodID, nullableString(shippingMethod), shippingAmount,
 	)
 	if err != nil {
-		tx.Rollback()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		return order, err
 	}
 
 	orderID, err := result.LastInsertId()
 	if err != nil {
-		tx.Rollback()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		return order, err
+	}
+
+	if err := recordStatusChange(tx, orderID, "", models.OrderPending, &userID, ""); err != nil {
+		return order, err
+	}
+
+	if req.ReservationID != nil {
+		if err := consumeReservation(tx, *req.ReservationID, orderID); err != nil {
+			return order, err
+		}
+	}
+
+	if err := recordOrderDiscounts(tx, orderID, discounts); err != nil {
+		return order, err
 	}
 
 	//Insert the item in the order table with the loop
 	for _, item := range orderItems {
-		_, err := tx.Exec(`
-			INSERT INTO order_items (order_id, product_id, quantity, unit_price, total_price) 
-			VALUES (?, ?, ?, ?, ?)`,
-			orderID, item.ProductID, item.Quantity, item.UnitPrice, item.TotalPrice,
+		itemResult, err := tx.Exec(`
+			INSERT INTO order_items (order_id, product_id, variant_id, quantity, unit_price, total_price, discount_amount, unit_cost,
+			                         tax_class, tax_rate, tax_amount, tax_inclusive) 
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			orderID, item.ProductID, item.VariantID, item.Quantity, item.UnitPrice, item.TotalPrice, item.DiscountAmount, item.UnitCost,
+			item.TaxClass, item.TaxRate, item.TaxAmount, item.TaxInclusive,
 		)
 		if err != nil {
-			tx.Rollback()
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+			return order, err
 		}
 
-		_, err = tx.Exec(`
-			UPDATE products 
-			SET quantity = quantity - ? 
-			WHERE id = ?`,
-			item.Quantity, item.ProductID,
-		)
+		itemID, err := itemResult.LastInsertId()
+		if err == nil {
+			err = recordAllocations(tx, itemID, item.Allocations)
+		}
 		if err != nil {
-			tx.Rollback()
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+			return order, err
 		}
-	}
 
-	if err := tx.Commit(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		if item.VariantID != nil {
+			_, err = tx.Exec(`
+				UPDATE product_variants 
+				SET quantity = quantity - ? 
+				WHERE id = ?`,
+				item.Quantity, *item.VariantID,
+			)
+			if err == nil {
+				err = bumpProductVersion(tx, item.ProductID)
+			}
+		} else {
+			_, err = tx.Exec(`
+				UPDATE products 
+				SET quantity = quantity - ?, version = version + 1 
+				WHERE id = ?`,
+				item.Quantity, item.ProductID,
+			)
+		}
+		if err != nil {
+			return order, err
+		}
+
+		err = recordMovement(tx, models.InventoryMovement{
+			ProductID:      item.ProductID,
+			VariantID:      item.VariantID,
+			QuantityChange: -item.Quantity,
+			Reason:         models.MovementSale,
+			Reference:      fmt.Sprintf("order:%d", orderID),
+			UserID:         &userID,
+		})
+		if err != nil {
+			return order, err
+		}
 	}
 
-	order := models.Order{
-		ID:          uint(orderID),
-		UserID:      userIDUint,
-		TotalAmount: totalAmount,
-		Status:      "pending",
-		OrderItems:  orderItems,
+	order = models.Order{
+		ID:             uint(orderID),
+		UserID:         userID,
+		Subtotal:       subtotal,
+		DiscountAmount: discountAmount,
+		TaxAmount:      taxAmount,
+		TaxRegion:      region,
+		ShippingMethod: shippingMethod,
+		ShippingAmount: shippingAmount,
+		TotalAmount:    totalAmount,
+		Status:         models.OrderPending,
+		OrderItems:     orderItems,
+		Discounts:      discounts,
 	}
+	if err := emitEvent(tx, models.EventOrderCreated, order); err != nil {
+		return order, err
+	}
+	return order, nil
+}
 
-	c.JSON(http.StatusCreated, order)
+// Work that follows a committed order and should not delay the response
+func orderPlaced(order models.Order) {
+	//Check the sold products against their reorder points
+	productIDs := make([]uint, 0, len(order.OrderItems))
+	for _, item := range order.OrderItems {
+		productIDs = append(productIDs, item.ProductID)
+	}
+	go func() {
+		if err := checkLowStock(productIDs...); err != nil {
+			log.Printf("stock alert check for order %d failed: %v", order.ID, err)
+		}
+	}()
 }
 
+// Order history of the current user, newest first. Filters are status (comma
+// separated), from and to. Without page or limit every order is returned as a
+// bare array with its items, as before pagination existed; with either the
+// response is {data, pagination} and include=items adds the order items.
 func GetUserOrders(c *gin.Context) {
-	userID, exists := c.Get("userID")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+	userIDUint, ok := currentUserID(c)
+	if !ok {
 		return
 	}
 
-	var userIDUint uint
-	switch v := userID.(type) {
-	case float64:
-		userIDUint = uint(v)
-	case int:
-		userIDUint = uint(v)
-	case int64:
-		userIDUint = uint(v)
-	case uint:
-		userIDUint = v
-	default:
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid user ID type"})
+	paginated := c.Query("page") != "" || c.Query("limit") != ""
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 10
+	}
+	offset := (page - 1) * limit
+
+	dateConditions, dateArgs, ok := reportDateRange(c)
+	if !ok {
 		return
 	}
+	conditions := append([]string{"o.user_id = ?"}, dateConditions...)
+	args := append([]interface{}{userIDUint}, dateArgs...)
+	if value := c.Query("status"); value != "" {
+		statuses := strings.Split(value, ",")
+		conditions = append(conditions, "o.status IN (?"+strings.Repeat(", ?", len(statuses)-1)+")")
+		for _, status := range statuses {
+			args = append(args, strings.TrimSpace(status))
+		}
+	}
+	where := "WHERE " + strings.Join(conditions, " AND ")
 
-	rows, err := config.DB.Query(`
-		SELECT id, user_id, total_amount, status, created_at 
-		FROM orders 
-		WHERE user_id = ? 
-		ORDER BY created_at DESC`,
-		userIDUint,
-	)
+	var total int
+	query := `
+		SELECT o.id, o.user_id, o.subtotal, o.discount_amount, o.tax_amount, o.tax_region, COALESCE(o.shipping_method, ''), o.shipping_amount,
+		       o.total_amount, o.refunded_amount, o.status, o.created_at 
+		FROM orders o 
+		` + where + ` 
+		ORDER BY o.created_at DESC, o.id DESC`
+	if paginated {
+		if err := config.DB.QueryRow("SELECT COUNT(*) FROM orders o "+where, args...).Scan(&total); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, limit, offset)
+	}
+
+	rows, err := config.DB.Query(query, args...)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 	defer rows.Close()
 
-	var orders []models.Order
+	orders := []models.Order{}
 	for rows.Next() {
 		var order models.Order
 		if err := rows.Scan(
 			&order.ID,
 			&order.UserID,
+			&order.Subtotal,
+			&order.DiscountAmount,
+			&order.TaxAmount,
+			&order.TaxRegion,
+			&order.ShippingMethod,
+			&order.ShippingAmount,
 			&order.TotalAmount,
+			&order.RefundedAmount,
 			&order.Status,
 			&order.CreatedAt,
 		); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
+		order.RefundStatus = refundStatus(order.TotalAmount, order.RefundedAmount)
 		orders = append(orders, order)
 	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	rows.Close()
 
-	for i, order := range orders {
-		itemRows, err := config.DB.Query(`
-			SELECT oi.id, oi.order_id,oi.product_id, oi.quantity, oi.unit_price, oi.total_price, 
-			      p.id, p.name, p.price, p.quantity, p.image,p.sales_rate,p.purchase_rate
-			FROM order_items oi
-			JOIN products p ON oi.product_id = p.id
-			WHERE oi.order_id = ?`,
-			order.ID,
-		)
-		if err != nil {
+	withItems := !paginated
+	for _, include := range strings.Split(c.Query("include"), ",") {
+		if strings.TrimSpace(include) == "items" {
+			withItems = true
+		}
+	}
+	if withItems {
+		if err := loadOrderItems(orders); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		defer itemRows.Close()
-
-		var orderItems []models.OrderItem
-		for itemRows.Next() {
-			var item models.OrderItem
-			var product models.Product
-			if err := itemRows.Scan(
-				&item.ID,
-				&item.OrderID,
-				&item.ProductID,
-				&item.Quantity,
-				&item.UnitPrice,
-				&item.TotalPrice,
-				&product.ID,
-				&product.Name,
-				&product.Price,
-				&product.Quantity,
-				&product.Image,
-				&product.SalesRate,
-				&product.PurchaseRate,
-			); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				return
-			}
-			item.Product = product
-			orderItems = append(orderItems, item)
-		}
-		orders[i].OrderItems = orderItems
 	}
 
-	c.JSON(http.StatusOK, orders)
+	if !paginated {
+		c.JSON(http.StatusOK, orders)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": orders,
+		"pagination": gin.H{
+			"total":       total,
+			"page":        page,
+			"limit":       limit,
+			"total_pages": (total + limit - 1) / limit,
+		},
+	})
+}
+
+// Attach the items of many orders with a single query
+func loadOrderItems(orders []models.Order) error {
+	if len(orders) == 0 {
+		return nil
+	}
+
+	index := make(map[uint]int, len(orders))
+	args := make([]interface{}, len(orders))
+	for i, order := range orders {
+		index[order.ID] = i
+		args[i] = order.ID
+	}
+
+	rows, err := config.DB.Query(`
+		SELECT oi.id, oi.order_id, oi.product_id, oi.variant_id, oi.quantity, oi.unit_price, oi.total_price, oi.discount_amount,
+		       oi.tax_class, oi.tax_rate, oi.tax_amount, oi.tax_inclusive,
+		       p.id, p.name, p.price, p.quantity, p.image, p.sales_rate, p.purchase_rate
+		FROM order_items oi
+		JOIN products p ON oi.product_id = p.id
+		WHERE oi.order_id IN (?`+strings.Repeat(", ?", len(orders)-1)+`)
+		ORDER BY oi.order_id, oi.id`,
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item models.OrderItem
+		var product models.Product
+		if err := rows.Scan(
+			&item.ID,
+			&item.OrderID,
+			&item.ProductID,
+			&item.VariantID,
+			&item.Quantity,
+			&item.UnitPrice,
+			&item.TotalPrice,
+			&item.DiscountAmount,
+			&item.TaxClass,
+			&item.TaxRate,
+			&item.TaxAmount,
+			&item.TaxInclusive,
+			&product.ID,
+			&product.Name,
+			&product.Price,
+			&product.Quantity,
+			&product.Image,
+			&product.SalesRate,
+			&product.PurchaseRate,
+		); err != nil {
+			return err
+		}
+		item.Product = product
+		order := &orders[index[item.OrderID]]
+		order.OrderItems = append(order.OrderItems, item)
+	}
+	return rows.Err()
 }
 
 func GetOrderByID(c *gin.Context) {
@@ -258,47 +582,55 @@ func GetOrderByID(c *gin.Context) {
 		return
 	}
 
-	userID, exists := c.Get("userID")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
-		return
-	}
-
-	var userIDUint uint
-	switch v := userID.(type) {
-	case float64:
-		userIDUint = uint(v)
-	case int:
-		userIDUint = uint(v)
-	case int64:
-		userIDUint = uint(v)
-	case uint:
-		userIDUint = v
-	default:
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid user ID type"})
+	userID, ok := currentUserID(c)
+	if !ok {
 		return
 	}
+	admin := isAdmin(c)
 
+	//Admins can open any order and see who placed it
 	var order models.Order
+	var customer models.OrderCustomer
 	err = config.DB.QueryRow(`
-		SELECT id, user_id, total_amount, status, created_at 
-		FROM orders 
-		WHERE id = ? AND user_id = ?`,
-		orderID, userIDUint,
+		SELECT o.id, o.user_id, o.subtotal, o.discount_amount, o.tax_amount, o.tax_region, COALESCE(o.shipping_method, ''), o.shipping_amount,
+		       o.total_amount, o.refunded_amount, o.status, o.created_at, o.cancel_reason, o.cancelled_at,
+		       u.id, u.name, u.email
+		FROM orders o 
+		JOIN users u ON u.id = o.user_id
+		WHERE o.id = ?`,
+		orderID,
 	).Scan(
 		&order.ID,
 		&order.UserID,
+		&order.Subtotal,
+		&order.DiscountAmount,
+		&order.TaxAmount,
+		&order.TaxRegion,
+		&order.ShippingMethod,
+		&order.ShippingAmount,
 		&order.TotalAmount,
+		&order.RefundedAmount,
 		&order.Status,
 		&order.CreatedAt,
+		&order.CancelReason,
+		&order.CancelledAt,
+		&customer.ID,
+		&customer.Name,
+		&customer.Email,
 	)
-	if err != nil {
+	if err != nil || (order.UserID != userID && !admin) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
 		return
 	}
+	if admin {
+		order.Customer = &customer
+	}
+
+	order.RefundStatus = refundStatus(order.TotalAmount, order.RefundedAmount)
 
 	itemRows, err := config.DB.Query(`
-		SELECT oi.id, oi.product_id, oi.quantity, oi.unit_price, oi.total_price, 
+		SELECT oi.id, oi.product_id, oi.variant_id, oi.quantity, oi.unit_price, oi.total_price, oi.discount_amount,
+		       oi.tax_class, oi.tax_rate, oi.tax_amount, oi.tax_inclusive,
 		       p.name, p.image, p.sales_rate, p.purchase_rate
 		FROM order_items oi
 		JOIN products p ON oi.product_id = p.id
@@ -318,9 +650,15 @@ func GetOrderByID(c *gin.Context) {
 		if err := itemRows.Scan(
 			&item.ID,
 			&item.ProductID,
+			&item.VariantID,
 			&item.Quantity,
 			&item.UnitPrice,
 			&item.TotalPrice,
+			&item.DiscountAmount,
+			&item.TaxClass,
+			&item.TaxRate,
+			&item.TaxAmount,
+			&item.TaxInclusive,
 			&product.Name,
 			&product.Image,
 			&product.SalesRate,
@@ -334,5 +672,22 @@ func GetOrderByID(c *gin.Context) {
 	}
 	order.OrderItems = orderItems
 
+	if err := loadOrderItemAllocations(order.OrderItems); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	order.Discounts, err = loadOrderDiscounts(order.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	order.History, err = loadOrderHistory(order.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
 	c.JSON(http.StatusOK, order)
 }
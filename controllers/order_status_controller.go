@@ -0,0 +1,468 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/umesh/ginapi/config"
+	"github.com/umesh/ginapi/models"
+)
+
+// Allowed moves from each status. The flag says whether the customer who
+// placed the order may make the move; every move is open to admins.
+var orderTransitions = map[string]map[string]bool{
+	models.OrderPending: {
+		models.OrderPaid:      false,
+		models.OrderCancelled: true,
+	},
+	models.OrderPaid: {
+		models.OrderProcessing: false,
+		models.OrderCancelled:  false,
+		models.OrderRefunded:   false,
+	},
+	models.OrderProcessing: {
+		models.OrderShipped:   false,
+		models.OrderCancelled: false,
+	},
+	models.OrderShipped: {
+		models.OrderDelivered: false,
+	},
+	models.OrderDelivered: {
+		models.OrderRefunded: false,
+	},
+}
+
+// Statuses an order only reaches through its payments. Refunding a payment
+// moves the order on; a plain status change cannot.
+var paymentOnlyStatuses = map[string]bool{
+	models.OrderRefunded: true,
+}
+
+// A status change the lifecycle does not allow from where the order is now
+type transitionError struct {
+	from, to string
+}
+
+func (e transitionError) Error() string {
+	if len(orderTransitions[e.from]) == 0 {
+		return fmt.Sprintf("order is %s and can no longer change status", e.from)
+	}
+	return fmt.Sprintf("cannot move order from %s to %s", e.from, e.to)
+}
+
+// Statuses an order can be moved to next, in lifecycle order
+func nextOrderStatuses(from string) []string {
+	lifecycle := []string{
+		models.OrderPending, models.OrderPaid, models.OrderProcessing, models.OrderShipped,
+		models.OrderDelivered, models.OrderCancelled, models.OrderRefunded,
+	}
+	next := []string{}
+	for _, status := range lifecycle {
+		if _, ok := orderTransitions[from][status]; ok && !paymentOnlyStatuses[status] {
+			next = append(next, status)
+		}
+	}
+	return next
+}
+
+// Write a history entry; from is empty for the entry of a new order
+func recordStatusChange(tx *sql.Tx, orderID int64, from, to string, userID *uint, note string) error {
+	_, err := tx.Exec(`
+		INSERT INTO order_status_history (order_id, from_status, to_status, note, user_id)
+		VALUES (?, ?, ?, ?, ?)`,
+		orderID, nullableString(from), to, nullableString(note), userID,
+	)
+	return err
+}
+
+// Move a locked order to a new status and record it in its history.
+// userID is nil for changes the system makes on its own.
+func transitionOrder(tx *sql.Tx, orderID int64, from, to string, userID *uint, note string) error {
+	if _, ok := orderTransitions[from][to]; !ok {
+		return transitionError{from, to}
+	}
+
+	if _, err := tx.Exec("UPDATE orders SET status = ? WHERE id = ?", to, orderID); err != nil {
+		return err
+	}
+	if err := recordStatusChange(tx, orderID, from, to, userID, note); err != nil {
+		return err
+	}
+	return emitEvent(tx, models.EventOrderStatusChanged, gin.H{
+		"order_id": orderID,
+		"from":     from,
+		"to":       to,
+		"note":     note,
+	})
+}
+
+// Lock an order for a status change, returning its owner and status
+func lockOrder(tx *sql.Tx, orderID int64) (uint, string, error) {
+	var owner uint
+	var status string
+	err := tx.QueryRow("SELECT user_id, status FROM orders WHERE id = ? FOR UPDATE", orderID).Scan(&owner, &status)
+	return owner, status, err
+}
+
+// Cancel a locked order: put its stock back where it was taken from, record
+// the reason, give back the uses of the promotions it applied and refund
+// what was paid
+func cancelOrder(tx *sql.Tx, orderID int64, from string, userID *uint, reason string) error {
+	if err := transitionOrder(tx, orderID, from, models.OrderCancelled, userID, reason); err != nil {
+		return err
+	}
+
+	_, err := tx.Exec(
+		"UPDATE orders SET cancel_reason = ?, cancelled_at = NOW() WHERE id = ?",
+		nullableString(reason), orderID,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := restockOrder(tx, orderID, userID); err != nil {
+		return err
+	}
+
+	//Per-user limits already leave cancelled orders out, so only the total needs undoing
+	_, err = tx.Exec(`
+		UPDATE promotions p
+		JOIN order_discounts od ON od.promotion_id = p.id
+		SET p.used_count = GREATEST(p.used_count - 1, 0)
+		WHERE od.order_id = ?`,
+		orderID,
+	)
+	if err != nil {
+		return err
+	}
+
+	//Money already taken for the order is queued to go back to the customer;
+	//the caller wakes the refund worker once this commits. Payments still
+	//processing are refunded by the webhook when they settle.
+	rows, err := tx.Query("SELECT id FROM payments WHERE order_id = ? AND status = ?", orderID, models.PaymentSucceeded)
+	if err != nil {
+		return err
+	}
+	var paymentIDs []uint
+	for rows.Next() {
+		var id uint
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		paymentIDs = append(paymentIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range paymentIDs {
+		if _, err := refundPayment(tx, id, nil, reason, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return the items of an order to stock, including the warehouses they
+// were allocated from
+func restockOrder(tx *sql.Tx, orderID int64, userID *uint) error {
+	rows, err := tx.Query(
+		"SELECT id, product_id, variant_id, quantity FROM order_items WHERE order_id = ? ORDER BY id",
+		orderID,
+	)
+	if err != nil {
+		return err
+	}
+	var items []models.OrderItem
+	for rows.Next() {
+		var item models.OrderItem
+		if err := rows.Scan(&item.ID, &item.ProductID, &item.VariantID, &item.Quantity); err != nil {
+			rows.Close()
+			return err
+		}
+		items = append(items, item)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		if item.VariantID != nil {
+			_, err = tx.Exec(
+				"UPDATE product_variants SET quantity = quantity + ? WHERE id = ?",
+				item.Quantity, *item.VariantID,
+			)
+			if err == nil {
+				err = bumpProductVersion(tx, item.ProductID)
+			}
+		} else {
+			_, err = tx.Exec(
+				"UPDATE products SET quantity = quantity + ?, version = version + 1 WHERE id = ?",
+				item.Quantity, item.ProductID,
+			)
+		}
+		if err != nil {
+			return err
+		}
+
+		allocRows, err := tx.Query(
+			"SELECT warehouse_id, quantity FROM order_item_allocations WHERE order_item_id = ? AND warehouse_id IS NOT NULL",
+			item.ID,
+		)
+		if err != nil {
+			return err
+		}
+		var allocations []models.OrderItemAllocation
+		for allocRows.Next() {
+			var allocation models.OrderItemAllocation
+			if err := allocRows.Scan(&allocation.WarehouseID, &allocation.Quantity); err != nil {
+				allocRows.Close()
+				return err
+			}
+			allocations = append(allocations, allocation)
+		}
+		allocRows.Close()
+		if err := allocRows.Err(); err != nil {
+			return err
+		}
+		for _, allocation := range allocations {
+			if err := changeWarehouseStock(tx, *allocation.WarehouseID, item.ProductID, item.VariantID, allocation.Quantity); err != nil {
+				return err
+			}
+		}
+
+		err = recordMovement(tx, models.InventoryMovement{
+			ProductID:      item.ProductID,
+			VariantID:      item.VariantID,
+			QuantityChange: item.Quantity,
+			Reason:         models.MovementCancellation,
+			Reference:      fmt.Sprintf("order:%d", orderID),
+			UserID:         userID,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func loadOrderHistory(orderID uint) ([]models.OrderStatusChange, error) {
+	rows, err := config.DB.Query(`
+		SELECT id, order_id, COALESCE(from_status, ''), to_status, COALESCE(note, ''), user_id, created_at
+		FROM order_status_history
+		WHERE order_id = ?
+		ORDER BY created_at, id`,
+		orderID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []models.OrderStatusChange{}
+	for rows.Next() {
+		var change models.OrderStatusChange
+		if err := rows.Scan(
+			&change.ID,
+			&change.OrderID,
+			&change.FromStatus,
+			&change.ToStatus,
+			&change.Note,
+			&change.UserID,
+			&change.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		history = append(history, change)
+	}
+	return history, rows.Err()
+}
+
+// Move an order along its lifecycle. Customers may only cancel their own
+// pending orders; the rest of the lifecycle is run by admins.
+func CreateOrderTransition(c *gin.Context) {
+	orderID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order ID"})
+		return
+	}
+
+	var req models.OrderTransitionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if paymentOnlyStatuses[req.Status] {
+		c.JSON(http.StatusConflict, gin.H{"error": "orders are refunded by refunding their payments"})
+		return
+	}
+
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	admin := isAdmin(c)
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	owner, status, err := lockOrder(tx, orderID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && owner != userID && !admin) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	customerAllowed, ok := orderTransitions[status][req.Status]
+	if !ok {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":   transitionError{status, req.Status}.Error(),
+			"status":  status,
+			"allowed": nextOrderStatuses(status),
+		})
+		return
+	}
+	if !admin && !customerAllowed {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("only admins can move an order to %s", req.Status)})
+		return
+	}
+
+	//Cancelling through here restocks the same way the cancel endpoint does
+	if req.Status == models.OrderCancelled {
+		err = cancelOrder(tx, orderID, status, &userID, req.Note)
+	} else {
+		err = transitionOrder(tx, orderID, status, req.Status, &userID, req.Note)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Status == models.OrderCancelled {
+		wakeRefundWorker()
+	}
+
+	history, err := loadOrderHistory(uint(orderID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":      orderID,
+		"status":  req.Status,
+		"allowed": nextOrderStatuses(req.Status),
+		"history": history,
+	})
+}
+
+func GetOrderHistory(c *gin.Context) {
+	orderID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order ID"})
+		return
+	}
+
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	var owner uint
+	err = config.DB.QueryRow("SELECT user_id FROM orders WHERE id = ?", orderID).Scan(&owner)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && owner != userID && !isAdmin(c)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	history, err := loadOrderHistory(uint(orderID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": history})
+}
+
+// Cancel an order and put its stock back. Customers can cancel their own
+// orders while they are pending; admins can cancel any order not yet shipped.
+func CancelOrder(c *gin.Context) {
+	orderID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order ID"})
+		return
+	}
+
+	var req models.CancelOrderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	admin := isAdmin(c)
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	owner, status, err := lockOrder(tx, orderID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && owner != userID && !admin) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	customerAllowed, ok := orderTransitions[status][models.OrderCancelled]
+	if !ok {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("order is %s and can no longer be cancelled", status)})
+		return
+	}
+	if !admin && !customerAllowed {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("orders that are %s can only be cancelled by an admin", status)})
+		return
+	}
+
+	if err := cancelOrder(tx, orderID, status, &userID, req.Reason); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	wakeRefundWorker()
+
+	c.JSON(http.StatusOK, gin.H{"message": "Order cancelled successfully", "id": orderID, "status": models.OrderCancelled})
+}
@@ -0,0 +1,99 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/umesh/ginapi/utils"
+)
+
+const (
+	mergePatchContentType = "application/merge-patch+json"
+	jsonPatchContentType  = "application/json-patch+json"
+)
+
+// Apply the request body to the current representation of a resource and
+// decode the result into patched. Merge patches (RFC 7396) and JSON Patches
+// (RFC 6902) are supported; a plain application/json body is treated as a
+// merge patch so omitted fields keep their current values. Required fields
+// cannot be removed. On failure the error response is written and false returned.
+func applyRequestPatch(c *gin.Context, current, patched interface{}, required ...string) bool {
+	document, err := json.Marshal(current)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+
+	// Older clients send the whole object as application/json, read-only
+	// fields included, so unknown fields are only rejected for patch types
+	strict := true
+	var result []byte
+	switch c.ContentType() {
+	case jsonPatchContentType:
+		result, err = utils.ApplyJSONPatch(document, body)
+	case mergePatchContentType:
+		result, err = utils.MergePatch(document, body)
+	case "application/json", "":
+		strict = false
+		result, err = utils.MergePatch(document, body)
+	default:
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{
+			"error": "Content-Type must be application/json, " + mergePatchContentType + " or " + jsonPatchContentType,
+		})
+		return false
+	}
+	switch {
+	case errors.Is(err, utils.ErrInvalidPatch):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	case errors.Is(err, utils.ErrPatchTestFailed):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return false
+	case err != nil:
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return false
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(result, &fields); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "patched document must be a JSON object"})
+		return false
+	}
+	fieldErrors := map[string]string{}
+	for _, name := range required {
+		if value, ok := fields[name]; !ok || value == nil {
+			fieldErrors[name] = "is required and cannot be removed"
+		}
+	}
+	if len(fieldErrors) > 0 {
+		respondWithFieldErrors(c, fieldErrors)
+		return false
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(result))
+	if strict {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(patched); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+func respondWithFieldErrors(c *gin.Context, fieldErrors map[string]string) {
+	c.JSON(http.StatusUnprocessableEntity, gin.H{
+		"error":  "validation failed",
+		"fields": fieldErrors,
+	})
+}
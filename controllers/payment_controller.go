@@ -0,0 +1,813 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/umesh/ginapi/config"
+	"github.com/umesh/ginapi/models"
+	"github.com/umesh/ginapi/utils"
+)
+
+// Set at startup from the environment; there is no default provider
+var paymentProvider utils.PaymentProvider
+
+// Refunds the provider refuses are retried on the same schedule as webhooks,
+// starting at refundRetryDelay. One that fails refundMaxAttempts times is
+// failed and waits for an admin.
+const (
+	refundMaxAttempts   = 6
+	refundRetryDelay    = time.Minute
+	refundMaxRetryDelay = 6 * time.Hour
+	refundBatchSize     = 20
+	// Claimed refunds are pushed this far ahead so other workers skip them
+	// while they are with the provider
+	refundClaimLease = 2 * time.Minute
+)
+
+// Wakes the refund worker early, e.g. after an order is cancelled
+var refundWake = make(chan struct{}, 1)
+
+// SetPaymentProvider sets the gateway that takes payments and signs webhooks
+func SetPaymentProvider(provider utils.PaymentProvider) {
+	if provider != nil {
+		paymentProvider = provider
+	}
+}
+
+// A refund that cannot be made as asked, shown to the caller as a 409
+type refundError struct {
+	message string
+}
+
+func (e refundError) Error() string {
+	return e.message
+}
+
+const paymentColumns = `id, order_id, provider, provider_ref, amount, refunded_amount, status,
+	COALESCE(failure_reason, ''), created_at, updated_at`
+
+func scanPayment(row interface{ Scan(...interface{}) error }) (models.Payment, error) {
+	var payment models.Payment
+	err := row.Scan(
+		&payment.ID,
+		&payment.OrderID,
+		&payment.Provider,
+		&payment.ProviderRef,
+		&payment.Amount,
+		&payment.RefundedAmount,
+		&payment.Status,
+		&payment.FailureReason,
+		&payment.CreatedAt,
+		&payment.UpdatedAt,
+	)
+	return payment, err
+}
+
+const refundColumns = `r.id, r.payment_id, p.order_id, COALESCE(r.provider_ref, ''), r.amount, COALESCE(r.reason, ''),
+	r.status, r.attempts, COALESCE(r.failure_reason, ''), r.created_at, r.updated_at`
+
+func scanRefund(row interface{ Scan(...interface{}) error }) (models.PaymentRefund, error) {
+	var refund models.PaymentRefund
+	err := row.Scan(
+		&refund.ID,
+		&refund.PaymentID,
+		&refund.OrderID,
+		&refund.ProviderRef,
+		&refund.Amount,
+		&refund.Reason,
+		&refund.Status,
+		&refund.Attempts,
+		&refund.FailureReason,
+		&refund.CreatedAt,
+		&refund.UpdatedAt,
+	)
+	return refund, err
+}
+
+func loadRefund(id uint) (models.PaymentRefund, error) {
+	return scanRefund(config.DB.QueryRow(
+		"SELECT "+refundColumns+" FROM payment_refunds r JOIN payments p ON p.id = r.payment_id WHERE r.id = ?", id,
+	))
+}
+
+func loadOrderPayments(orderID uint) ([]models.Payment, error) {
+	rows, err := config.DB.Query("SELECT "+paymentColumns+" FROM payments WHERE order_id = ? ORDER BY id", orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	payments := []models.Payment{}
+	index := map[uint]int{}
+	for rows.Next() {
+		payment, err := scanPayment(rows)
+		if err != nil {
+			return nil, err
+		}
+		index[payment.ID] = len(payments)
+		payments = append(payments, payment)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	refundRows, err := config.DB.Query(`
+		SELECT `+refundColumns+`
+		FROM payment_refunds r
+		JOIN payments p ON p.id = r.payment_id
+		WHERE p.order_id = ?
+		ORDER BY r.id`,
+		orderID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer refundRows.Close()
+
+	for refundRows.Next() {
+		refund, err := scanRefund(refundRows)
+		if err != nil {
+			return nil, err
+		}
+		payment := &payments[index[refund.PaymentID]]
+		payment.Refunds = append(payment.Refunds, refund)
+	}
+	return payments, refundRows.Err()
+}
+
+// Pay for a pending order. The payment is authorised and captured at once;
+// the order only becomes paid when the provider's webhook confirms it.
+func CreatePayment(c *gin.Context) {
+	orderID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order ID"})
+		return
+	}
+
+	var req models.CreatePaymentRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	//The order stays locked until the payment is stored, so two requests
+	//cannot both start paying it
+	tx, err := config.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	owner, status, err := lockOrder(tx, orderID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && owner != userID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if status != models.OrderPending {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("order is %s and cannot be paid", status)})
+		return
+	}
+
+	var amount float64
+	if err := tx.QueryRow("SELECT total_amount FROM orders WHERE id = ?", orderID).Scan(&amount); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var open int
+	err = tx.QueryRow(
+		"SELECT COUNT(*) FROM payments WHERE order_id = ? AND status IN (?, ?, ?)",
+		orderID, models.PaymentRequiresCapture, models.PaymentProcessing, models.PaymentSucceeded,
+	).Scan(&open)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if open > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "order already has a payment in progress"})
+		return
+	}
+
+	intent, err := paymentProvider.CreateIntent(amount, fmt.Sprintf("order:%d", orderID), req.Method)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	//Stored before capturing so the webhook can find it however soon it arrives
+	result, err := tx.Exec(`
+		INSERT INTO payments (order_id, provider, provider_ref, amount, status)
+		VALUES (?, ?, ?, ?, ?)`,
+		orderID, paymentProvider.Name(), intent.ID, amount, intent.Status,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	paymentID, err := result.LastInsertId()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	intent, err = paymentProvider.Capture(intent.ID, amount)
+	if err != nil {
+		intent.Status = models.PaymentFailed
+		intent.FailureReason = err.Error()
+	}
+	//Only the webhook settles a payment, so a capture that succeeded waits
+	//for it as processing
+	status = intent.Status
+	if status == utils.IntentSucceeded {
+		status = models.PaymentProcessing
+	}
+	_, err = config.DB.Exec(`
+		UPDATE payments SET status = ?, failure_reason = ?
+		WHERE id = ? AND status = ?`,
+		status, nullableString(intent.FailureReason), paymentID, models.PaymentRequiresCapture,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	payment, err := scanPayment(config.DB.QueryRow("SELECT "+paymentColumns+" FROM payments WHERE id = ?", paymentID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, payment)
+}
+
+func GetOrderPayments(c *gin.Context) {
+	orderID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order ID"})
+		return
+	}
+
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	var owner uint
+	err = config.DB.QueryRow("SELECT user_id FROM orders WHERE id = ?", orderID).Scan(&owner)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && owner != userID && !isAdmin(c)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	payments, err := loadOrderPayments(uint(orderID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": payments})
+}
+
+// Receive payment events from the provider. A settled payment moves its
+// order from pending to paid; one that settles for an order that is no longer
+// pending, e.g. cancelled or already paid, is refunded. Replays of an event
+// change nothing.
+func PaymentWebhook(c *gin.Context) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	event, err := paymentProvider.VerifyWebhook(body, c.Request.Header)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	var paymentID, orderID int64
+	var status string
+	var amount float64
+	var refunded bool
+	//A payment never moves to another order, so its order can be read before
+	//anything is locked. The order is locked before the payment, in the same
+	//order cancelling does, so the two cannot deadlock.
+	err = tx.QueryRow(
+		"SELECT id, order_id FROM payments WHERE provider = ? AND provider_ref = ?",
+		paymentProvider.Name(), event.IntentID,
+	).Scan(&paymentID, &orderID)
+	if errors.Is(err, sql.ErrNoRows) {
+		log.Printf("payment webhook %s for unknown intent %s ignored", event.ID, event.IntentID)
+		c.JSON(http.StatusOK, gin.H{"received": true})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	_, orderStatus, err := lockOrder(tx, orderID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	err = tx.QueryRow("SELECT status, amount FROM payments WHERE id = ? FOR UPDATE", paymentID).Scan(&status, &amount)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if roundMoney(event.Amount) != amount {
+		log.Printf("payment webhook %s for payment %d has amount %.2f, expected %.2f", event.ID, paymentID, event.Amount, amount)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "event amount does not match the payment"})
+		return
+	}
+
+	switch event.Type {
+	case utils.EventPaymentSucceeded:
+		if status == models.PaymentSucceeded || status == models.PaymentRefunded {
+			break
+		}
+		if _, err := tx.Exec("UPDATE payments SET status = ? WHERE id = ?", models.PaymentSucceeded, paymentID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		//The order was cancelled or paid some other way meanwhile, so the money
+		//goes straight back. A second payment of a paid order was never part of
+		//it, so only the payment is refunded, not the order.
+		if orderStatus != models.OrderPending {
+			reason := fmt.Sprintf("payment settled for an order that is %s", orderStatus)
+			if orderStatus == models.OrderCancelled {
+				_, err = refundPayment(tx, uint(paymentID), nil, reason, nil)
+			} else {
+				_, err = queueRefund(tx, uint(paymentID), nil, reason, nil)
+			}
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			log.Printf("payment %d settled for order %d that is %s, refund queued", paymentID, orderID, orderStatus)
+			refunded = true
+			break
+		}
+		note := fmt.Sprintf("payment %s settled", event.IntentID)
+		if err := transitionOrder(tx, orderID, orderStatus, models.OrderPaid, nil, note); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+	case utils.EventPaymentFailed:
+		if status == models.PaymentFailed {
+			break
+		}
+		_, err := tx.Exec(
+			"UPDATE payments SET status = ?, failure_reason = ? WHERE id = ?",
+			models.PaymentFailed, nullableString(event.FailureReason), paymentID,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+	default:
+		log.Printf("payment webhook %s of type %s ignored", event.ID, event.Type)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if refunded {
+		wakeRefundWorker()
+	}
+
+	c.JSON(http.StatusOK, gin.H{"received": true})
+}
+
+// Record a refund of part or all of a settled payment, leaving its order as
+// it is. The refund is only queued here; the refund worker sends it to the
+// provider once the transaction commits.
+func queueRefund(tx *sql.Tx, paymentID uint, amount *float64, reason string, userID *uint) (models.PaymentRefund, error) {
+	refund := models.PaymentRefund{PaymentID: paymentID, Reason: reason, Status: models.RefundPending}
+
+	payment, err := scanPayment(tx.QueryRow("SELECT "+paymentColumns+" FROM payments WHERE id = ? FOR UPDATE", paymentID))
+	if err != nil {
+		return refund, err
+	}
+	if payment.Status != models.PaymentSucceeded {
+		return refund, refundError{fmt.Sprintf("payment is %s and cannot be refunded", payment.Status)}
+	}
+
+	remaining := roundMoney(payment.Amount - payment.RefundedAmount)
+	refund.Amount = remaining
+	if amount != nil {
+		refund.Amount = roundMoney(*amount)
+	}
+	if refund.Amount <= 0 || refund.Amount > remaining {
+		return refund, refundError{fmt.Sprintf("refund must be between 0.01 and %.2f", remaining)}
+	}
+
+	refund.OrderID = payment.OrderID
+
+	result, err := tx.Exec(`
+		INSERT INTO payment_refunds (payment_id, amount, reason, status, next_attempt_at, user_id)
+		VALUES (?, ?, ?, ?, NOW(), ?)`,
+		paymentID, refund.Amount, nullableString(reason), models.RefundPending, userID,
+	)
+	if err != nil {
+		return refund, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return refund, err
+	}
+	refund.ID = uint(id)
+
+	status := payment.Status
+	if refund.Amount == remaining {
+		status = models.PaymentRefunded
+	}
+	_, err = tx.Exec(
+		"UPDATE payments SET refunded_amount = refunded_amount + ?, status = ? WHERE id = ?",
+		refund.Amount, status, paymentID,
+	)
+	return refund, err
+}
+
+// Refund part or all of a settled payment of an order. When the whole payment
+// is refunded the order is marked refunded, if its status allows.
+func refundPayment(tx *sql.Tx, paymentID uint, amount *float64, reason string, userID *uint) (models.PaymentRefund, error) {
+	refund, err := queueRefund(tx, paymentID, amount, reason, userID)
+	if err != nil {
+		return refund, err
+	}
+
+	_, err = tx.Exec(
+		"UPDATE orders SET refunded_amount = refunded_amount + ? WHERE id = ?",
+		refund.Amount, refund.OrderID,
+	)
+	if err != nil {
+		return refund, err
+	}
+
+	var status string
+	if err := tx.QueryRow("SELECT status FROM payments WHERE id = ?", paymentID).Scan(&status); err != nil || status != models.PaymentRefunded {
+		return refund, err
+	}
+
+	_, orderStatus, err := lockOrder(tx, int64(refund.OrderID))
+	if err != nil {
+		return refund, err
+	}
+	if _, ok := orderTransitions[orderStatus][models.OrderRefunded]; ok {
+		err = transitionOrder(tx, int64(refund.OrderID), orderStatus, models.OrderRefunded, userID, reason)
+	}
+	return refund, err
+}
+
+func RefundPayment(c *gin.Context) {
+	paymentID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid payment ID"})
+		return
+	}
+
+	var req models.RefundPaymentRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	refund, err := refundPayment(tx, uint(paymentID), req.Amount, req.Reason, &userID)
+	if err != nil {
+		var invalid refundError
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			c.JSON(http.StatusNotFound, gin.H{"error": "payment not found"})
+		case errors.As(err, &invalid):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	//Sent at once so the response shows how it went; the worker retries failures
+	sendRefunds([]uint{refund.ID})
+
+	refund, err = loadRefund(refund.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, refund)
+}
+
+// StartRefundWorker sends queued refunds to the provider on the given interval
+func StartRefundWorker(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := processRefunds(); err != nil {
+				log.Printf("refund worker failed: %v", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-refundWake:
+			}
+		}
+	}()
+}
+
+func wakeRefundWorker() {
+	select {
+	case refundWake <- struct{}{}:
+	default:
+	}
+}
+
+type dueRefund struct {
+	id       uint
+	intentID string
+	amount   float64
+	attempts int
+}
+
+func processRefunds() error {
+	for {
+		due, err := claimDueRefunds(nil)
+		if err != nil {
+			return err
+		}
+		for _, refund := range due {
+			if err := sendRefund(refund); err != nil {
+				log.Printf("refund %d: %v", refund.id, err)
+			}
+		}
+		if len(due) < refundBatchSize {
+			return nil
+		}
+	}
+}
+
+// Send the given refunds now, if they are still due. Any that are not sent
+// here are left to the worker.
+func sendRefunds(ids []uint) {
+	if len(ids) == 0 {
+		return
+	}
+	due, err := claimDueRefunds(ids)
+	if err != nil {
+		log.Printf("sending refunds %v failed: %v", ids, err)
+		wakeRefundWorker()
+		return
+	}
+	for _, refund := range due {
+		if err := sendRefund(refund); err != nil {
+			log.Printf("refund %d: %v", refund.id, err)
+		}
+	}
+}
+
+// Take a batch of due refunds, or only the given ones when ids is not empty.
+// Rows locked by another worker are skipped.
+func claimDueRefunds(ids []uint) ([]dueRefund, error) {
+	tx, err := config.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		SELECT r.id, p.provider_ref, r.amount, r.attempts
+		FROM payment_refunds r
+		JOIN payments p ON p.id = r.payment_id
+		WHERE r.status = ? AND r.next_attempt_at <= NOW()`
+	args := []interface{}{models.RefundPending}
+	if len(ids) > 0 {
+		query += " AND r.id IN (?" + strings.Repeat(", ?", len(ids)-1) + ")"
+		for _, id := range ids {
+			args = append(args, id)
+		}
+	}
+	rows, err := tx.Query(query+`
+		ORDER BY r.next_attempt_at, r.id
+		LIMIT ?
+		FOR UPDATE OF r SKIP LOCKED`,
+		append(args, refundBatchSize)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var due []dueRefund
+	for rows.Next() {
+		var refund dueRefund
+		if err := rows.Scan(&refund.id, &refund.intentID, &refund.amount, &refund.attempts); err != nil {
+			return nil, err
+		}
+		due = append(due, refund)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	if len(due) == 0 {
+		return nil, nil
+	}
+
+	args = []interface{}{int(refundClaimLease.Seconds())}
+	for _, refund := range due {
+		args = append(args, refund.id)
+	}
+	_, err = tx.Exec(
+		"UPDATE payment_refunds SET next_attempt_at = NOW() + INTERVAL ? SECOND WHERE id IN (?"+strings.Repeat(", ?", len(due)-1)+")",
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return due, tx.Commit()
+}
+
+// Ask the provider for one refund and record how it went. The refund ID is
+// the idempotency key, so a refund sent again after a crash is not paid twice.
+func sendRefund(refund dueRefund) error {
+	providerRef, err := paymentProvider.Refund(refund.intentID, refund.amount, fmt.Sprintf("refund:%d", refund.id))
+
+	attempts := refund.attempts + 1
+	switch {
+	case err == nil:
+		_, err = config.DB.Exec(`
+			UPDATE payment_refunds
+			SET status = ?, provider_ref = ?, attempts = ?, next_attempt_at = NULL, failure_reason = NULL
+			WHERE id = ?`,
+			models.RefundSucceeded, providerRef, attempts, refund.id,
+		)
+	case attempts >= refundMaxAttempts:
+		_, err = config.DB.Exec(
+			"UPDATE payment_refunds SET status = ?, attempts = ?, next_attempt_at = NULL, failure_reason = ? WHERE id = ?",
+			models.RefundFailed, attempts, truncateText(err.Error(), 500), refund.id,
+		)
+	default:
+		_, err = config.DB.Exec(
+			"UPDATE payment_refunds SET attempts = ?, next_attempt_at = NOW() + INTERVAL ? SECOND, failure_reason = ? WHERE id = ?",
+			attempts, int(retryBackoff(attempts, refundRetryDelay, refundMaxRetryDelay).Seconds()), truncateText(err.Error(), 500), refund.id,
+		)
+	}
+	return err
+}
+
+// Refunds across all payments, newest first. ?status=failed lists the ones
+// the provider refused that need an admin.
+func GetRefunds(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+	offset := (page - 1) * limit
+
+	where := ""
+	var args []interface{}
+	if value := c.Query("status"); value != "" {
+		where, args = "WHERE r.status = ?", append(args, value)
+	}
+
+	var total int
+	if err := config.DB.QueryRow("SELECT COUNT(*) FROM payment_refunds r "+where, args...).Scan(&total); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	rows, err := config.DB.Query(
+		"SELECT "+refundColumns+" FROM payment_refunds r JOIN payments p ON p.id = r.payment_id "+where+" ORDER BY r.id DESC LIMIT ? OFFSET ?",
+		append(args, limit, offset)...,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	refunds := []models.PaymentRefund{}
+	for rows.Next() {
+		refund, err := scanRefund(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		refunds = append(refunds, refund)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": refunds,
+		"pagination": gin.H{
+			"total":       total,
+			"page":        page,
+			"limit":       limit,
+			"total_pages": (total + limit - 1) / limit,
+		},
+	})
+}
+
+// Send a failed refund again with a full set of attempts
+func RetryRefund(c *gin.Context) {
+	refundID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid refund ID"})
+		return
+	}
+
+	result, err := config.DB.Exec(
+		"UPDATE payment_refunds SET status = ?, attempts = 0, next_attempt_at = NOW() WHERE id = ? AND status = ?",
+		models.RefundPending, refundID, models.RefundFailed,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		refund, err := loadRefund(uint(refundID))
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			c.JSON(http.StatusNotFound, gin.H{"error": "refund not found"})
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("refund is %s and cannot be retried", refund.Status)})
+		}
+		return
+	}
+
+	sendRefunds([]uint{uint(refundID)})
+
+	refund, err := loadRefund(uint(refundID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, refund)
+}
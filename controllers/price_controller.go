@@ -0,0 +1,383 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/umesh/ginapi/config"
+	"github.com/umesh/ginapi/models"
+)
+
+// Implemented by both *sql.DB and *sql.Tx
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Work out the price entry in effect for a product at a point in time. The
+// latest started, unexpired entry wins; rates it leaves empty are taken from
+// the entries before it. Returns nil when the product has no price history.
+func priceInEffect(q queryer, productID uint, at time.Time) (*models.ProductPrice, error) {
+	rows, err := q.Query(`
+		SELECT id, product_id, price, sales_rate, purchase_rate, starts_at, ends_at, created_by, created_at
+		FROM product_prices
+		WHERE product_id = ? AND starts_at <= ? AND (ends_at IS NULL OR ends_at > ?)
+		ORDER BY starts_at DESC, id DESC`,
+		productID, at, at,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var effective *models.ProductPrice
+	for rows.Next() {
+		var entry models.ProductPrice
+		if err := rows.Scan(
+			&entry.ID,
+			&entry.ProductID,
+			&entry.Price,
+			&entry.SalesRate,
+			&entry.PurchaseRate,
+			&entry.StartsAt,
+			&entry.EndsAt,
+			&entry.CreatedBy,
+			&entry.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+
+		if effective == nil {
+			effective = &entry
+		} else {
+			if effective.SalesRate == nil {
+				effective.SalesRate = entry.SalesRate
+			}
+			if effective.PurchaseRate == nil {
+				effective.PurchaseRate = entry.PurchaseRate
+			}
+		}
+		if effective.SalesRate != nil && effective.PurchaseRate != nil {
+			break
+		}
+	}
+
+	return effective, rows.Err()
+}
+
+// Add a history entry holding the current prices of a product, effective now
+func recordPriceChange(tx *sql.Tx, productID uint, userID *uint) error {
+	now := time.Now()
+	_, err := tx.Exec(`
+		INSERT INTO product_prices (product_id, price, sales_rate, purchase_rate, starts_at, applied_at, created_by)
+		SELECT id, price, sales_rate, purchase_rate, ?, ?, ?
+		FROM products
+		WHERE id = ?`,
+		now, now, userID, productID,
+	)
+	return err
+}
+
+func priceStatus(entry models.ProductPrice, activeID uint, now time.Time) string {
+	switch {
+	case entry.StartsAt.After(now):
+		return "scheduled"
+	case entry.EndsAt != nil && !entry.EndsAt.After(now):
+		return "ended"
+	case entry.ID == activeID:
+		return "active"
+	default:
+		return "superseded"
+	}
+}
+
+// StartPriceScheduler applies scheduled prices that have started and rolls
+// back those that have ended on the given interval
+func StartPriceScheduler(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := applyScheduledPrices(); err != nil {
+				log.Printf("price scheduler failed: %v", err)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+func applyScheduledPrices() error {
+	now := time.Now()
+	rows, err := config.DB.Query(`
+		SELECT DISTINCT product_id
+		FROM product_prices
+		WHERE (applied_at IS NULL AND starts_at <= ?) OR (expired_at IS NULL AND ends_at <= ?)`,
+		now, now,
+	)
+	if err != nil {
+		return err
+	}
+
+	var productIDs []uint
+	for rows.Next() {
+		var id uint
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		productIDs = append(productIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range productIDs {
+		if err := applyProductPrice(id, now); err != nil {
+			log.Printf("price scheduler: product %d: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// Copy the prices in effect at now onto the product row
+func applyProductPrice(productID uint, now time.Time) error {
+	tx, err := config.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var version int
+	if err := tx.QueryRow("SELECT version FROM products WHERE id = ? FOR UPDATE", productID).Scan(&version); err != nil {
+		return err
+	}
+
+	effective, err := priceInEffect(tx, productID, now)
+	if err != nil {
+		return err
+	}
+	if effective != nil {
+		_, err = tx.Exec(`
+			UPDATE products
+			SET price = ?, sales_rate = COALESCE(?, sales_rate), purchase_rate = COALESCE(?, purchase_rate),
+			    version = version + 1
+			WHERE id = ?`,
+			effective.Price, effective.SalesRate, effective.PurchaseRate, productID,
+		)
+		if err != nil {
+			return err
+		}
+
+		var price, salesRate, purchaseRate float64
+		err = tx.QueryRow(
+			"SELECT price, COALESCE(sales_rate, 0), purchase_rate FROM products WHERE id = ?", productID,
+		).Scan(&price, &salesRate, &purchaseRate)
+		if err != nil {
+			return err
+		}
+		err = emitEvent(tx, models.EventProductUpdated, gin.H{
+			"id":            productID,
+			"version":       version + 1,
+			"price":         price,
+			"sales_rate":    salesRate,
+			"purchase_rate": purchaseRate,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(
+		"UPDATE product_prices SET applied_at = ? WHERE product_id = ? AND applied_at IS NULL AND starts_at <= ?",
+		now, productID, now,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		"UPDATE product_prices SET expired_at = ? WHERE product_id = ? AND expired_at IS NULL AND ends_at <= ?",
+		now, productID, now,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func GetProductPrices(c *gin.Context) {
+	productID, ok := parseProductID(c)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	active, err := priceInEffect(config.DB, productID, now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	var activeID uint
+	if active != nil {
+		activeID = active.ID
+	}
+
+	rows, err := config.DB.Query(`
+		SELECT id, product_id, price, sales_rate, purchase_rate, starts_at, ends_at, created_by, created_at
+		FROM product_prices
+		WHERE product_id = ?
+		ORDER BY starts_at DESC, id DESC`,
+		productID,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	prices := []models.ProductPrice{}
+	for rows.Next() {
+		var entry models.ProductPrice
+		if err := rows.Scan(
+			&entry.ID,
+			&entry.ProductID,
+			&entry.Price,
+			&entry.SalesRate,
+			&entry.PurchaseRate,
+			&entry.StartsAt,
+			&entry.EndsAt,
+			&entry.CreatedBy,
+			&entry.CreatedAt,
+		); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		entry.Status = priceStatus(entry, activeID, now)
+		prices = append(prices, entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": prices})
+}
+
+func SchedulePrice(c *gin.Context) {
+	productID, ok := parseProductID(c)
+	if !ok {
+		return
+	}
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	var req models.SchedulePriceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !req.StartsAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "starts_at must be in the future"})
+		return
+	}
+	if req.EndsAt != nil && !req.EndsAt.After(req.StartsAt) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ends_at must be after starts_at"})
+		return
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	// Products created before price history existed get their current price
+	// as a baseline, so an expiring schedule has something to fall back to
+	var count int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM product_prices WHERE product_id = ?", productID).Scan(&count); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if count == 0 {
+		if err := recordPriceChange(tx, productID, nil); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO product_prices (product_id, price, sales_rate, purchase_rate, starts_at, ends_at, created_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		productID, req.Price, req.SalesRate, req.PurchaseRate, req.StartsAt, req.EndsAt, userID,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, models.ProductPrice{
+		ID:           uint(id),
+		ProductID:    productID,
+		Price:        req.Price,
+		SalesRate:    req.SalesRate,
+		PurchaseRate: req.PurchaseRate,
+		StartsAt:     req.StartsAt,
+		EndsAt:       req.EndsAt,
+		Status:       "scheduled",
+		CreatedBy:    &userID,
+		CreatedAt:    time.Now(),
+	})
+}
+
+// Cancel a scheduled price that has not started yet
+func CancelScheduledPrice(c *gin.Context) {
+	productID, ok := parseProductID(c)
+	if !ok {
+		return
+	}
+
+	var startsAt time.Time
+	err := config.DB.QueryRow(
+		"SELECT starts_at FROM product_prices WHERE id = ? AND product_id = ?",
+		c.Param("priceId"), productID,
+	).Scan(&startsAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "price entry not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	if !startsAt.After(time.Now()) {
+		c.JSON(http.StatusConflict, gin.H{"error": "only prices that have not started can be cancelled"})
+		return
+	}
+
+	_, err = config.DB.Exec("DELETE FROM product_prices WHERE id = ? AND applied_at IS NULL", c.Param("priceId"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Scheduled price cancelled successfully"})
+}
@@ -1,9 +1,14 @@
 package controllers
 
 import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
 	"math"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/umesh/ginapi/config"
@@ -24,9 +29,21 @@ func GetProducts(c *gin.Context) {
 
 	offset := (page - 1) * limit
 
+	withDeleted, ok := includeDeleted(c)
+	if !ok {
+		return
+	}
+	where := "WHERE deleted_at IS NULL"
+	if withDeleted {
+		where = ""
+	}
+
 	query := `
-        SELECT id, name, price, quantity, image, sales_rate, purchase_rate 
+        SELECT id, name, COALESCE(sku, ''), COALESCE(category, ''), price, quantity, image, sales_rate, purchase_rate, tax_class,
+               weight, length, width, height, deleted_at,
+               rating_average, rating_count, ` + productReservedStock + `
         FROM products 
+        ` + where + `
         LIMIT ? OFFSET ?
     `
 	rows, err := config.DB.Query(query, limit, offset)
@@ -42,16 +59,28 @@ func GetProducts(c *gin.Context) {
 		err := rows.Scan(
 			&product.ID,
 			&product.Name,
+			&product.SKU,
+			&product.Category,
 			&product.Price,
 			&product.Quantity,
 			&product.Image,
 			&product.SalesRate,
 			&product.PurchaseRate,
+			&product.TaxClass,
+			&product.Weight,
+			&product.Length,
+			&product.Width,
+			&product.Height,
+			&product.DeletedAt,
+			&product.RatingAverage,
+			&product.RatingCount,
+			&product.Reserved,
 		)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
+		product.Available = product.Quantity - product.Reserved
 		products = append(products, product)
 	}
 
@@ -61,7 +90,7 @@ func GetProducts(c *gin.Context) {
 	}
 
 	var total int
-	err = config.DB.QueryRow("SELECT COUNT(*) FROM products").Scan(&total)
+	err = config.DB.QueryRow("SELECT COUNT(*) FROM products " + where).Scan(&total)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -85,8 +114,17 @@ func GetProductByID(c *gin.Context) {
 		return
 	}
 
+	withDeleted, ok := includeDeleted(c)
+	if !ok {
+		return
+	}
+	where := "id = ? AND deleted_at IS NULL"
+	if withDeleted {
+		where = "id = ?"
+	}
+
 	var count int
-	err := config.DB.QueryRow("SELECT COUNT(*) FROM products WHERE id = ?", id).Scan(&count)
+	err := config.DB.QueryRow("SELECT COUNT(*) FROM products WHERE "+where, id).Scan(&count)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -98,16 +136,32 @@ func GetProductByID(c *gin.Context) {
 
 	productData := models.Product{}
 	err = config.DB.QueryRow(`
-		SELECT id, name, price, quantity, image, sales_rate, purchase_rate 
+		SELECT id, name, COALESCE(sku, ''), COALESCE(category, ''), price, quantity, image, sales_rate, purchase_rate, tax_class,
+		       weight, length, width, height, reorder_point, reorder_quantity, deleted_at, version, rating_average, rating_count,
+		       `+productReservedStock+`
 		FROM products WHERE id = ?`, id).
 		Scan(
 			&productData.ID,
 			&productData.Name,
+			&productData.SKU,
+			&productData.Category,
 			&productData.Price,
 			&productData.Quantity,
 			&productData.Image,
 			&productData.SalesRate,
 			&productData.PurchaseRate,
+			&productData.TaxClass,
+			&productData.Weight,
+			&productData.Length,
+			&productData.Width,
+			&productData.Height,
+			&productData.ReorderPoint,
+			&productData.ReorderQuantity,
+			&productData.DeletedAt,
+			&productData.Version,
+			&productData.RatingAverage,
+			&productData.RatingCount,
+			&productData.Reserved,
 		)
 
 	if err != nil {
@@ -115,6 +169,53 @@ func GetProductByID(c *gin.Context) {
 		return
 	}
 
+	//The ETag describes the current product, so historical ?at= views go without one
+	if c.Query("at") == "" {
+		etag := productETag(productData.Version)
+		c.Header("ETag", etag)
+		if header := c.GetHeader("If-None-Match"); header != "" && etagListed(header, etag, true) {
+			c.Status(http.StatusNotModified)
+			return
+		}
+	}
+
+	//With ?at= the prices are the ones in effect at that time instead of the current ones
+	if value := c.Query("at"); value != "" {
+		at, err := parseTimeParam(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		effective, err := priceInEffect(config.DB, productData.ID, at)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if effective != nil {
+			productData.Price = effective.Price
+			if effective.SalesRate != nil {
+				productData.SalesRate = *effective.SalesRate
+			}
+			if effective.PurchaseRate != nil {
+				productData.PurchaseRate = *effective.PurchaseRate
+			}
+		}
+	}
+
+	productData.Available = productData.Quantity - productData.Reserved
+
+	productData.Options, err = loadProductOptions(productData.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	productData.Variants, err = loadProductVariants(productData.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
 	c.JSON(http.StatusOK, productData)
 }
 
@@ -126,12 +227,22 @@ func SearchProducts(c *gin.Context) {
 		return
 	}
 
+	withDeleted, ok := includeDeleted(c)
+	if !ok {
+		return
+	}
+
 	// Prepare the SQL query with search
 	query := `
-        SELECT id, name, price, quantity, image, sales_rate, purchase_rate 
+        SELECT id, name, COALESCE(sku, ''), COALESCE(category, ''), price, quantity, image, sales_rate, purchase_rate, tax_class,
+               weight, length, width, height, deleted_at,
+               rating_average, rating_count, ` + productReservedStock + `
         FROM products 
-        WHERE name LIKE ? OR id LIKE ?
+        WHERE (name LIKE ? OR id LIKE ?)
     `
+	if !withDeleted {
+		query += " AND deleted_at IS NULL"
+	}
 	searchParam := "%" + searchQuery + "%"
 	rows, err := config.DB.Query(query, searchParam, searchParam)
 	if err != nil {
@@ -146,16 +257,28 @@ func SearchProducts(c *gin.Context) {
 		err := rows.Scan(
 			&product.ID,
 			&product.Name,
+			&product.SKU,
+			&product.Category,
 			&product.Price,
 			&product.Quantity,
 			&product.Image,
 			&product.SalesRate,
 			&product.PurchaseRate,
+			&product.TaxClass,
+			&product.Weight,
+			&product.Length,
+			&product.Width,
+			&product.Height,
+			&product.DeletedAt,
+			&product.RatingAverage,
+			&product.RatingCount,
+			&product.Reserved,
 		)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
+		product.Available = product.Quantity - product.Reserved
 		products = append(products, product)
 	}
 
@@ -188,15 +311,53 @@ func CreateProduct(c *gin.Context) {
 		return
 	}
 
-	result, err := config.DB.Exec(`
-		INSERT INTO products (name, price, quantity, image, sales_rate, purchase_rate) 
-		VALUES (?, ?, ?, ?, ?, ?)`,
+	if product.SKU != "" {
+		err = config.DB.QueryRow("SELECT COUNT(*) FROM products WHERE sku = ?", product.SKU).Scan(&count)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if count > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "product with this SKU already exists"})
+			return
+		}
+	}
+
+	if product.TaxClass == "" {
+		product.TaxClass = models.DefaultTaxClass
+	}
+
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		INSERT INTO products (name, sku, category, price, quantity, image, sales_rate, purchase_rate, tax_class,
+		                      weight, length, width, height, reorder_point, reorder_quantity) 
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		product.Name,
+		nullableString(product.SKU),
+		nullableString(product.Category),
 		product.Price,
 		product.Quantity,
 		product.Image,
 		product.SalesRate,
 		product.PurchaseRate,
+		product.TaxClass,
+		product.Weight,
+		product.Length,
+		product.Width,
+		product.Height,
+		product.ReorderPoint,
+		product.ReorderQuantity,
 	)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -209,10 +370,40 @@ func CreateProduct(c *gin.Context) {
 		return
 	}
 
+	//Opening stock is recorded as the first restock of the product
+	err = recordMovement(tx, models.InventoryMovement{
+		ProductID:      uint(id),
+		QuantityChange: product.Quantity,
+		Reason:         models.MovementRestock,
+		Reference:      "product:create",
+		UserID:         &userID,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := recordPriceChange(tx, uint(id), &userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
 	product.ID = uint(id)
+	if err := emitEvent(tx, models.EventProductCreated, product); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
 	c.JSON(http.StatusCreated, product)
 }
 
+// Partially update a product. Only the fields present in the patch are
+// validated and only the columns whose value changed are written.
 func UpdateProduct(c *gin.Context) {
 	id := c.Param("id")
 	if id == "" {
@@ -220,43 +411,250 @@ func UpdateProduct(c *gin.Context) {
 		return
 	}
 
-	var product models.Product
-	if err := c.ShouldBindJSON(&product); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	userID, ok := currentUserID(c)
+	if !ok {
 		return
 	}
 
-	var count int
-	err := config.DB.QueryRow("SELECT COUNT(*) FROM products WHERE id = ?", id).Scan(&count)
+	tx, err := config.DB.Begin()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	if count == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Product does not exist"})
+	defer tx.Rollback()
+
+	//Lock the row so the version check and the stock difference written to the ledger are exact
+	var current models.ProductPatch
+	var productID uint
+	var version int
+	err = tx.QueryRow(`
+		SELECT id, name, COALESCE(sku, ''), COALESCE(category, ''), price, quantity, COALESCE(image, ''), COALESCE(sales_rate, 0),
+		       purchase_rate, tax_class, weight, length, width, height, reorder_point, reorder_quantity, version
+		FROM products WHERE id = ? AND deleted_at IS NULL FOR UPDATE`, id,
+	).Scan(
+		&productID,
+		&current.Name,
+		&current.SKU,
+		&current.Category,
+		&current.Price,
+		&current.Quantity,
+		&current.Image,
+		&current.SalesRate,
+		&current.PurchaseRate,
+		&current.TaxClass,
+		&current.Weight,
+		&current.Length,
+		&current.Width,
+		&current.Height,
+		&current.ReorderPoint,
+		&current.ReorderQuantity,
+		&version,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product does not exist"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
 		return
 	}
 
-	_, err = config.DB.Exec(`
-		UPDATE products 
-		SET name = ?, price = ?, quantity = ?, image = ?, sales_rate = ?, purchase_rate = ?
-		WHERE id = ?`,
-		product.Name,
-		product.Price,
-		product.Quantity,
-		product.Image,
-		product.SalesRate,
-		product.PurchaseRate,
-		id,
-	)
+	if !checkIfMatch(c, version) {
+		return
+	}
+
+	var product models.ProductPatch
+	if !applyRequestPatch(c, current, &product, "name", "price", "quantity", "purchase_rate") {
+		return
+	}
+
+	fieldErrors := map[string]string{}
+	if product.Name == "" {
+		fieldErrors["name"] = "must not be empty"
+	} else if product.Name != current.Name {
+		var count int
+		err = tx.QueryRow("SELECT COUNT(*) FROM products WHERE name = ? AND id != ?", product.Name, productID).Scan(&count)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if count > 0 {
+			fieldErrors["name"] = "product with this name already exists"
+		}
+	}
+	if product.SKU != "" && product.SKU != current.SKU {
+		var count int
+		err = tx.QueryRow("SELECT COUNT(*) FROM products WHERE sku = ? AND id != ?", product.SKU, productID).Scan(&count)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if count > 0 {
+			fieldErrors["sku"] = "product with this SKU already exists"
+		}
+	}
+	if product.Price < 0 {
+		fieldErrors["price"] = "must not be negative"
+	}
+	if product.Quantity < 0 {
+		fieldErrors["quantity"] = "must not be negative"
+	} else if product.Quantity < current.Quantity {
+		assigned, err := assignedStock(tx, productID, nil)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if product.Quantity < assigned {
+			fieldErrors["quantity"] = fmt.Sprintf("must not be below the %d units held at warehouses", assigned)
+		}
+	}
+	if product.SalesRate < 0 {
+		fieldErrors["sales_rate"] = "must not be negative"
+	}
+	if product.PurchaseRate < 0 {
+		fieldErrors["purchase_rate"] = "must not be negative"
+	}
+	if product.TaxClass == "" {
+		fieldErrors["tax_class"] = "must not be empty"
+	} else if len(product.TaxClass) > 50 {
+		fieldErrors["tax_class"] = "must be at most 50 characters"
+	}
+	for field, value := range map[string]*float64{
+		"weight": product.Weight,
+		"length": product.Length,
+		"width":  product.Width,
+		"height": product.Height,
+	} {
+		if value != nil && *value < 0 {
+			fieldErrors[field] = "must not be negative"
+		}
+	}
+	if product.ReorderPoint != nil && *product.ReorderPoint < 0 {
+		fieldErrors["reorder_point"] = "must not be negative"
+	}
+	if product.ReorderQuantity != nil && *product.ReorderQuantity < 1 {
+		fieldErrors["reorder_quantity"] = "must be at least 1"
+	}
+	if len(fieldErrors) > 0 {
+		respondWithFieldErrors(c, fieldErrors)
+		return
+	}
+
+	var sets []string
+	var args []interface{}
+	if product.Name != current.Name {
+		sets, args = append(sets, "name = ?"), append(args, product.Name)
+	}
+	if product.SKU != current.SKU {
+		sets, args = append(sets, "sku = ?"), append(args, nullableString(product.SKU))
+	}
+	if product.Category != current.Category {
+		sets, args = append(sets, "category = ?"), append(args, nullableString(product.Category))
+	}
+	if product.Price != current.Price {
+		sets, args = append(sets, "price = ?"), append(args, product.Price)
+	}
+	if product.Quantity != current.Quantity {
+		sets, args = append(sets, "quantity = ?"), append(args, product.Quantity)
+	}
+	if product.Image != current.Image {
+		sets, args = append(sets, "image = ?"), append(args, product.Image)
+	}
+	if product.SalesRate != current.SalesRate {
+		sets, args = append(sets, "sales_rate = ?"), append(args, product.SalesRate)
+	}
+	if product.PurchaseRate != current.PurchaseRate {
+		sets, args = append(sets, "purchase_rate = ?"), append(args, product.PurchaseRate)
+	}
+	if product.TaxClass != current.TaxClass {
+		sets, args = append(sets, "tax_class = ?"), append(args, product.TaxClass)
+	}
+	if !equalFloatPtr(product.Weight, current.Weight) || !equalFloatPtr(product.Length, current.Length) ||
+		!equalFloatPtr(product.Width, current.Width) || !equalFloatPtr(product.Height, current.Height) {
+		sets = append(sets, "weight = ?", "length = ?", "width = ?", "height = ?")
+		args = append(args, product.Weight, product.Length, product.Width, product.Height)
+	}
+	reorderChanged := !equalIntPtr(product.ReorderPoint, current.ReorderPoint) ||
+		!equalIntPtr(product.ReorderQuantity, current.ReorderQuantity)
+	if reorderChanged {
+		sets = append(sets, "reorder_point = ?", "reorder_quantity = ?")
+		args = append(args, product.ReorderPoint, product.ReorderQuantity)
+	}
+
+	if len(sets) == 0 {
+		c.Header("ETag", productETag(version))
+		c.JSON(http.StatusOK, gin.H{"message": "Product is already up to date"})
+		return
+	}
+
+	sets = append(sets, "version = version + 1")
+	args = append(args, productID)
+	_, err = tx.Exec("UPDATE products SET "+strings.Join(sets, ", ")+" WHERE id = ?", args...)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	err = recordMovement(tx, models.InventoryMovement{
+		ProductID:      productID,
+		QuantityChange: product.Quantity - current.Quantity,
+		Reason:         models.MovementAdjustment,
+		Reference:      "product:update",
+		UserID:         &userID,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if product.Price != current.Price || product.SalesRate != current.SalesRate || product.PurchaseRate != current.PurchaseRate {
+		if err := recordPriceChange(tx, productID, &userID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	err = emitEvent(tx, models.EventProductUpdated, gin.H{
+		"id":      productID,
+		"version": version + 1,
+		"product": product,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if reorderChanged || product.Quantity != current.Quantity {
+		go func() {
+			if err := checkLowStock(productID); err != nil {
+				log.Printf("stock alert check for product %d failed: %v", productID, err)
+			}
+		}()
+	}
+
+	c.Header("ETag", productETag(version+1))
 	c.JSON(http.StatusOK, gin.H{"message": "Product updated successfully"})
 }
 
+func equalIntPtr(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func equalFloatPtr(a, b *float64) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
 func DeleteProduct(c *gin.Context) {
 	id := c.Param("id")
 	if id == "" {
@@ -264,22 +662,118 @@ func DeleteProduct(c *gin.Context) {
 		return
 	}
 
-	var count int
-	err := config.DB.QueryRow("SELECT COUNT(*) FROM products WHERE id = ?", id).Scan(&count)
+	tx, err := config.DB.Begin()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	if count == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Product does not exist"})
+	defer tx.Rollback()
+
+	//Locked so no write lands between the version check and the archive
+	var productID uint
+	var version int
+	err = tx.QueryRow("SELECT id, version FROM products WHERE id = ? AND deleted_at IS NULL FOR UPDATE", id).Scan(&productID, &version)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product does not exist"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	if !checkIfMatch(c, version) {
 		return
 	}
 
-	_, err = config.DB.Exec("DELETE FROM products WHERE id = ?", id)
+	//Products are archived rather than removed, order_items and the stock ledger still point at them
+	_, err = tx.Exec("UPDATE products SET deleted_at = CURRENT_TIMESTAMP, version = version + 1 WHERE id = ?", productID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	_, err = tx.Exec(
+		"UPDATE stock_alerts SET status = 'resolved', resolved_at = CURRENT_TIMESTAMP WHERE product_id = ? AND status = 'open'",
+		productID,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := emitEvent(tx, models.EventProductDeleted, gin.H{"id": productID}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{"message": "Product deleted successfully"})
 }
+
+func RestoreProduct(c *gin.Context) {
+	id := c.Param("id")
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	var productID uint
+	err = tx.QueryRow("SELECT id FROM products WHERE id = ? AND deleted_at IS NOT NULL FOR UPDATE", id).Scan(&productID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "archived product not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE products SET deleted_at = NULL, version = version + 1 WHERE id = ?", productID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := emitEvent(tx, models.EventProductRestored, gin.H{"id": productID}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	//Alerts were resolved when it was archived; raise them again if it is still low
+	go func() {
+		if err := checkLowStock(productID); err != nil {
+			log.Printf("stock alert check for product %d failed: %v", productID, err)
+		}
+	}()
+
+	c.JSON(http.StatusOK, gin.H{"message": "Product restored successfully"})
+}
+
+// Archived products are only listed for admins asking for ?include_deleted=true
+func includeDeleted(c *gin.Context) (bool, bool) {
+	if c.Query("include_deleted") != "true" {
+		return false, true
+	}
+	if !isAdmin(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "admin access required to include deleted products"})
+		return false, false
+	}
+	return true, true
+}
+
+// Store empty strings as NULL so optional unique columns do not collide
+func nullableString(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: value != ""}
+}
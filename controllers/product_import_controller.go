@@ -0,0 +1,665 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/umesh/ginapi/config"
+	"github.com/umesh/ginapi/models"
+	"github.com/umesh/ginapi/utils"
+)
+
+// Imports with more rows than this run as a background job
+const importSyncRowLimit = 500
+
+// How often a background import writes its progress back to import_jobs
+const importProgressInterval = 50
+
+// Imports commit after this many rows, so the products they lock are not
+// held until the whole file is done
+const importBatchSize = 100
+
+var productExportColumns = []string{"id", "name", "sku", "category", "price", "quantity", "image", "sales_rate", "purchase_rate"}
+
+// Map header names to column positions, ignoring case and surrounding spaces
+func importHeader(row []string) map[string]int {
+	header := map[string]int{}
+	for i, name := range row {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if name != "" {
+			header[name] = i
+		}
+	}
+	return header
+}
+
+type importRow struct {
+	header map[string]int
+	values []string
+	// Row number in the file, counting the header as row 1
+	line int
+}
+
+// Report whether a spreadsheet row has nothing filled in
+func blankRow(values []string) bool {
+	for _, value := range values {
+		if strings.TrimSpace(value) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// Value of a column and whether the column was filled in for this row
+func (r importRow) get(column string) (string, bool) {
+	i, ok := r.header[column]
+	if !ok || i >= len(r.values) {
+		return "", false
+	}
+	value := strings.TrimSpace(r.values[i])
+	return value, value != ""
+}
+
+func (r importRow) float(column string) (*float64, error) {
+	value, ok := r.get(column)
+	if !ok {
+		return nil, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f < 0 {
+		return nil, fmt.Errorf("%s must be a non-negative number", column)
+	}
+	return &f, nil
+}
+
+func (r importRow) int(column string) (*int, error) {
+	value, ok := r.get(column)
+	if !ok {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("%s must be a non-negative whole number", column)
+	}
+	return &n, nil
+}
+
+// Create or update one product from a spreadsheet row. Existing products are
+// matched by SKU first and then by name; only the filled in columns are written.
+func importProductRow(tx *sql.Tx, row importRow, userID uint) (string, error) {
+	name, hasName := row.get("name")
+	sku, hasSKU := row.get("sku")
+	category, hasCategory := row.get("category")
+	image, hasImage := row.get("image")
+	if !hasName && !hasSKU {
+		return "", errors.New("name or sku is required")
+	}
+
+	price, err := row.float("price")
+	if err != nil {
+		return "", err
+	}
+	quantity, err := row.int("quantity")
+	if err != nil {
+		return "", err
+	}
+	salesRate, err := row.float("sales_rate")
+	if err != nil {
+		return "", err
+	}
+	purchaseRate, err := row.float("purchase_rate")
+	if err != nil {
+		return "", err
+	}
+
+	var productID int64
+	var previous models.Product
+	var archived bool
+	lookup := `
+		SELECT id, quantity, price, COALESCE(sales_rate, 0), purchase_rate, deleted_at IS NOT NULL
+		FROM products WHERE %s = ? FOR UPDATE`
+	err = sql.ErrNoRows
+	if hasSKU {
+		err = tx.QueryRow(fmt.Sprintf(lookup, "sku"), sku).
+			Scan(&productID, &previous.Quantity, &previous.Price, &previous.SalesRate, &previous.PurchaseRate, &archived)
+	}
+	if errors.Is(err, sql.ErrNoRows) && hasName {
+		err = tx.QueryRow(fmt.Sprintf(lookup, "name"), name).
+			Scan(&productID, &previous.Quantity, &previous.Price, &previous.SalesRate, &previous.PurchaseRate, &archived)
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+	//Archived products keep their name and SKU, so the row can neither update nor create one
+	if archived {
+		return "", fmt.Errorf("product %d is archived, restore it before importing it", productID)
+	}
+
+	if hasName {
+		var count int
+		err := tx.QueryRow("SELECT COUNT(*) FROM products WHERE name = ? AND id != ?", name, productID).Scan(&count)
+		if err != nil {
+			return "", err
+		}
+		if count > 0 {
+			return "", errors.New("product with this name already exists")
+		}
+	}
+	if hasSKU {
+		var count int
+		err := tx.QueryRow("SELECT COUNT(*) FROM products WHERE sku = ? AND id != ?", sku, productID).Scan(&count)
+		if err != nil {
+			return "", err
+		}
+		if count > 0 {
+			return "", errors.New("product with this SKU already exists")
+		}
+	}
+
+	if productID == 0 {
+		if !hasName || price == nil || quantity == nil || purchaseRate == nil {
+			return "", errors.New("name, price, quantity and purchase_rate are required for new products")
+		}
+		result, err := tx.Exec(`
+			INSERT INTO products (name, sku, category, price, quantity, image, sales_rate, purchase_rate)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			name, nullableString(sku), nullableString(category), *price, *quantity, image, salesRate, *purchaseRate,
+		)
+		if err != nil {
+			return "", err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return "", err
+		}
+		err = recordMovement(tx, models.InventoryMovement{
+			ProductID:      uint(id),
+			QuantityChange: *quantity,
+			Reason:         models.MovementRestock,
+			Reference:      "product:import",
+			UserID:         &userID,
+		})
+		if err != nil {
+			return "", err
+		}
+		if err := recordPriceChange(tx, uint(id), &userID); err != nil {
+			return "", err
+		}
+		product, err := importedProduct(tx, id)
+		if err != nil {
+			return "", err
+		}
+		if err := emitEvent(tx, models.EventProductCreated, product); err != nil {
+			return "", err
+		}
+		return "created", nil
+	}
+
+	if quantity != nil && *quantity < previous.Quantity {
+		assigned, err := assignedStock(tx, uint(productID), nil)
+		if err != nil {
+			return "", err
+		}
+		if *quantity < assigned {
+			return "", fmt.Errorf("quantity cannot be below the %d units held at warehouses", assigned)
+		}
+	}
+
+	var sets []string
+	var args []interface{}
+	if hasName {
+		sets, args = append(sets, "name = ?"), append(args, name)
+	}
+	if hasSKU {
+		sets, args = append(sets, "sku = ?"), append(args, sku)
+	}
+	if hasCategory {
+		sets, args = append(sets, "category = ?"), append(args, category)
+	}
+	if price != nil {
+		sets, args = append(sets, "price = ?"), append(args, *price)
+	}
+	if quantity != nil {
+		sets, args = append(sets, "quantity = ?"), append(args, *quantity)
+	}
+	if hasImage {
+		sets, args = append(sets, "image = ?"), append(args, image)
+	}
+	if salesRate != nil {
+		sets, args = append(sets, "sales_rate = ?"), append(args, *salesRate)
+	}
+	if purchaseRate != nil {
+		sets, args = append(sets, "purchase_rate = ?"), append(args, *purchaseRate)
+	}
+
+	sets = append(sets, "version = version + 1")
+	args = append(args, productID)
+	_, err = tx.Exec("UPDATE products SET "+strings.Join(sets, ", ")+" WHERE id = ?", args...)
+	if err != nil {
+		return "", err
+	}
+
+	if quantity != nil {
+		err = recordMovement(tx, models.InventoryMovement{
+			ProductID:      uint(productID),
+			QuantityChange: *quantity - previous.Quantity,
+			Reason:         models.MovementAdjustment,
+			Reference:      "product:import",
+			UserID:         &userID,
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	priceChanged := (price != nil && *price != previous.Price) ||
+		(salesRate != nil && *salesRate != previous.SalesRate) ||
+		(purchaseRate != nil && *purchaseRate != previous.PurchaseRate)
+	if priceChanged {
+		if err := recordPriceChange(tx, uint(productID), &userID); err != nil {
+			return "", err
+		}
+	}
+
+	product, err := importedProduct(tx, productID)
+	if err != nil {
+		return "", err
+	}
+	err = emitEvent(tx, models.EventProductUpdated, gin.H{
+		"id":      productID,
+		"version": product.Version,
+		"product": product,
+	})
+	if err != nil {
+		return "", err
+	}
+	return "updated", nil
+}
+
+// Read back a product an import row wrote, for its webhook event
+func importedProduct(tx *sql.Tx, id int64) (models.Product, error) {
+	var product models.Product
+	err := tx.QueryRow(`
+		SELECT id, name, COALESCE(sku, ''), COALESCE(category, ''), price, quantity, COALESCE(image, ''),
+		       COALESCE(sales_rate, 0), purchase_rate, tax_class, version
+		FROM products WHERE id = ?`,
+		id,
+	).Scan(
+		&product.ID,
+		&product.Name,
+		&product.SKU,
+		&product.Category,
+		&product.Price,
+		&product.Quantity,
+		&product.Image,
+		&product.SalesRate,
+		&product.PurchaseRate,
+		&product.TaxClass,
+		&product.Version,
+	)
+	return product, err
+}
+
+// Apply the data rows, each inside a savepoint so a row that fails part way
+// leaves nothing behind. Rows are committed in batches of importBatchSize. A
+// dry run goes through the same statements and rolls each batch back instead,
+// so the report shows what a real run would do without holding row locks for
+// the whole file.
+func importProducts(records []importRow, userID uint, dryRun bool, progress func(processed int, report models.ImportReport)) (models.ImportReport, error) {
+	report := models.ImportReport{
+		DryRun:    dryRun,
+		TotalRows: len(records),
+		Errors:    []models.ImportRowError{},
+	}
+
+	var tx *sql.Tx
+	defer func() {
+		if tx != nil {
+			tx.Rollback()
+		}
+	}()
+
+	for i, row := range records {
+		if tx == nil {
+			var err error
+			if tx, err = config.DB.Begin(); err != nil {
+				return report, err
+			}
+		}
+
+		savepoint := fmt.Sprintf("import_row_%d", i)
+		if _, err := tx.Exec("SAVEPOINT " + savepoint); err != nil {
+			return report, err
+		}
+		action, err := importProductRow(tx, row, userID)
+		if err != nil {
+			if _, err := tx.Exec("ROLLBACK TO SAVEPOINT " + savepoint); err != nil {
+				return report, err
+			}
+		} else if _, err := tx.Exec("RELEASE SAVEPOINT " + savepoint); err != nil {
+			return report, err
+		}
+		switch {
+		case err != nil:
+			report.Failed++
+			report.Errors = append(report.Errors, models.ImportRowError{Row: row.line, Error: err.Error()})
+		case action == "created":
+			report.Created++
+		default:
+			report.Updated++
+		}
+
+		if (i+1)%importBatchSize == 0 {
+			var err error
+			if dryRun {
+				err = tx.Rollback()
+			} else {
+				err = tx.Commit()
+			}
+			tx = nil
+			if err != nil {
+				return report, err
+			}
+		}
+
+		if progress != nil && (i+1)%importProgressInterval == 0 {
+			progress(i+1, report)
+		}
+	}
+
+	if dryRun || tx == nil {
+		return report, nil
+	}
+	err := tx.Commit()
+	tx = nil
+	return report, err
+}
+
+func ImportProducts(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "CSV or XLSX file is required"})
+		return
+	}
+	dryRun := c.Query("dry_run") == "true"
+
+	f, err := file.Open()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer f.Close()
+
+	rows, err := utils.ReadSpreadsheet(file.Filename, f)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(rows) < 2 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file must contain a header row and at least one product"})
+		return
+	}
+
+	header := importHeader(rows[0])
+	_, hasName := header["name"]
+	_, hasSKU := header["sku"]
+	if !hasName && !hasSKU {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "header must contain a name or sku column"})
+		return
+	}
+	var records []importRow
+	for i, values := range rows[1:] {
+		if blankRow(values) {
+			continue
+		}
+		// Header is row 1, so the first data row is row 2
+		records = append(records, importRow{header: header, values: values, line: i + 2})
+	}
+	if len(records) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file must contain a header row and at least one product"})
+		return
+	}
+
+	if len(records) <= importSyncRowLimit {
+		report, err := importProducts(records, userID, dryRun, nil)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, report)
+		return
+	}
+
+	result, err := config.DB.Exec(`
+		INSERT INTO import_jobs (user_id, filename, dry_run, total_rows)
+		VALUES (?, ?, ?, ?)`,
+		userID, file.Filename, dryRun, len(records),
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	jobID, err := result.LastInsertId()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	go runImportJob(jobID, records, userID, dryRun)
+
+	c.JSON(http.StatusAccepted, models.ImportJob{
+		ID:        uint(jobID),
+		UserID:    userID,
+		Filename:  file.Filename,
+		Status:    "queued",
+		DryRun:    dryRun,
+		TotalRows: len(records),
+		Errors:    []models.ImportRowError{},
+		CreatedAt: time.Now(),
+	})
+}
+
+func runImportJob(jobID int64, records []importRow, userID uint, dryRun bool) {
+	saveProgress := func(processed int, report models.ImportReport) {
+		_, err := config.DB.Exec(`
+			UPDATE import_jobs
+			SET status = 'running', processed_rows = ?, created_count = ?, updated_count = ?, failed_count = ?
+			WHERE id = ?`,
+			processed, report.Created, report.Updated, report.Failed, jobID,
+		)
+		if err != nil {
+			log.Printf("import job %d: failed to save progress: %v", jobID, err)
+		}
+	}
+	saveProgress(0, models.ImportReport{})
+
+	report, err := importProducts(records, userID, dryRun, saveProgress)
+	status := "completed"
+	if err != nil {
+		status = "failed"
+		report.Errors = append(report.Errors, models.ImportRowError{Error: err.Error()})
+	}
+
+	errorsJSON, _ := json.Marshal(report.Errors)
+	_, err = config.DB.Exec(`
+		UPDATE import_jobs
+		SET status = ?, processed_rows = ?, created_count = ?, updated_count = ?, failed_count = ?,
+		    errors = ?, finished_at = CURRENT_TIMESTAMP
+		WHERE id = ?`,
+		status, len(records), report.Created, report.Updated, report.Failed, string(errorsJSON), jobID,
+	)
+	if err != nil {
+		log.Printf("import job %d: failed to save result: %v", jobID, err)
+	}
+}
+
+func GetImportJob(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	var job models.ImportJob
+	var errorsJSON sql.NullString
+	var finishedAt sql.NullTime
+	err := config.DB.QueryRow(`
+		SELECT id, user_id, filename, status, dry_run, total_rows, processed_rows,
+		       created_count, updated_count, failed_count, errors, created_at, finished_at
+		FROM import_jobs
+		WHERE id = ? AND user_id = ?`,
+		c.Param("jobId"), userID,
+	).Scan(
+		&job.ID,
+		&job.UserID,
+		&job.Filename,
+		&job.Status,
+		&job.DryRun,
+		&job.TotalRows,
+		&job.ProcessedRows,
+		&job.Created,
+		&job.Updated,
+		&job.Failed,
+		&errorsJSON,
+		&job.CreatedAt,
+		&finishedAt,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "import job not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	job.Errors = []models.ImportRowError{}
+	if errorsJSON.Valid {
+		if err := json.Unmarshal([]byte(errorsJSON.String), &job.Errors); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if finishedAt.Valid {
+		job.FinishedAt = &finishedAt.Time
+	}
+
+	c.JSON(http.StatusOK, job)
+}
+
+// Row writer shared by the CSV and XLSX exports
+type recordWriter interface {
+	Write(record []string) error
+}
+
+func ExportProducts(c *gin.Context) {
+	format := c.DefaultQuery("format", "csv")
+	if format != "csv" && format != "xlsx" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be csv or xlsx"})
+		return
+	}
+
+	withDeleted, ok := includeDeleted(c)
+	if !ok {
+		return
+	}
+	where := "WHERE deleted_at IS NULL"
+	if withDeleted {
+		where = ""
+	}
+
+	rows, err := config.DB.Query(`
+		SELECT id, name, COALESCE(sku, ''), COALESCE(category, ''), price, quantity, COALESCE(image, ''),
+		       COALESCE(sales_rate, 0), purchase_rate
+		FROM products
+		` + where + `
+		ORDER BY id`)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	filename := fmt.Sprintf("products_%s.%s", time.Now().Format("20060102_150405"), format)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	var writer recordWriter
+	var finish func() error
+	if format == "csv" {
+		c.Header("Content-Type", "text/csv")
+		csvWriter := csv.NewWriter(c.Writer)
+		writer = csvWriter
+		finish = func() error {
+			csvWriter.Flush()
+			return csvWriter.Error()
+		}
+	} else {
+		c.Header("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		xlsxWriter, err := utils.NewXLSXWriter(c.Writer)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		writer = xlsxWriter
+		finish = xlsxWriter.Close
+	}
+	c.Status(http.StatusOK)
+
+	// Once streaming has started the status is sent, so failures can only be logged
+	if err := writer.Write(productExportColumns); err != nil {
+		log.Printf("product export: %v", err)
+		return
+	}
+	for rows.Next() {
+		var product models.Product
+		if err := rows.Scan(
+			&product.ID,
+			&product.Name,
+			&product.SKU,
+			&product.Category,
+			&product.Price,
+			&product.Quantity,
+			&product.Image,
+			&product.SalesRate,
+			&product.PurchaseRate,
+		); err != nil {
+			log.Printf("product export: %v", err)
+			return
+		}
+		err := writer.Write([]string{
+			strconv.Itoa(int(product.ID)),
+			product.Name,
+			product.SKU,
+			product.Category,
+			strconv.FormatFloat(product.Price, 'f', 2, 64),
+			strconv.Itoa(product.Quantity),
+			product.Image,
+			strconv.FormatFloat(product.SalesRate, 'f', 2, 64),
+			strconv.FormatFloat(product.PurchaseRate, 'f', 2, 64),
+		})
+		if err != nil {
+			log.Printf("product export: %v", err)
+			return
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("product export: %v", err)
+		return
+	}
+	if err := finish(); err != nil {
+		log.Printf("product export: %v", err)
+	}
+}
@@ -0,0 +1,668 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/umesh/ginapi/config"
+	"github.com/umesh/ginapi/models"
+)
+
+// A coupon the customer entered cannot be used; shown to them as a 400
+type couponError struct {
+	message string
+}
+
+func (e couponError) Error() string {
+	return e.message
+}
+
+func roundMoney(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+const promotionColumns = `
+	id, code, name, type, value, buy_quantity, get_quantity, min_spend, usage_limit,
+	per_user_limit, used_count, starts_at, ends_at, active, created_at`
+
+func scanPromotion(row interface{ Scan(...interface{}) error }, promotion *models.Promotion) error {
+	return row.Scan(
+		&promotion.ID,
+		&promotion.Code,
+		&promotion.Name,
+		&promotion.Type,
+		&promotion.Value,
+		&promotion.BuyQuantity,
+		&promotion.GetQuantity,
+		&promotion.MinSpend,
+		&promotion.UsageLimit,
+		&promotion.PerUserLimit,
+		&promotion.UsedCount,
+		&promotion.StartsAt,
+		&promotion.EndsAt,
+		&promotion.Active,
+		&promotion.CreatedAt,
+	)
+}
+
+// Fill in the product and category scopes of promotions with one query each
+func loadPromotionScopes(q queryer, promotions []models.Promotion) error {
+	if len(promotions) == 0 {
+		return nil
+	}
+
+	index := make(map[uint]int, len(promotions))
+	args := make([]interface{}, len(promotions))
+	for i := range promotions {
+		promotions[i].ProductIDs = []uint{}
+		promotions[i].Categories = []string{}
+		index[promotions[i].ID] = i
+		args[i] = promotions[i].ID
+	}
+	in := "(?" + strings.Repeat(", ?", len(promotions)-1) + ")"
+
+	rows, err := q.Query("SELECT promotion_id, product_id FROM promotion_products WHERE promotion_id IN "+in, args...)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var promotionID, productID uint
+		if err := rows.Scan(&promotionID, &productID); err != nil {
+			rows.Close()
+			return err
+		}
+		i := index[promotionID]
+		promotions[i].ProductIDs = append(promotions[i].ProductIDs, productID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = q.Query("SELECT promotion_id, category FROM promotion_categories WHERE promotion_id IN "+in, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var promotionID uint
+		var category string
+		if err := rows.Scan(&promotionID, &category); err != nil {
+			return err
+		}
+		i := index[promotionID]
+		promotions[i].Categories = append(promotions[i].Categories, category)
+	}
+	return rows.Err()
+}
+
+// Check that a coupon code exists and is within its validity window
+func findCoupon(tx *sql.Tx, code string, now time.Time) error {
+	var active bool
+	var startsAt, endsAt *time.Time
+	err := tx.QueryRow("SELECT active, starts_at, ends_at FROM promotions WHERE code = ?", code).
+		Scan(&active, &startsAt, &endsAt)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return couponError{"coupon " + code + " does not exist"}
+	case err != nil:
+		return err
+	case !active:
+		return couponError{"coupon " + code + " is no longer active"}
+	case startsAt != nil && startsAt.After(now):
+		return couponError{"coupon " + code + " is not valid yet"}
+	case endsAt != nil && !endsAt.After(now):
+		return couponError{"coupon " + code + " has expired"}
+	}
+	return nil
+}
+
+// Work out the discounts for an order being placed in tx: every automatic
+// promotion it qualifies for plus the coupon, if one was given. Each discount
+// is shared out over the items it covers through their DiscountAmount, and no
+// item is discounted below zero. Promotions are locked until tx ends so usage
+// limits hold under concurrent checkouts.
+func applyPromotions(tx *sql.Tx, userID uint, couponCode string, items []models.OrderItem, categories map[uint]string) ([]models.OrderDiscount, error) {
+	now := time.Now()
+	couponCode = strings.TrimSpace(couponCode)
+	if couponCode != "" {
+		if err := findCoupon(tx, couponCode, now); err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := tx.Query(`
+		SELECT `+promotionColumns+`
+		FROM promotions
+		WHERE active = TRUE AND (code IS NULL OR code = ?)
+		  AND (starts_at IS NULL OR starts_at <= ?) AND (ends_at IS NULL OR ends_at > ?)
+		ORDER BY code IS NOT NULL, id`,
+		couponCode, now, now,
+	)
+	if err != nil {
+		return nil, err
+	}
+	var promotions []models.Promotion
+	for rows.Next() {
+		var promotion models.Promotion
+		if err := scanPromotion(rows, &promotion); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		promotions = append(promotions, promotion)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := loadPromotionScopes(tx, promotions); err != nil {
+		return nil, err
+	}
+
+	var discounts []models.OrderDiscount
+	for _, promotion := range promotions {
+		isCoupon := promotion.Code != nil
+		//Automatic promotions that do not qualify are skipped, a coupon that does not is an error
+		reject := func(message string) error {
+			if isCoupon {
+				return couponError{fmt.Sprintf("coupon %s %s", couponCode, message)}
+			}
+			return nil
+		}
+
+		var eligible []int
+		var eligibleTotal float64
+		for i, item := range items {
+			if promotionCovers(promotion, item.ProductID, categories[item.ProductID]) {
+				eligible = append(eligible, i)
+				eligibleTotal += item.TotalPrice
+			}
+		}
+		if len(eligible) == 0 {
+			if err := reject("does not apply to any item in this order"); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if promotion.MinSpend != nil && eligibleTotal < *promotion.MinSpend {
+			if err := reject(fmt.Sprintf("requires a minimum spend of %.2f", *promotion.MinSpend)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		//Only limited promotions that apply are locked, so other checkouts are not held up.
+		//The count is read again under the lock.
+		if promotion.UsageLimit != nil || promotion.PerUserLimit != nil {
+			err := tx.QueryRow("SELECT used_count FROM promotions WHERE id = ? FOR UPDATE", promotion.ID).Scan(&promotion.UsedCount)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if promotion.UsageLimit != nil && promotion.UsedCount >= *promotion.UsageLimit {
+			if err := reject("has reached its usage limit"); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if promotion.PerUserLimit != nil {
+			var used int
+			err := tx.QueryRow(`
+				SELECT COUNT(*) FROM order_discounts od
+				JOIN orders o ON o.id = od.order_id
+				WHERE od.promotion_id = ? AND o.user_id = ? AND o.status != 'cancelled'`,
+				promotion.ID, userID,
+			).Scan(&used)
+			if err != nil {
+				return nil, err
+			}
+			if used >= *promotion.PerUserLimit {
+				if err := reject("has already been used the maximum number of times"); err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
+
+		amount := allocateDiscount(items, eligible, promotionDiscount(promotion, items, eligible, eligibleTotal))
+		if amount <= 0 {
+			if err := reject("gives no discount on this order"); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		discount := models.OrderDiscount{
+			PromotionID: promotion.ID,
+			Description: promotion.Name,
+			Amount:      amount,
+		}
+		if isCoupon {
+			discount.Code = *promotion.Code
+		}
+		discounts = append(discounts, discount)
+	}
+
+	return discounts, nil
+}
+
+func promotionCovers(promotion models.Promotion, productID uint, category string) bool {
+	if len(promotion.ProductIDs) == 0 && len(promotion.Categories) == 0 {
+		return true
+	}
+	for _, id := range promotion.ProductIDs {
+		if id == productID {
+			return true
+		}
+	}
+	for _, scoped := range promotion.Categories {
+		if category != "" && strings.EqualFold(scoped, category) {
+			return true
+		}
+	}
+	return false
+}
+
+// The undiscounted amount a promotion takes off the eligible items. Buy X get Y
+// gives away the cheapest units: for every X+Y units bought, Y are free.
+func promotionDiscount(promotion models.Promotion, items []models.OrderItem, eligible []int, eligibleTotal float64) float64 {
+	switch promotion.Type {
+	case models.PromotionPercentage:
+		return eligibleTotal * promotion.Value / 100
+	case models.PromotionFixed:
+		return promotion.Value
+	case models.PromotionBuyXGetY:
+		if promotion.BuyQuantity == nil || promotion.GetQuantity == nil {
+			return 0
+		}
+		var units []float64
+		for _, i := range eligible {
+			for n := 0; n < items[i].Quantity; n++ {
+				units = append(units, items[i].UnitPrice)
+			}
+		}
+		sort.Float64s(units)
+		free := len(units) / (*promotion.BuyQuantity + *promotion.GetQuantity) * *promotion.GetQuantity
+		var amount float64
+		for _, price := range units[:free] {
+			amount += price
+		}
+		return amount
+	}
+	return 0
+}
+
+// Spread a discount over the eligible items in proportion to what is left to
+// pay on each, rounding to cents. Returns the amount actually allocated.
+func allocateDiscount(items []models.OrderItem, eligible []int, amount float64) float64 {
+	var remaining float64
+	for _, i := range eligible {
+		remaining += items[i].TotalPrice - items[i].DiscountAmount
+	}
+	amount = roundMoney(math.Min(amount, remaining))
+	if amount <= 0 {
+		return 0
+	}
+
+	allocated := 0.0
+	for n, i := range eligible {
+		left := items[i].TotalPrice - items[i].DiscountAmount
+		share := roundMoney(amount * left / remaining)
+		//The last item takes the rounding difference
+		if n == len(eligible)-1 {
+			share = roundMoney(amount - allocated)
+		}
+		share = math.Min(share, roundMoney(left))
+		items[i].DiscountAmount = roundMoney(items[i].DiscountAmount + share)
+		allocated = roundMoney(allocated + share)
+	}
+	return allocated
+}
+
+// Store the discount lines of a new order and count the promotions as used
+func recordOrderDiscounts(tx *sql.Tx, orderID int64, discounts []models.OrderDiscount) error {
+	for i, discount := range discounts {
+		result, err := tx.Exec(`
+			INSERT INTO order_discounts (order_id, promotion_id, code, description, amount)
+			VALUES (?, ?, ?, ?, ?)`,
+			orderID, discount.PromotionID, nullableString(discount.Code), discount.Description, discount.Amount,
+		)
+		if err != nil {
+			return err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		discounts[i].ID = uint(id)
+
+		if _, err := tx.Exec("UPDATE promotions SET used_count = used_count + 1 WHERE id = ?", discount.PromotionID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func loadOrderDiscounts(orderID uint) ([]models.OrderDiscount, error) {
+	rows, err := config.DB.Query(`
+		SELECT id, promotion_id, COALESCE(code, ''), description, amount
+		FROM order_discounts WHERE order_id = ? ORDER BY id`,
+		orderID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var discounts []models.OrderDiscount
+	for rows.Next() {
+		var discount models.OrderDiscount
+		if err := rows.Scan(&discount.ID, &discount.PromotionID, &discount.Code, &discount.Description, &discount.Amount); err != nil {
+			return nil, err
+		}
+		discounts = append(discounts, discount)
+	}
+	return discounts, rows.Err()
+}
+
+func validatePromotionRequest(req *models.PromotionRequest) string {
+	if req.Code != nil {
+		code := strings.TrimSpace(*req.Code)
+		if code == "" {
+			req.Code = nil
+		} else {
+			req.Code = &code
+		}
+	}
+	switch req.Type {
+	case models.PromotionPercentage:
+		if req.Value <= 0 || req.Value > 100 {
+			return "value must be a percentage between 0 and 100"
+		}
+	case models.PromotionFixed:
+		if req.Value <= 0 {
+			return "value must be greater than 0"
+		}
+	case models.PromotionBuyXGetY:
+		if req.BuyQuantity == nil || req.GetQuantity == nil {
+			return "buy_quantity and get_quantity are required for buy_x_get_y promotions"
+		}
+	}
+	if req.StartsAt != nil && req.EndsAt != nil && !req.EndsAt.After(*req.StartsAt) {
+		return "ends_at must be after starts_at"
+	}
+	return ""
+}
+
+// Replace the product and category scope of a promotion
+func savePromotionScopes(tx *sql.Tx, promotionID uint, req models.PromotionRequest) error {
+	if _, err := tx.Exec("DELETE FROM promotion_products WHERE promotion_id = ?", promotionID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM promotion_categories WHERE promotion_id = ?", promotionID); err != nil {
+		return err
+	}
+	for _, productID := range req.ProductIDs {
+		_, err := tx.Exec("INSERT IGNORE INTO promotion_products (promotion_id, product_id) VALUES (?, ?)", promotionID, productID)
+		if err != nil {
+			return err
+		}
+	}
+	for _, category := range req.Categories {
+		category = strings.TrimSpace(category)
+		if category == "" {
+			continue
+		}
+		_, err := tx.Exec("INSERT IGNORE INTO promotion_categories (promotion_id, category) VALUES (?, ?)", promotionID, category)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getPromotion(id interface{}) (models.Promotion, error) {
+	var promotion models.Promotion
+	err := scanPromotion(config.DB.QueryRow("SELECT "+promotionColumns+" FROM promotions WHERE id = ?", id), &promotion)
+	if err != nil {
+		return promotion, err
+	}
+	promotions := []models.Promotion{promotion}
+	err = loadPromotionScopes(config.DB, promotions)
+	return promotions[0], err
+}
+
+func GetPromotions(c *gin.Context) {
+	query := "SELECT " + promotionColumns + " FROM promotions"
+	if c.Query("active") == "true" {
+		query += " WHERE active = TRUE"
+	}
+	query += " ORDER BY created_at DESC, id DESC"
+
+	rows, err := config.DB.Query(query)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	promotions := []models.Promotion{}
+	for rows.Next() {
+		var promotion models.Promotion
+		if err := scanPromotion(rows, &promotion); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		promotions = append(promotions, promotion)
+	}
+
+	if err = rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := loadPromotionScopes(config.DB, promotions); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": promotions})
+}
+
+func GetPromotionByID(c *gin.Context) {
+	promotion, err := getPromotion(c.Param("id"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "promotion not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, promotion)
+}
+
+func CreatePromotion(c *gin.Context) {
+	var req models.PromotionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if message := validatePromotionRequest(&req); message != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": message})
+		return
+	}
+
+	if req.Code != nil {
+		var count int
+		if err := config.DB.QueryRow("SELECT COUNT(*) FROM promotions WHERE code = ?", *req.Code).Scan(&count); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if count > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "a promotion with this code already exists"})
+			return
+		}
+	}
+
+	active := true
+	if req.Active != nil {
+		active = *req.Active
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		INSERT INTO promotions (code, name, type, value, buy_quantity, get_quantity, min_spend,
+		                        usage_limit, per_user_limit, starts_at, ends_at, active)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		req.Code, req.Name, req.Type, req.Value, req.BuyQuantity, req.GetQuantity, req.MinSpend,
+		req.UsageLimit, req.PerUserLimit, req.StartsAt, req.EndsAt, active,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := savePromotionScopes(tx, uint(id), req); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	promotion, err := getPromotion(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, promotion)
+}
+
+// Replace the settings of a promotion. Its usage count is kept.
+func UpdatePromotion(c *gin.Context) {
+	var req models.PromotionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if message := validatePromotionRequest(&req); message != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": message})
+		return
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	var promotionID uint
+	var active bool
+	err = tx.QueryRow("SELECT id, active FROM promotions WHERE id = ? FOR UPDATE", c.Param("id")).Scan(&promotionID, &active)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "promotion not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	if req.Active != nil {
+		active = *req.Active
+	}
+
+	if req.Code != nil {
+		var count int
+		err := tx.QueryRow("SELECT COUNT(*) FROM promotions WHERE code = ? AND id != ?", *req.Code, promotionID).Scan(&count)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if count > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "a promotion with this code already exists"})
+			return
+		}
+	}
+
+	_, err = tx.Exec(`
+		UPDATE promotions
+		SET code = ?, name = ?, type = ?, value = ?, buy_quantity = ?, get_quantity = ?, min_spend = ?,
+		    usage_limit = ?, per_user_limit = ?, starts_at = ?, ends_at = ?, active = ?
+		WHERE id = ?`,
+		req.Code, req.Name, req.Type, req.Value, req.BuyQuantity, req.GetQuantity, req.MinSpend,
+		req.UsageLimit, req.PerUserLimit, req.StartsAt, req.EndsAt, active, promotionID,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := savePromotionScopes(tx, promotionID, req); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	promotion, err := getPromotion(promotionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, promotion)
+}
+
+// Promotions stay referenced by the orders they discounted, so deleting one
+// only deactivates it
+func DeletePromotion(c *gin.Context) {
+	result, err := config.DB.Exec("UPDATE promotions SET active = FALSE WHERE id = ?", c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if affected == 0 {
+		var count int
+		if err := config.DB.QueryRow("SELECT COUNT(*) FROM promotions WHERE id = ?", c.Param("id")).Scan(&count); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if count == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "promotion not found"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Promotion deactivated successfully"})
+}
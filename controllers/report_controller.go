@@ -0,0 +1,300 @@
+package controllers
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/umesh/ginapi/config"
+	"github.com/umesh/ginapi/models"
+)
+
+// Orders that did not end in a sale are left out of sales reports
+const reportedOrderStatuses = "o.status NOT IN ('cancelled', 'refunded')"
+
+// Cost of one unit of an order item. Items sold before unit_cost was stored
+// fall back to the cost on their sale movement and then to the current purchase rate.
+const orderItemUnitCost = `COALESCE(
+	oi.unit_cost,
+	(SELECT m.unit_cost FROM inventory_movements m
+	 WHERE m.reference = CONCAT('order:', oi.order_id) AND m.product_id = oi.product_id
+	   AND m.variant_id <=> oi.variant_id AND m.reason = 'sale'
+	 LIMIT 1),
+	p.purchase_rate
+)`
+
+var marginPeriodFormats = map[string]string{
+	"day":   "%Y-%m-%d",
+	"week":  "%x-W%v",
+	"month": "%Y-%m",
+}
+
+var marginCSVHeader = []string{
+	"key", "label", "quantity_sold", "revenue", "discounts", "net_revenue", "cost", "gross_margin", "margin_percent",
+}
+
+// Read the from and to query parameters. A plain date for to includes the whole day.
+func reportDateRange(c *gin.Context) (conditions []string, args []interface{}, ok bool) {
+	if value := c.Query("from"); value != "" {
+		from, err := parseTimeParam(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return nil, nil, false
+		}
+		conditions, args = append(conditions, "o.created_at >= ?"), append(args, from)
+	}
+	if value := c.Query("to"); value != "" {
+		to, err := parseTimeParam(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return nil, nil, false
+		}
+		if len(value) == len("2006-01-02") {
+			to = to.AddDate(0, 0, 1)
+		}
+		conditions, args = append(conditions, "o.created_at < ?"), append(args, to)
+	}
+	return conditions, args, true
+}
+
+// Gross margin per product
+func GetProductMargins(c *gin.Context) {
+	marginReport(c, "product", "CAST(p.id AS CHAR)", "p.name", "gross_margin DESC")
+}
+
+// Gross margin per product category
+func GetCategoryMargins(c *gin.Context) {
+	marginReport(c, "category", "COALESCE(p.category, '')", "COALESCE(p.category, 'Uncategorized')", "gross_margin DESC")
+}
+
+// Gross margin per day, week or month
+func GetPeriodMargins(c *gin.Context) {
+	period := c.DefaultQuery("period", "month")
+	format, ok := marginPeriodFormats[period]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "period must be day, week or month"})
+		return
+	}
+	key := fmt.Sprintf("DATE_FORMAT(o.created_at, '%s')", format)
+	marginReport(c, "period_"+period, key, key, "report_key")
+}
+
+func marginReport(c *gin.Context, name, key, label, orderBy string) {
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "csv" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or csv"})
+		return
+	}
+
+	conditions, args, ok := reportDateRange(c)
+	if !ok {
+		return
+	}
+	where := "WHERE " + reportedOrderStatuses
+	for _, condition := range conditions {
+		where += " AND " + condition
+	}
+
+	rows, err := config.DB.Query(`
+		SELECT report_key, report_label, quantity_sold, revenue, discounts, cost,
+		       revenue - discounts - cost AS gross_margin
+		FROM (
+			SELECT `+key+` AS report_key, MIN(`+label+`) AS report_label,
+			       SUM(oi.quantity) AS quantity_sold,
+			       SUM(oi.total_price - IF(oi.tax_inclusive, oi.tax_amount, 0)) AS revenue,
+			       SUM(oi.discount_amount) AS discounts,
+			       SUM(oi.quantity * `+orderItemUnitCost+`) AS cost
+			FROM order_items oi
+			JOIN orders o ON o.id = oi.order_id
+			JOIN products p ON p.id = oi.product_id
+			`+where+`
+			GROUP BY report_key
+		) margins
+		ORDER BY `+orderBy,
+		args...,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	report := []models.MarginRow{}
+	totals := models.MarginRow{Key: "total", Label: "Total"}
+	for rows.Next() {
+		var row models.MarginRow
+		if err := rows.Scan(
+			&row.Key,
+			&row.Label,
+			&row.QuantitySold,
+			&row.Revenue,
+			&row.Discounts,
+			&row.Cost,
+			&row.GrossMargin,
+		); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		totals.QuantitySold += row.QuantitySold
+		totals.Revenue += row.Revenue
+		totals.Discounts += row.Discounts
+		totals.Cost += row.Cost
+		report = append(report, finishMarginRow(row))
+	}
+
+	if err = rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	totals.GrossMargin = totals.Revenue - totals.Discounts - totals.Cost
+	totals = finishMarginRow(totals)
+
+	if format == "json" {
+		c.JSON(http.StatusOK, gin.H{"data": report, "totals": totals})
+		return
+	}
+
+	filename := fmt.Sprintf("margins_%s_%s.csv", name, time.Now().Format("20060102_150405"))
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Header("Content-Type", "text/csv")
+	c.Status(http.StatusOK)
+
+	writer := csv.NewWriter(c.Writer)
+	writer.Write(marginCSVHeader)
+	for _, row := range append(report, totals) {
+		writer.Write([]string{
+			row.Key,
+			row.Label,
+			strconv.Itoa(row.QuantitySold),
+			strconv.FormatFloat(row.Revenue, 'f', 2, 64),
+			strconv.FormatFloat(row.Discounts, 'f', 2, 64),
+			strconv.FormatFloat(row.NetRevenue, 'f', 2, 64),
+			strconv.FormatFloat(row.Cost, 'f', 2, 64),
+			strconv.FormatFloat(row.GrossMargin, 'f', 2, 64),
+			strconv.FormatFloat(row.MarginPercent, 'f', 2, 64),
+		})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		log.Printf("margin report export: %v", err)
+	}
+}
+
+func finishMarginRow(row models.MarginRow) models.MarginRow {
+	row.Revenue = roundMoney(row.Revenue)
+	row.Discounts = roundMoney(row.Discounts)
+	row.Cost = roundMoney(row.Cost)
+	row.NetRevenue = roundMoney(row.Revenue - row.Discounts)
+	row.GrossMargin = roundMoney(row.GrossMargin)
+	if row.NetRevenue != 0 {
+		row.MarginPercent = roundMoney(row.GrossMargin / row.NetRevenue * 100)
+	}
+	return row
+}
+
+var taxSummaryCSVHeader = []string{
+	"region", "tax_class", "rate", "inclusive", "order_count", "taxable_amount", "tax_amount",
+}
+
+// Tax charged per region, tax class and rate, for filing returns. Rates are
+// the ones stored on the order items, so later rate changes do not alter it.
+func GetTaxSummary(c *gin.Context) {
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "csv" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or csv"})
+		return
+	}
+
+	conditions, args, ok := reportDateRange(c)
+	if !ok {
+		return
+	}
+	where := "WHERE " + reportedOrderStatuses
+	for _, condition := range conditions {
+		where += " AND " + condition
+	}
+
+	rows, err := config.DB.Query(`
+		SELECT o.tax_region, oi.tax_class, oi.tax_rate, oi.tax_inclusive,
+		       COUNT(DISTINCT o.id),
+		       SUM(oi.total_price - oi.discount_amount - IF(oi.tax_inclusive, oi.tax_amount, 0)),
+		       SUM(oi.tax_amount)
+		FROM order_items oi
+		JOIN orders o ON o.id = oi.order_id
+		`+where+`
+		GROUP BY o.tax_region, oi.tax_class, oi.tax_rate, oi.tax_inclusive
+		ORDER BY o.tax_region, oi.tax_class, oi.tax_rate`,
+		args...,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	report := []models.TaxSummaryRow{}
+	var taxable, tax float64
+	for rows.Next() {
+		var row models.TaxSummaryRow
+		if err := rows.Scan(
+			&row.Region,
+			&row.TaxClass,
+			&row.Rate,
+			&row.Inclusive,
+			&row.OrderCount,
+			&row.TaxableAmount,
+			&row.TaxAmount,
+		); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		row.TaxableAmount = roundMoney(row.TaxableAmount)
+		row.TaxAmount = roundMoney(row.TaxAmount)
+		taxable += row.TaxableAmount
+		tax += row.TaxAmount
+		report = append(report, row)
+	}
+
+	if err = rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	totals := gin.H{"taxable_amount": roundMoney(taxable), "tax_amount": roundMoney(tax)}
+
+	if format == "json" {
+		c.JSON(http.StatusOK, gin.H{"data": report, "totals": totals})
+		return
+	}
+
+	filename := fmt.Sprintf("tax_summary_%s.csv", time.Now().Format("20060102_150405"))
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Header("Content-Type", "text/csv")
+	c.Status(http.StatusOK)
+
+	writer := csv.NewWriter(c.Writer)
+	writer.Write(taxSummaryCSVHeader)
+	for _, row := range report {
+		writer.Write([]string{
+			row.Region,
+			row.TaxClass,
+			strconv.FormatFloat(row.Rate, 'f', 3, 64),
+			strconv.FormatBool(row.Inclusive),
+			strconv.Itoa(row.OrderCount),
+			strconv.FormatFloat(row.TaxableAmount, 'f', 2, 64),
+			strconv.FormatFloat(row.TaxAmount, 'f', 2, 64),
+		})
+	}
+	writer.Write([]string{
+		"total", "", "", "", "",
+		strconv.FormatFloat(roundMoney(taxable), 'f', 2, 64),
+		strconv.FormatFloat(roundMoney(tax), 'f', 2, 64),
+	})
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		log.Printf("tax summary export: %v", err)
+	}
+}
@@ -0,0 +1,369 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/umesh/ginapi/config"
+	"github.com/umesh/ginapi/models"
+)
+
+// How long a reservation holds stock when the request does not say
+var reservationTTL = 15 * time.Minute
+
+// What one customer may hold at a time, so nobody can tie up a product's
+// whole stock by reserving it over and over
+const (
+	maxActiveReservations = 3
+	maxReservedUnits      = 50
+)
+
+// Units of the product in the current products row held by reservations.
+// Expiry is checked against the database clock, so an expired reservation
+// stops counting even before the sweeper has marked it.
+const productReservedStock = `COALESCE((
+	SELECT SUM(ri.quantity) FROM stock_reservation_items ri
+	JOIN stock_reservations r ON r.id = ri.reservation_id
+	WHERE ri.product_id = products.id AND ri.variant_id IS NULL
+	  AND r.status = 'active' AND r.expires_at > NOW()
+), 0)`
+
+const variantReservedStock = `COALESCE((
+	SELECT SUM(ri.quantity) FROM stock_reservation_items ri
+	JOIN stock_reservations r ON r.id = ri.reservation_id
+	WHERE ri.variant_id = product_variants.id
+	  AND r.status = 'active' AND r.expires_at > NOW()
+), 0)`
+
+// A reservation given at checkout cannot be used; shown to the customer as a 400
+type reservationError struct {
+	message string
+}
+
+func (e reservationError) Error() string {
+	return e.message
+}
+
+// Units of a product or variant held by reservations, leaving out the one
+// being consumed, if any
+func reservedStock(q queryer, productID uint, variantID *uint, exclude *uint) (int, error) {
+	query := `
+		SELECT COALESCE(SUM(ri.quantity), 0) FROM stock_reservation_items ri
+		JOIN stock_reservations r ON r.id = ri.reservation_id
+		WHERE ri.product_id = ? AND ri.variant_id <=> ?
+		  AND r.status = 'active' AND r.expires_at > NOW()`
+	args := []interface{}{productID, variantID}
+	if exclude != nil {
+		query += " AND r.id != ?"
+		args = append(args, *exclude)
+	}
+
+	var reserved int
+	err := q.QueryRow(query, args...).Scan(&reserved)
+	return reserved, err
+}
+
+// Lock a reservation of the user that is about to be consumed by an order
+func lockReservation(tx *sql.Tx, reservationID, userID uint) error {
+	var owner uint
+	var status string
+	var live bool
+	err := tx.QueryRow(
+		"SELECT user_id, status, expires_at > NOW() FROM stock_reservations WHERE id = ? FOR UPDATE",
+		reservationID,
+	).Scan(&owner, &status, &live)
+	switch {
+	case errors.Is(err, sql.ErrNoRows) || (err == nil && owner != userID):
+		return reservationError{"reservation not found"}
+	case err != nil:
+		return err
+	case status != models.ReservationActive:
+		return reservationError{"reservation is " + status}
+	case !live:
+		return reservationError{"reservation has expired"}
+	}
+	return nil
+}
+
+func consumeReservation(tx *sql.Tx, reservationID uint, orderID int64) error {
+	_, err := tx.Exec(
+		"UPDATE stock_reservations SET status = ?, order_id = ? WHERE id = ?",
+		models.ReservationConsumed, orderID, reservationID,
+	)
+	return err
+}
+
+// StartReservationSweeper sets the default reservation length and marks
+// reservations past their expiry as expired on the given interval
+func StartReservationSweeper(ttl, interval time.Duration) {
+	reservationTTL = ttl
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := expireReservations(); err != nil {
+				log.Printf("reservation sweeper failed: %v", err)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+func expireReservations() error {
+	_, err := config.DB.Exec(
+		"UPDATE stock_reservations SET status = ? WHERE status = ? AND expires_at <= NOW()",
+		models.ReservationExpired, models.ReservationActive,
+	)
+	return err
+}
+
+func loadReservation(id interface{}) (models.Reservation, error) {
+	var reservation models.Reservation
+	err := config.DB.QueryRow(`
+		SELECT id, user_id, status, expires_at, order_id, created_at
+		FROM stock_reservations WHERE id = ?`, id,
+	).Scan(
+		&reservation.ID,
+		&reservation.UserID,
+		&reservation.Status,
+		&reservation.ExpiresAt,
+		&reservation.OrderID,
+		&reservation.CreatedAt,
+	)
+	if err != nil {
+		return reservation, err
+	}
+
+	//The sweeper may not have run yet
+	if reservation.Status == models.ReservationActive && !reservation.ExpiresAt.After(time.Now()) {
+		reservation.Status = models.ReservationExpired
+	}
+
+	rows, err := config.DB.Query(
+		"SELECT product_id, variant_id, quantity FROM stock_reservation_items WHERE reservation_id = ? ORDER BY id",
+		reservation.ID,
+	)
+	if err != nil {
+		return reservation, err
+	}
+	defer rows.Close()
+
+	reservation.Items = []models.ReservationItem{}
+	for rows.Next() {
+		var item models.ReservationItem
+		if err := rows.Scan(&item.ProductID, &item.VariantID, &item.Quantity); err != nil {
+			return reservation, err
+		}
+		reservation.Items = append(reservation.Items, item)
+	}
+	return reservation, rows.Err()
+}
+
+// Hold stock for the current user while they check out
+func CreateReservation(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	var req models.CreateReservationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ttl := reservationTTL
+	if req.Minutes > 0 {
+		ttl = time.Duration(req.Minutes) * time.Minute
+	}
+
+	//The same product can be listed more than once, so check the combined quantity
+	type stockKey struct {
+		productID uint
+		variantID uint
+	}
+	requested := map[stockKey]int{}
+	var items []models.ReservationItem
+	for _, item := range req.Items {
+		key := stockKey{item.ProductID, variantKey(item.VariantID)}
+		if _, seen := requested[key]; !seen {
+			items = append(items, models.ReservationItem{ProductID: item.ProductID, VariantID: item.VariantID})
+		}
+		requested[key] += item.Quantity
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	//Locking the user serialises their reservations so the limits hold
+	var locked uint
+	if err := tx.QueryRow("SELECT id FROM users WHERE id = ? FOR UPDATE", userID).Scan(&locked); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	var active, held int
+	err = tx.QueryRow(`
+		SELECT COUNT(DISTINCT r.id), COALESCE(SUM(ri.quantity), 0)
+		FROM stock_reservations r
+		LEFT JOIN stock_reservation_items ri ON ri.reservation_id = r.id
+		WHERE r.user_id = ? AND r.status = 'active' AND r.expires_at > NOW()`,
+		userID,
+	).Scan(&active, &held)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if active >= maxActiveReservations {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("you already have %d active reservations", active)})
+		return
+	}
+	units := 0
+	for _, quantity := range requested {
+		units += quantity
+	}
+	if held+units > maxReservedUnits {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": fmt.Sprintf("reservations are limited to %d units at a time (held: %d, requested: %d)", maxReservedUnits, held, units),
+		})
+		return
+	}
+
+	for i, item := range items {
+		item.Quantity = requested[stockKey{item.ProductID, variantKey(item.VariantID)}]
+		items[i] = item
+
+		var count int
+		err := tx.QueryRow("SELECT COUNT(*) FROM products WHERE id = ? AND deleted_at IS NULL", item.ProductID).Scan(&count)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		//Locking the stock row serialises reservations and orders for the product
+		var total int
+		if count > 0 {
+			total, err = lockStockTotal(tx, item.ProductID, item.VariantID)
+		}
+		if count == 0 || errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("product %d not found", item.ProductID)})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		reserved, err := reservedStock(tx, item.ProductID, item.VariantID, nil)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if available := total - reserved; available < item.Quantity {
+			c.JSON(http.StatusConflict, gin.H{
+				"error": fmt.Sprintf("insufficient stock for product %d (available: %d, requested: %d)",
+					item.ProductID, available, item.Quantity),
+			})
+			return
+		}
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO stock_reservations (user_id, status, expires_at)
+		VALUES (?, ?, DATE_ADD(NOW(), INTERVAL ? SECOND))`,
+		userID, models.ReservationActive, int(ttl.Seconds()),
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	for _, item := range items {
+		_, err := tx.Exec(`
+			INSERT INTO stock_reservation_items (reservation_id, product_id, variant_id, quantity)
+			VALUES (?, ?, ?, ?)`,
+			id, item.ProductID, item.VariantID, item.Quantity,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	reservation, err := loadReservation(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, reservation)
+}
+
+func GetReservation(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	reservation, err := loadReservation(c.Param("id"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "reservation not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	if reservation.UserID != userID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "reservation not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, reservation)
+}
+
+// Give the held stock back before the reservation expires
+func ReleaseReservation(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	result, err := config.DB.Exec(
+		"UPDATE stock_reservations SET status = ? WHERE id = ? AND user_id = ? AND status = ?",
+		models.ReservationReleased, c.Param("id"), userID, models.ReservationActive,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if affected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no active reservation with this ID"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Reservation released successfully"})
+}
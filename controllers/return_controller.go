@@ -0,0 +1,612 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/umesh/ginapi/config"
+	"github.com/umesh/ginapi/models"
+)
+
+// partial or full once any of the order has been paid back
+func refundStatus(total, refunded float64) string {
+	switch {
+	case refunded <= 0:
+		return ""
+	case refunded < total:
+		return "partial"
+	default:
+		return "full"
+	}
+}
+
+// Units of an order item already covered by returns that were not rejected
+func returnedQuantity(q queryer, orderItemID uint) (int, error) {
+	var quantity int
+	err := q.QueryRow(`
+		SELECT COALESCE(SUM(ri.quantity), 0)
+		FROM return_items ri
+		JOIN returns r ON r.id = ri.return_id
+		WHERE ri.order_item_id = ? AND r.status != ?`,
+		orderItemID, models.ReturnRejected,
+	).Scan(&quantity)
+	return quantity, err
+}
+
+func loadReturn(q queryer, id interface{}) (models.Return, error) {
+	var ret models.Return
+	err := q.QueryRow(`
+		SELECT id, order_id, user_id, status, reason, COALESCE(admin_note, ''), refund_amount, refunded_amount,
+		       created_at, updated_at
+		FROM returns WHERE id = ?`,
+		id,
+	).Scan(
+		&ret.ID,
+		&ret.OrderID,
+		&ret.UserID,
+		&ret.Status,
+		&ret.Reason,
+		&ret.AdminNote,
+		&ret.RefundAmount,
+		&ret.RefundedAmount,
+		&ret.CreatedAt,
+		&ret.UpdatedAt,
+	)
+	if err != nil {
+		return ret, err
+	}
+
+	rows, err := q.Query(`
+		SELECT ri.id, ri.order_item_id, oi.product_id, oi.variant_id, ri.quantity, COALESCE(ri.reason, ''),
+		       ri.item_condition, ri.refund_amount
+		FROM return_items ri
+		JOIN order_items oi ON oi.id = ri.order_item_id
+		WHERE ri.return_id = ?
+		ORDER BY ri.id`,
+		ret.ID,
+	)
+	if err != nil {
+		return ret, err
+	}
+	defer rows.Close()
+
+	ret.Items = []models.ReturnItem{}
+	for rows.Next() {
+		var item models.ReturnItem
+		if err := rows.Scan(
+			&item.ID,
+			&item.OrderItemID,
+			&item.ProductID,
+			&item.VariantID,
+			&item.Quantity,
+			&item.Reason,
+			&item.Condition,
+			&item.RefundAmount,
+		); err != nil {
+			return ret, err
+		}
+		ret.Items = append(ret.Items, item)
+	}
+	return ret, rows.Err()
+}
+
+func respondWithReturn(c *gin.Context, status int, id interface{}) {
+	ret, err := loadReturn(config.DB, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(status, ret)
+}
+
+// Ask to send back items of a delivered order
+func CreateReturn(c *gin.Context) {
+	orderID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order ID"})
+		return
+	}
+
+	var req models.CreateReturnRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	//The order lock keeps two requests from returning the same units
+	owner, status, err := lockOrder(tx, orderID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && owner != userID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if status != models.OrderDelivered {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("order is %s; only delivered orders can be returned", status)})
+		return
+	}
+
+	requested := map[uint]int{}
+	for _, item := range req.Items {
+		requested[item.OrderItemID] += item.Quantity
+	}
+	for orderItemID, quantity := range requested {
+		var ordered int
+		err := tx.QueryRow(
+			"SELECT quantity FROM order_items WHERE id = ? AND order_id = ?",
+			orderItemID, orderID,
+		).Scan(&ordered)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("order item %d is not part of this order", orderItemID)})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		returned, err := returnedQuantity(tx, orderItemID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if returned+quantity > ordered {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("only %d of order item %d can still be returned", ordered-returned, orderItemID),
+			})
+			return
+		}
+	}
+
+	result, err := tx.Exec(
+		"INSERT INTO returns (order_id, user_id, status, reason) VALUES (?, ?, ?, ?)",
+		orderID, userID, models.ReturnRequested, req.Reason,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	returnID, err := result.LastInsertId()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	for _, item := range req.Items {
+		_, err := tx.Exec(
+			"INSERT INTO return_items (return_id, order_item_id, quantity, reason) VALUES (?, ?, ?, ?)",
+			returnID, item.OrderItemID, item.Quantity, nullableString(item.Reason),
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	respondWithReturn(c, http.StatusCreated, returnID)
+}
+
+func GetOrderReturns(c *gin.Context) {
+	orderID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order ID"})
+		return
+	}
+
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	var owner uint
+	err = config.DB.QueryRow("SELECT user_id FROM orders WHERE id = ?", orderID).Scan(&owner)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && owner != userID && !isAdmin(c)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	rows, err := config.DB.Query("SELECT id FROM returns WHERE order_id = ? ORDER BY id", orderID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	var ids []uint
+	for rows.Next() {
+		var id uint
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	returns := []models.Return{}
+	for _, id := range ids {
+		ret, err := loadReturn(config.DB, id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		returns = append(returns, ret)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": returns})
+}
+
+// Admin list of returns, newest first, optionally by status
+func GetReturns(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 10
+	}
+	offset := (page - 1) * limit
+
+	where := ""
+	var args []interface{}
+	if status := c.Query("status"); status != "" {
+		where = "WHERE status = ?"
+		args = append(args, status)
+	}
+
+	var total int
+	if err := config.DB.QueryRow("SELECT COUNT(*) FROM returns "+where, args...).Scan(&total); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	rows, err := config.DB.Query(
+		"SELECT id FROM returns "+where+" ORDER BY created_at DESC, id DESC LIMIT ? OFFSET ?",
+		append(args, limit, offset)...,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	var ids []uint
+	for rows.Next() {
+		var id uint
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	returns := []models.Return{}
+	for _, id := range ids {
+		ret, err := loadReturn(config.DB, id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		returns = append(returns, ret)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": returns,
+		"pagination": gin.H{
+			"total":       total,
+			"page":        page,
+			"limit":       limit,
+			"total_pages": (total + limit - 1) / limit,
+		},
+	})
+}
+
+func GetReturn(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	ret, err := loadReturn(config.DB, c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && ret.UserID != userID && !isAdmin(c)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "return not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, ret)
+}
+
+// Approve or reject a requested return
+func DecideReturn(c *gin.Context) {
+	var req models.ReturnDecisionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := config.DB.Exec(
+		"UPDATE returns SET status = ?, admin_note = ? WHERE id = ? AND status = ?",
+		req.Status, nullableString(req.Note), c.Param("id"), models.ReturnRequested,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if affected == 0 {
+		var status string
+		err := config.DB.QueryRow("SELECT status FROM returns WHERE id = ?", c.Param("id")).Scan(&status)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "return not found"})
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("return is already %s", status)})
+		}
+		return
+	}
+
+	respondWithReturn(c, http.StatusOK, c.Param("id"))
+}
+
+// Book in the goods of an approved return. Resellable items go back into
+// stock and damaged ones do not. The refund is each line's price after
+// discounts, plus any tax added on top, for the units returned. The return
+// that brings back the last units of an order also refunds its shipping. The
+// refund is paid back through the order's payments where there are any.
+func ReceiveReturn(c *gin.Context) {
+	returnID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid return ID"})
+		return
+	}
+
+	var req models.ReceiveReturnRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	var orderID int64
+	var status string
+	err = tx.QueryRow("SELECT order_id, status FROM returns WHERE id = ? FOR UPDATE", returnID).Scan(&orderID, &status)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "return not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if status != models.ReturnApproved {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("return is %s; only approved returns can be received", status)})
+		return
+	}
+
+	//Returns of the same order are received one at a time, so only one of
+	//them can be the last and refund the shipping
+	if _, _, err := lockOrder(tx, orderID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	ret, err := loadReturn(tx, returnID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	inReturn := map[uint]bool{}
+	for _, item := range ret.Items {
+		inReturn[item.ID] = true
+	}
+	conditions := map[uint]string{}
+	for _, item := range req.Items {
+		if !inReturn[item.ReturnItemID] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("return item %d is not part of this return", item.ReturnItemID)})
+			return
+		}
+		conditions[item.ReturnItemID] = item.Condition
+	}
+
+	var refundAmount float64
+	reference := fmt.Sprintf("return:%d", returnID)
+	for _, item := range ret.Items {
+		condition := conditions[item.ID]
+		if condition == "" {
+			condition = models.ReturnResellable
+		}
+
+		var ordered int
+		var totalPrice, discount, addedTax float64
+		err := tx.QueryRow(
+			"SELECT quantity, total_price, discount_amount, IF(tax_inclusive, 0, tax_amount) FROM order_items WHERE id = ?",
+			item.OrderItemID,
+		).Scan(&ordered, &totalPrice, &discount, &addedTax)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		itemRefund := roundMoney((totalPrice - discount + addedTax) * float64(item.Quantity) / float64(ordered))
+		refundAmount = roundMoney(refundAmount + itemRefund)
+
+		_, err = tx.Exec(
+			"UPDATE return_items SET item_condition = ?, refund_amount = ? WHERE id = ?",
+			condition, itemRefund, item.ID,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if condition == models.ReturnDamaged {
+			continue
+		}
+		if item.VariantID != nil {
+			_, err = tx.Exec("UPDATE product_variants SET quantity = quantity + ? WHERE id = ?", item.Quantity, *item.VariantID)
+			if err == nil {
+				err = bumpProductVersion(tx, item.ProductID)
+			}
+		} else {
+			_, err = tx.Exec(
+				"UPDATE products SET quantity = quantity + ?, version = version + 1 WHERE id = ?",
+				item.Quantity, item.ProductID,
+			)
+		}
+		if err == nil {
+			err = recordMovement(tx, models.InventoryMovement{
+				ProductID:      item.ProductID,
+				VariantID:      item.VariantID,
+				QuantityChange: item.Quantity,
+				Reason:         models.MovementReturn,
+				Reference:      reference,
+				UserID:         &userID,
+			})
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	//Once every unit of the order has come back, with this return or earlier
+	//ones, nothing was delivered and the shipping is refunded too
+	var ordered, returned int
+	var shippingAmount float64
+	err = tx.QueryRow(
+		"SELECT COALESCE(SUM(quantity), 0) FROM order_items WHERE order_id = ?", orderID,
+	).Scan(&ordered)
+	if err == nil {
+		err = tx.QueryRow(`
+			SELECT COALESCE(SUM(ri.quantity), 0)
+			FROM return_items ri
+			JOIN returns r ON r.id = ri.return_id
+			WHERE r.order_id = ? AND (r.status IN (?, ?) OR r.id = ?)`,
+			orderID, models.ReturnReceived, models.ReturnRefunded, returnID,
+		).Scan(&returned)
+	}
+	if err == nil {
+		err = tx.QueryRow("SELECT shipping_amount FROM orders WHERE id = ?", orderID).Scan(&shippingAmount)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if returned >= ordered {
+		refundAmount = roundMoney(refundAmount + shippingAmount)
+	}
+
+	//Pay the refund back from the order's settled payments, oldest first
+	rows, err := tx.Query(
+		"SELECT id, amount - refunded_amount FROM payments WHERE order_id = ? AND status = ? ORDER BY id",
+		orderID, models.PaymentSucceeded,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	type refundable struct {
+		paymentID uint
+		amount    float64
+	}
+	var payments []refundable
+	for rows.Next() {
+		var p refundable
+		if err := rows.Scan(&p.paymentID, &p.amount); err != nil {
+			rows.Close()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		payments = append(payments, p)
+	}
+	rows.Close()
+
+	//Only recorded here; they go to the provider once the return is committed
+	var refunded float64
+	var refundIDs []uint
+	for _, p := range payments {
+		amount := roundMoney(refundAmount - refunded)
+		if amount <= 0 {
+			break
+		}
+		if amount > p.amount {
+			amount = p.amount
+		}
+		refund, err := refundPayment(tx, p.paymentID, &amount, reference, &userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		refunded = roundMoney(refunded + refund.Amount)
+		refundIDs = append(refundIDs, refund.ID)
+	}
+
+	status = models.ReturnReceived
+	if refunded > 0 {
+		status = models.ReturnRefunded
+	}
+	_, err = tx.Exec(
+		"UPDATE returns SET status = ?, refund_amount = ?, refunded_amount = ? WHERE id = ?",
+		status, refundAmount, refunded, returnID,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	sendRefunds(refundIDs)
+
+	respondWithReturn(c, http.StatusOK, returnID)
+}
@@ -0,0 +1,563 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/umesh/ginapi/config"
+	"github.com/umesh/ginapi/models"
+)
+
+const maxReviewPhotos = 5
+
+var reviewPhotoExtensions = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".webp": true}
+
+var reviewSortOrders = map[string]string{
+	"recent":  "r.created_at DESC, r.id DESC",
+	"helpful": "r.helpful_count DESC, r.created_at DESC, r.id DESC",
+	"rating":  "r.rating DESC, r.created_at DESC, r.id DESC",
+}
+
+// Accepted as JSON or, to attach photos, as multipart/form-data
+type createReviewRequest struct {
+	Rating int    `form:"rating" json:"rating" binding:"required,min=1,max=5"`
+	Title  string `form:"title" json:"title" binding:"required,max=255"`
+	Body   string `form:"body" json:"body"`
+}
+
+// Recalculate the rating aggregates of a product from its approved reviews
+func refreshProductRating(tx *sql.Tx, productID uint) error {
+	_, err := tx.Exec(`
+		UPDATE products
+		SET rating_average = (
+		        SELECT COALESCE(AVG(rating), 0) FROM product_reviews WHERE product_id = ? AND status = ?
+		    ),
+		    rating_count = (
+		        SELECT COUNT(*) FROM product_reviews WHERE product_id = ? AND status = ?
+		    ),
+		    version = version + 1
+		WHERE id = ?`,
+		productID, models.ReviewApproved, productID, models.ReviewApproved, productID,
+	)
+	return err
+}
+
+// Attach photos to a page of reviews with a single query
+func loadReviewPhotos(reviews []models.Review) error {
+	if len(reviews) == 0 {
+		return nil
+	}
+
+	index := make(map[uint]int, len(reviews))
+	args := make([]interface{}, len(reviews))
+	for i, review := range reviews {
+		index[review.ID] = i
+		args[i] = review.ID
+	}
+
+	rows, err := config.DB.Query(`
+		SELECT review_id, filename FROM review_photos
+		WHERE review_id IN (?`+strings.Repeat(", ?", len(reviews)-1)+`)
+		ORDER BY review_id, position`,
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var reviewID uint
+		var filename string
+		if err := rows.Scan(&reviewID, &filename); err != nil {
+			return err
+		}
+		i := index[reviewID]
+		reviews[i].Photos = append(reviews[i].Photos, getFullImageURL(filename))
+	}
+	return rows.Err()
+}
+
+func GetProductReviews(c *gin.Context) {
+	productID, ok := parseProductID(c)
+	if !ok {
+		return
+	}
+
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if err != nil || limit < 1 {
+		limit = 10
+	}
+
+	orderBy, ok := reviewSortOrders[c.DefaultQuery("sort", "recent")]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sort must be recent, helpful or rating"})
+		return
+	}
+
+	//Reviews waiting for moderation or rejected are only visible to admins
+	conditions := []string{"r.product_id = ?"}
+	args := []interface{}{productID}
+	status := c.DefaultQuery("status", models.ReviewApproved)
+	if status != models.ReviewApproved && !isAdmin(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only admins can list unmoderated reviews"})
+		return
+	}
+	switch status {
+	case "all":
+	case models.ReviewPending, models.ReviewApproved, models.ReviewRejected:
+		conditions, args = append(conditions, "r.status = ?"), append(args, status)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be pending, approved, rejected or all"})
+		return
+	}
+	if value := c.Query("rating"); value != "" {
+		rating, err := strconv.Atoi(value)
+		if err != nil || rating < 1 || rating > 5 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "rating must be between 1 and 5"})
+			return
+		}
+		conditions, args = append(conditions, "r.rating = ?"), append(args, rating)
+	}
+	where := "WHERE " + strings.Join(conditions, " AND ")
+
+	var total int
+	err = config.DB.QueryRow("SELECT COUNT(*) FROM product_reviews r "+where, args...).Scan(&total)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	rows, err := config.DB.Query(`
+		SELECT r.id, r.product_id, r.user_id, u.name, r.rating, r.title, COALESCE(r.body, ''),
+		       r.status, COALESCE(r.moderation_note, ''), r.moderated_at, r.helpful_count, r.created_at, r.updated_at
+		FROM product_reviews r
+		JOIN users u ON u.id = r.user_id
+		`+where+`
+		ORDER BY `+orderBy+`
+		LIMIT ? OFFSET ?`,
+		append(args, limit, (page-1)*limit)...,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	reviews := []models.Review{}
+	for rows.Next() {
+		review := models.Review{Photos: []string{}}
+		if err := rows.Scan(
+			&review.ID,
+			&review.ProductID,
+			&review.UserID,
+			&review.UserName,
+			&review.Rating,
+			&review.Title,
+			&review.Body,
+			&review.Status,
+			&review.ModerationNote,
+			&review.ModeratedAt,
+			&review.HelpfulCount,
+			&review.CreatedAt,
+			&review.UpdatedAt,
+		); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		reviews = append(reviews, review)
+	}
+
+	if err = rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := loadReviewPhotos(reviews); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": reviews,
+		"pagination": gin.H{
+			"total":       total,
+			"page":        page,
+			"limit":       limit,
+			"total_pages": int(math.Ceil(float64(total) / float64(limit))),
+		},
+	})
+}
+
+// Review a product the user has received. New reviews wait for moderation.
+func CreateProductReview(c *gin.Context) {
+	productID, ok := parseProductID(c)
+	if !ok {
+		return
+	}
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	var req createReviewRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var files []*multipart.FileHeader
+	if form, err := c.MultipartForm(); err == nil {
+		files = form.File["photos"]
+	}
+	if len(files) > maxReviewPhotos {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("a review can have at most %d photos", maxReviewPhotos)})
+		return
+	}
+	for _, file := range files {
+		if !reviewPhotoExtensions[strings.ToLower(filepath.Ext(file.Filename))] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "photos must be jpg, jpeg, png or webp images"})
+			return
+		}
+	}
+
+	var delivered bool
+	err := config.DB.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM order_items oi
+			JOIN orders o ON o.id = oi.order_id
+			WHERE o.user_id = ? AND oi.product_id = ? AND o.status = 'delivered'
+		)`,
+		userID, productID,
+	).Scan(&delivered)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !delivered {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only customers who received this product can review it"})
+		return
+	}
+
+	var count int
+	err = config.DB.QueryRow(
+		"SELECT COUNT(*) FROM product_reviews WHERE product_id = ? AND user_id = ?",
+		productID, userID,
+	).Scan(&count)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "you have already reviewed this product"})
+		return
+	}
+
+	var photos []string
+	defer func() {
+		//Files of a review that was not created are not referenced by anything
+		if c.Writer.Status() != http.StatusCreated {
+			for _, filename := range photos {
+				os.Remove(filepath.Join("uploads", filename))
+			}
+		}
+	}()
+	for i, file := range files {
+		filename := fmt.Sprintf("review_%d_%d_%d_%s", productID, userID, i, filepath.Base(file.Filename))
+		if err := c.SaveUploadedFile(file, filepath.Join("uploads", filename)); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		photos = append(photos, filename)
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		INSERT INTO product_reviews (product_id, user_id, rating, title, body)
+		VALUES (?, ?, ?, ?, ?)`,
+		productID, userID, req.Rating, req.Title, nullableString(req.Body),
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	review := models.Review{
+		ID:        uint(id),
+		ProductID: productID,
+		UserID:    userID,
+		Rating:    req.Rating,
+		Title:     req.Title,
+		Body:      req.Body,
+		Photos:    []string{},
+		Status:    models.ReviewPending,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	for i, filename := range photos {
+		_, err := tx.Exec(
+			"INSERT INTO review_photos (review_id, filename, position) VALUES (?, ?, ?)",
+			id, filename, i,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		review.Photos = append(review.Photos, getFullImageURL(filename))
+	}
+
+	if err := tx.QueryRow("SELECT name FROM users WHERE id = ?", userID).Scan(&review.UserName); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, review)
+}
+
+// Approve, reject or reopen a review and update the product rating to match
+func ModerateReview(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	var req models.ModerateReviewRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	var productID uint
+	var status string
+	err = tx.QueryRow(
+		"SELECT product_id, status FROM product_reviews WHERE id = ? FOR UPDATE",
+		c.Param("id"),
+	).Scan(&productID, &status)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "review not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE product_reviews
+		SET status = ?, moderation_note = ?, moderated_by = ?, moderated_at = CURRENT_TIMESTAMP
+		WHERE id = ?`,
+		req.Status, nullableString(req.Note), userID, c.Param("id"),
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if status == models.ReviewApproved || req.Status == models.ReviewApproved {
+		if err := refreshProductRating(tx, productID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Review " + req.Status})
+}
+
+// Authors can delete their own reviews, admins can delete any
+func DeleteReview(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	var productID, authorID uint
+	var status string
+	err = tx.QueryRow(
+		"SELECT product_id, user_id, status FROM product_reviews WHERE id = ? FOR UPDATE",
+		c.Param("id"),
+	).Scan(&productID, &authorID, &status)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "review not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	if authorID != userID && !isAdmin(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "you can only delete your own reviews"})
+		return
+	}
+
+	rows, err := tx.Query("SELECT filename FROM review_photos WHERE review_id = ?", c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	var photos []string
+	for rows.Next() {
+		var filename string
+		if err := rows.Scan(&filename); err != nil {
+			rows.Close()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		photos = append(photos, filename)
+	}
+	rows.Close()
+
+	if _, err := tx.Exec("DELETE FROM product_reviews WHERE id = ?", c.Param("id")); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if status == models.ReviewApproved {
+		if err := refreshProductRating(tx, productID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	for _, filename := range photos {
+		os.Remove(filepath.Join("uploads", filename))
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Review deleted successfully"})
+}
+
+// Mark an approved review as helpful. Voting twice has no further effect.
+func VoteReviewHelpful(c *gin.Context) {
+	setReviewVote(c, true)
+}
+
+func RemoveReviewVote(c *gin.Context) {
+	setReviewVote(c, false)
+}
+
+func setReviewVote(c *gin.Context, helpful bool) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	var reviewID, authorID uint
+	var status string
+	err = tx.QueryRow(
+		"SELECT id, user_id, status FROM product_reviews WHERE id = ? FOR UPDATE",
+		c.Param("id"),
+	).Scan(&reviewID, &authorID, &status)
+	if err != nil || status != models.ReviewApproved {
+		if err == nil || errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "review not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	if authorID == userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "you cannot vote on your own review"})
+		return
+	}
+
+	var result sql.Result
+	if helpful {
+		result, err = tx.Exec("INSERT IGNORE INTO review_votes (review_id, user_id) VALUES (?, ?)", reviewID, userID)
+	} else {
+		result, err = tx.Exec("DELETE FROM review_votes WHERE review_id = ? AND user_id = ?", reviewID, userID)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if affected > 0 {
+		change := 1
+		if !helpful {
+			change = -1
+		}
+		_, err = tx.Exec("UPDATE product_reviews SET helpful_count = helpful_count + ? WHERE id = ?", change, reviewID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	var helpfulCount int
+	if err := tx.QueryRow("SELECT helpful_count FROM product_reviews WHERE id = ?", reviewID).Scan(&helpfulCount); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"helpful_count": helpfulCount})
+}
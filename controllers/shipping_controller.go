@@ -0,0 +1,687 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-sql-driver/mysql"
+	"github.com/umesh/ginapi/config"
+	"github.com/umesh/ginapi/models"
+)
+
+// Cubic centimetres per kg of volumetric weight, the usual courier divisor
+const volumetricDivisor = 5000
+
+// What shipping is charged on: the chargeable weight in kg and the value of
+// the items at their list prices
+type shippingParcel struct {
+	weight float64
+	value  float64
+}
+
+// Weight one unit of a product is charged at, the larger of its actual and
+// volumetric weight. Products without a weight or dimensions add nothing.
+func chargeableWeight(product models.Product) float64 {
+	var weight float64
+	if product.Weight != nil {
+		weight = *product.Weight
+	}
+	if product.Length != nil && product.Width != nil && product.Height != nil {
+		weight = math.Max(weight, *product.Length**product.Width**product.Height/volumetricDivisor)
+	}
+	return weight
+}
+
+// Build the parcel for a list of items at their current prices
+func shippingParcelFor(q queryer, items []models.OrderItemRequest) (shippingParcel, error) {
+	var parcel shippingParcel
+	for _, item := range items {
+		var product models.Product
+		err := q.QueryRow(`
+			SELECT price, weight, length, width, height
+			FROM products
+			WHERE id = ? AND deleted_at IS NULL`,
+			item.ProductID,
+		).Scan(&product.Price, &product.Weight, &product.Length, &product.Width, &product.Height)
+		if errors.Is(err, sql.ErrNoRows) {
+			return parcel, orderError{"product not found"}
+		}
+		if err != nil {
+			return parcel, err
+		}
+
+		if item.VariantID != nil {
+			var variantPrice sql.NullFloat64
+			err := q.QueryRow(
+				"SELECT price FROM product_variants WHERE id = ? AND product_id = ? AND deleted_at IS NULL",
+				*item.VariantID, item.ProductID,
+			).Scan(&variantPrice)
+			if errors.Is(err, sql.ErrNoRows) {
+				return parcel, orderError{"variant not found"}
+			}
+			if err != nil {
+				return parcel, err
+			}
+			if variantPrice.Valid {
+				product.Price = variantPrice.Float64
+			}
+		}
+
+		parcel.weight += chargeableWeight(product) * float64(item.Quantity)
+		parcel.value += product.Price * float64(item.Quantity)
+	}
+	parcel.value = roundMoney(parcel.value)
+	return parcel, nil
+}
+
+// Active shipping methods that can take the parcel to the region, cheapest
+// first. A method with several matching rates is quoted at its cheapest.
+func quoteShipping(q queryer, region string, parcel shippingParcel) ([]models.ShippingQuote, error) {
+	quotes := []models.ShippingQuote{}
+
+	var zoneID uint
+	err := q.QueryRow(`
+		SELECT zone_id FROM shipping_zone_regions
+		WHERE region IN (?, ?)
+		ORDER BY region = ?
+		LIMIT 1`,
+		region, models.ShippingRegionDefault, models.ShippingRegionDefault,
+	).Scan(&zoneID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return quotes, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := q.Query(`
+		SELECT m.id, m.code, m.name, MIN(r.fee + r.fee_per_kg * ?) AS fee
+		FROM shipping_methods m
+		JOIN shipping_rates r ON r.method_id = m.id
+		WHERE m.active = TRUE AND r.zone_id = ?
+		  AND r.min_weight <= ? AND (r.max_weight IS NULL OR ? < r.max_weight)
+		  AND r.min_value <= ? AND (r.max_value IS NULL OR ? < r.max_value)
+		GROUP BY m.id, m.code, m.name
+		ORDER BY fee, m.name`,
+		parcel.weight, zoneID, parcel.weight, parcel.weight, parcel.value, parcel.value,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var quote models.ShippingQuote
+		if err := rows.Scan(&quote.MethodID, &quote.Code, &quote.Name, &quote.Fee); err != nil {
+			return nil, err
+		}
+		quote.Fee = roundMoney(quote.Fee)
+		quotes = append(quotes, quote)
+	}
+	return quotes, rows.Err()
+}
+
+// Quote the shipping methods available for a list of items, or for the
+// caller's cart when no items are given
+func GetShippingQuote(c *gin.Context) {
+	var req models.ShippingQuoteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	items := req.Items
+	if len(items) == 0 {
+		cartID, _, err := findCart(c, false)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if cartID == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "items are required when there is no cart"})
+			return
+		}
+		cart, err := loadCart(cartID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if len(cart.Items) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "cart is empty"})
+			return
+		}
+		for _, item := range cart.Items {
+			items = append(items, models.OrderItemRequest{
+				ProductID: item.ProductID,
+				VariantID: item.VariantID,
+				Quantity:  item.Quantity,
+			})
+		}
+	}
+
+	parcel, err := shippingParcelFor(config.DB, items)
+	if err != nil {
+		respondOrderError(c, err)
+		return
+	}
+
+	region := normalizeRegion(req.Region)
+	quotes, err := quoteShipping(config.DB, region, parcel)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"region":  region,
+		"weight":  math.Round(parcel.weight*1000) / 1000,
+		"value":   parcel.value,
+		"methods": quotes,
+	})
+}
+
+// A problem with a shipping zone or method request, shown as a 400
+type shippingError struct {
+	message string
+}
+
+func (e shippingError) Error() string {
+	return e.message
+}
+
+func respondShippingError(c *gin.Context, err error, duplicate string) {
+	var invalid shippingError
+	if errors.As(err, &invalid) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == errDuplicateEntry {
+		c.JSON(http.StatusConflict, gin.H{"error": duplicate})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
+
+func loadShippingZones(q queryer, id interface{}) ([]models.ShippingZone, error) {
+	query := "SELECT id, name, created_at FROM shipping_zones"
+	var args []interface{}
+	if id != nil {
+		query, args = query+" WHERE id = ?", append(args, id)
+	}
+	rows, err := q.Query(query+" ORDER BY name, id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	zones := []models.ShippingZone{}
+	index := map[uint]int{}
+	for rows.Next() {
+		zone := models.ShippingZone{Regions: []string{}}
+		if err := rows.Scan(&zone.ID, &zone.Name, &zone.CreatedAt); err != nil {
+			return nil, err
+		}
+		index[zone.ID] = len(zones)
+		zones = append(zones, zone)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	regionRows, err := q.Query("SELECT zone_id, region FROM shipping_zone_regions ORDER BY region")
+	if err != nil {
+		return nil, err
+	}
+	defer regionRows.Close()
+
+	for regionRows.Next() {
+		var zoneID uint
+		var region string
+		if err := regionRows.Scan(&zoneID, &region); err != nil {
+			return nil, err
+		}
+		if i, ok := index[zoneID]; ok {
+			zones[i].Regions = append(zones[i].Regions, region)
+		}
+	}
+	return zones, regionRows.Err()
+}
+
+func saveShippingZoneRegions(tx *sql.Tx, zoneID uint, regions []string) error {
+	if _, err := tx.Exec("DELETE FROM shipping_zone_regions WHERE zone_id = ?", zoneID); err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, region := range regions {
+		region = normalizeRegion(region)
+		if seen[region] {
+			continue
+		}
+		seen[region] = true
+		if _, err := tx.Exec("INSERT INTO shipping_zone_regions (zone_id, region) VALUES (?, ?)", zoneID, region); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func GetShippingZones(c *gin.Context) {
+	zones, err := loadShippingZones(config.DB, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": zones})
+}
+
+func CreateShippingZone(c *gin.Context) {
+	var req models.ShippingZoneRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO shipping_zones (name) VALUES (?)", req.Name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := saveShippingZoneRegions(tx, uint(id), req.Regions); err != nil {
+		respondShippingError(c, err, "a region is already part of another shipping zone")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	zones, err := loadShippingZones(config.DB, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, zones[0])
+}
+
+// Rename a zone and replace its regions
+func UpdateShippingZone(c *gin.Context) {
+	var req models.ShippingZoneRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	var zoneID uint
+	err = tx.QueryRow("SELECT id FROM shipping_zones WHERE id = ? FOR UPDATE", c.Param("id")).Scan(&zoneID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "shipping zone not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE shipping_zones SET name = ? WHERE id = ?", req.Name, zoneID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := saveShippingZoneRegions(tx, zoneID, req.Regions); err != nil {
+		respondShippingError(c, err, "a region is already part of another shipping zone")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	zones, err := loadShippingZones(config.DB, zoneID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, zones[0])
+}
+
+// Zones still used by a shipping rate cannot be deleted
+func DeleteShippingZone(c *gin.Context) {
+	var count int
+	if err := config.DB.QueryRow("SELECT COUNT(*) FROM shipping_rates WHERE zone_id = ?", c.Param("id")).Scan(&count); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("shipping zone is used by %d shipping rates", count)})
+		return
+	}
+
+	result, err := config.DB.Exec("DELETE FROM shipping_zones WHERE id = ?", c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if affected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "shipping zone not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Shipping zone deleted successfully"})
+}
+
+func loadShippingMethods(q queryer, id interface{}, activeOnly bool) ([]models.ShippingMethod, error) {
+	var conditions []string
+	var args []interface{}
+	if id != nil {
+		conditions, args = append(conditions, "id = ?"), append(args, id)
+	}
+	if activeOnly {
+		conditions = append(conditions, "active = TRUE")
+	}
+	query := "SELECT id, code, name, active, created_at FROM shipping_methods"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	rows, err := q.Query(query+" ORDER BY name, id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	methods := []models.ShippingMethod{}
+	index := map[uint]int{}
+	for rows.Next() {
+		method := models.ShippingMethod{Rates: []models.ShippingRate{}}
+		if err := rows.Scan(&method.ID, &method.Code, &method.Name, &method.Active, &method.CreatedAt); err != nil {
+			return nil, err
+		}
+		index[method.ID] = len(methods)
+		methods = append(methods, method)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	if len(methods) == 0 {
+		return methods, nil
+	}
+
+	rateArgs := make([]interface{}, len(methods))
+	for i, method := range methods {
+		rateArgs[i] = method.ID
+	}
+	rateRows, err := q.Query(`
+		SELECT id, method_id, zone_id, min_weight, max_weight, min_value, max_value, fee, fee_per_kg
+		FROM shipping_rates
+		WHERE method_id IN (?`+strings.Repeat(", ?", len(methods)-1)+`)
+		ORDER BY zone_id, min_weight, min_value, id`,
+		rateArgs...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rateRows.Close()
+
+	for rateRows.Next() {
+		var rate models.ShippingRate
+		var methodID uint
+		if err := rateRows.Scan(
+			&rate.ID,
+			&methodID,
+			&rate.ZoneID,
+			&rate.MinWeight,
+			&rate.MaxWeight,
+			&rate.MinValue,
+			&rate.MaxValue,
+			&rate.Fee,
+			&rate.FeePerKg,
+		); err != nil {
+			return nil, err
+		}
+		method := &methods[index[methodID]]
+		method.Rates = append(method.Rates, rate)
+	}
+	return methods, rateRows.Err()
+}
+
+func validateShippingRates(rates []models.ShippingRate) string {
+	for i, rate := range rates {
+		if rate.MaxWeight != nil && *rate.MaxWeight <= rate.MinWeight {
+			return fmt.Sprintf("rate %d: max_weight must be greater than min_weight", i+1)
+		}
+		if rate.MaxValue != nil && *rate.MaxValue <= rate.MinValue {
+			return fmt.Sprintf("rate %d: max_value must be greater than min_value", i+1)
+		}
+	}
+	return ""
+}
+
+func saveShippingRates(tx *sql.Tx, methodID uint, rates []models.ShippingRate) error {
+	if _, err := tx.Exec("DELETE FROM shipping_rates WHERE method_id = ?", methodID); err != nil {
+		return err
+	}
+	for i, rate := range rates {
+		var count int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM shipping_zones WHERE id = ?", rate.ZoneID).Scan(&count); err != nil {
+			return err
+		}
+		if count == 0 {
+			return shippingError{fmt.Sprintf("rate %d: shipping zone %d not found", i+1, rate.ZoneID)}
+		}
+		_, err := tx.Exec(`
+			INSERT INTO shipping_rates (method_id, zone_id, min_weight, max_weight, min_value, max_value, fee, fee_per_kg)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			methodID, rate.ZoneID, rate.MinWeight, rate.MaxWeight, rate.MinValue, rate.MaxValue, rate.Fee, rate.FeePerKg,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func GetShippingMethods(c *gin.Context) {
+	methods, err := loadShippingMethods(config.DB, nil, c.Query("active") == "true")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": methods})
+}
+
+func GetShippingMethod(c *gin.Context) {
+	methods, err := loadShippingMethods(config.DB, c.Param("id"), false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(methods) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "shipping method not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, methods[0])
+}
+
+func CreateShippingMethod(c *gin.Context) {
+	var req models.ShippingMethodRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if message := validateShippingRates(req.Rates); message != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": message})
+		return
+	}
+
+	active := true
+	if req.Active != nil {
+		active = *req.Active
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"INSERT INTO shipping_methods (code, name, active) VALUES (?, ?, ?)",
+		strings.TrimSpace(req.Code), req.Name, active,
+	)
+	if err != nil {
+		respondShippingError(c, err, "a shipping method with this code already exists")
+		return
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := saveShippingRates(tx, uint(id), req.Rates); err != nil {
+		respondShippingError(c, err, "")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	methods, err := loadShippingMethods(config.DB, id, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, methods[0])
+}
+
+// Replace a shipping method and its rates. Orders keep the fee they were charged.
+func UpdateShippingMethod(c *gin.Context) {
+	var req models.ShippingMethodRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if message := validateShippingRates(req.Rates); message != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": message})
+		return
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	var methodID uint
+	var active bool
+	err = tx.QueryRow("SELECT id, active FROM shipping_methods WHERE id = ? FOR UPDATE", c.Param("id")).Scan(&methodID, &active)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "shipping method not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	if req.Active != nil {
+		active = *req.Active
+	}
+
+	_, err = tx.Exec(
+		"UPDATE shipping_methods SET code = ?, name = ?, active = ? WHERE id = ?",
+		strings.TrimSpace(req.Code), req.Name, active, methodID,
+	)
+	if err != nil {
+		respondShippingError(c, err, "a shipping method with this code already exists")
+		return
+	}
+
+	if err := saveShippingRates(tx, methodID, req.Rates); err != nil {
+		respondShippingError(c, err, "")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	methods, err := loadShippingMethods(config.DB, methodID, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, methods[0])
+}
+
+// Shipping methods stay referenced by the orders that used them, so deleting
+// one only deactivates it
+func DeleteShippingMethod(c *gin.Context) {
+	result, err := config.DB.Exec("UPDATE shipping_methods SET active = FALSE WHERE id = ?", c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if affected == 0 {
+		var count int
+		if err := config.DB.QueryRow("SELECT COUNT(*) FROM shipping_methods WHERE id = ?", c.Param("id")).Scan(&count); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if count == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "shipping method not found"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Shipping method deactivated successfully"})
+}
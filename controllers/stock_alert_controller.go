@@ -0,0 +1,250 @@
+package controllers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/umesh/ginapi/config"
+	"github.com/umesh/ginapi/models"
+	"github.com/umesh/ginapi/utils"
+)
+
+var stockAlertNotifier utils.Notifier = utils.LogNotifier{}
+
+// Order commits and the scheduler can check at the same time, so checks are
+// serialised to keep at most one open alert per product
+var stockCheckMu sync.Mutex
+
+// StartStockAlertChecker sets the notifier for new alerts and checks every
+// product with a reorder point on the given interval
+func StartStockAlertChecker(interval time.Duration, notifier utils.Notifier) {
+	if notifier != nil {
+		stockAlertNotifier = notifier
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := checkLowStock(); err != nil {
+				log.Printf("stock alert check failed: %v", err)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// Raise an alert for every product at or below its reorder point and resolve
+// open alerts for products that have been restocked. With no IDs every
+// tracked product is checked. New alerts are sent to the notifier in the
+// background, so a slow notifier holds up neither the caller nor other checks.
+func checkLowStock(productIDs ...uint) error {
+	raised, err := updateStockAlerts(productIDs)
+	if len(raised) > 0 {
+		go notifyStockAlerts(raised)
+	}
+	return err
+}
+
+// The stock of a product counts its own quantity and that of its variants
+const productTotalStock = `p.quantity + COALESCE((
+	SELECT SUM(v.quantity) FROM product_variants v
+	WHERE v.product_id = p.id AND v.deleted_at IS NULL
+), 0)`
+
+// Open and resolve alerts, returning the ones opened
+func updateStockAlerts(productIDs []uint) ([]models.StockAlert, error) {
+	stockCheckMu.Lock()
+	defer stockCheckMu.Unlock()
+
+	query := `
+		SELECT p.id, p.name, ` + productTotalStock + `, p.reorder_point, COALESCE(p.reorder_quantity, 0), a.id
+		FROM products p
+		LEFT JOIN stock_alerts a ON a.product_id = p.id AND a.status = 'open'
+		WHERE p.reorder_point IS NOT NULL AND p.deleted_at IS NULL`
+	var args []interface{}
+	if len(productIDs) > 0 {
+		query += " AND p.id IN (?" + strings.Repeat(", ?", len(productIDs)-1) + ")"
+		for _, id := range productIDs {
+			args = append(args, id)
+		}
+	}
+
+	rows, err := config.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var raise []models.StockAlert
+	var resolve []int64
+	for rows.Next() {
+		var alert models.StockAlert
+		var openAlertID sql.NullInt64
+		if err := rows.Scan(
+			&alert.ProductID,
+			&alert.ProductName,
+			&alert.Quantity,
+			&alert.ReorderPoint,
+			&alert.ReorderQuantity,
+			&openAlertID,
+		); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		lowStock := alert.Quantity <= alert.ReorderPoint
+		if lowStock && !openAlertID.Valid {
+			raise = append(raise, alert)
+		} else if !lowStock && openAlertID.Valid {
+			resolve = append(resolve, openAlertID.Int64)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, id := range resolve {
+		_, err := config.DB.Exec(
+			"UPDATE stock_alerts SET status = 'resolved', resolved_at = CURRENT_TIMESTAMP WHERE id = ?",
+			id,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var raised []models.StockAlert
+	for _, alert := range raise {
+		result, err := config.DB.Exec(`
+			INSERT INTO stock_alerts (product_id, quantity, reorder_point, reorder_quantity)
+			VALUES (?, ?, ?, ?)`,
+			alert.ProductID, alert.Quantity, alert.ReorderPoint, alert.ReorderQuantity,
+		)
+		if err != nil {
+			return raised, err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return raised, err
+		}
+		alert.ID = uint(id)
+		alert.Status = "open"
+		alert.CreatedAt = time.Now()
+		raised = append(raised, alert)
+	}
+
+	return raised, nil
+}
+
+func notifyStockAlerts(alerts []models.StockAlert) {
+	for _, alert := range alerts {
+		subject := fmt.Sprintf("Low stock: %s (%d left, reorder point %d)", alert.ProductName, alert.Quantity, alert.ReorderPoint)
+		if err := stockAlertNotifier.Notify(subject, alert); err != nil {
+			log.Printf("stock alert %d: notification failed: %v", alert.ID, err)
+		}
+	}
+}
+
+func GetStockAlerts(c *gin.Context) {
+	status := c.DefaultQuery("status", "open")
+	if status != "open" && status != "resolved" && status != "all" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be open, resolved or all"})
+		return
+	}
+
+	query := `
+		SELECT a.id, a.product_id, p.name, a.quantity, a.reorder_point, a.reorder_quantity,
+		       a.status, a.created_at, a.resolved_at
+		FROM stock_alerts a
+		JOIN products p ON p.id = a.product_id`
+	var args []interface{}
+	if status != "all" {
+		query += " WHERE a.status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY a.created_at DESC"
+
+	rows, err := config.DB.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	alerts := []models.StockAlert{}
+	for rows.Next() {
+		var alert models.StockAlert
+		if err := rows.Scan(
+			&alert.ID,
+			&alert.ProductID,
+			&alert.ProductName,
+			&alert.Quantity,
+			&alert.ReorderPoint,
+			&alert.ReorderQuantity,
+			&alert.Status,
+			&alert.CreatedAt,
+			&alert.ResolvedAt,
+		); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		alerts = append(alerts, alert)
+	}
+
+	if err = rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": alerts})
+}
+
+// Set or clear the reorder point and reorder quantity of a product
+func UpdateReorderSettings(c *gin.Context) {
+	productID, ok := parseProductID(c)
+	if !ok {
+		return
+	}
+
+	var req models.ReorderSettingsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, err := config.DB.Exec(
+		"UPDATE products SET reorder_point = ?, reorder_quantity = ?, version = version + 1 WHERE id = ?",
+		req.ReorderPoint, req.ReorderQuantity, productID,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Without a reorder point the product is no longer tracked, so close its alert
+	if req.ReorderPoint == nil {
+		_, err = config.DB.Exec(
+			"UPDATE stock_alerts SET status = 'resolved', resolved_at = CURRENT_TIMESTAMP WHERE product_id = ? AND status = 'open'",
+			productID,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	} else {
+		go func() {
+			if err := checkLowStock(productID); err != nil {
+				log.Printf("stock alert check for product %d failed: %v", productID, err)
+			}
+		}()
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Reorder settings updated successfully"})
+}
@@ -0,0 +1,210 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-sql-driver/mysql"
+	"github.com/umesh/ginapi/config"
+	"github.com/umesh/ginapi/models"
+)
+
+const taxRateColumns = "id, region, tax_class, name, rate, inclusive, created_at"
+
+func scanTaxRate(row interface{ Scan(...interface{}) error }, rate *models.TaxRate) error {
+	return row.Scan(&rate.ID, &rate.Region, &rate.TaxClass, &rate.Name, &rate.Rate, &rate.Inclusive, &rate.CreatedAt)
+}
+
+// Regions are matched without regard to case or surrounding spaces
+func normalizeRegion(region string) string {
+	return strings.ToUpper(strings.TrimSpace(region))
+}
+
+// Rate for a tax class in a region, falling back to the default region. A
+// class with no rate anywhere is not taxed.
+func findTaxRate(q queryer, region, taxClass string) (models.TaxRate, error) {
+	var rate models.TaxRate
+	err := q.QueryRow(`
+		SELECT rate, inclusive FROM tax_rates
+		WHERE tax_class = ? AND region IN (?, ?)
+		ORDER BY region = ?
+		LIMIT 1`,
+		taxClass, region, models.TaxRegionDefault, models.TaxRegionDefault,
+	).Scan(&rate.Rate, &rate.Inclusive)
+	if errors.Is(err, sql.ErrNoRows) {
+		return rate, nil
+	}
+	return rate, err
+}
+
+// Work out the tax of every order item, on the line total after its discount.
+// Returns the tax added on top of the prices and the tax in total, which also
+// counts the tax already included in them.
+func applyTax(q queryer, region string, items []models.OrderItem, taxClasses map[uint]string) (added, total float64, err error) {
+	rates := map[string]models.TaxRate{}
+	for i := range items {
+		item := &items[i]
+		taxClass := taxClasses[item.ProductID]
+		if taxClass == "" {
+			taxClass = models.DefaultTaxClass
+		}
+		rate, ok := rates[taxClass]
+		if !ok {
+			if rate, err = findTaxRate(q, region, taxClass); err != nil {
+				return 0, 0, err
+			}
+			rates[taxClass] = rate
+		}
+
+		item.TaxClass = taxClass
+		item.TaxRate = rate.Rate
+		item.TaxInclusive = rate.Inclusive
+		net := item.TotalPrice - item.DiscountAmount
+		if rate.Inclusive {
+			item.TaxAmount = roundMoney(net - net/(1+rate.Rate/100))
+		} else {
+			item.TaxAmount = roundMoney(net * rate.Rate / 100)
+			added = roundMoney(added + item.TaxAmount)
+		}
+		total = roundMoney(total + item.TaxAmount)
+	}
+	return added, total, nil
+}
+
+func respondTaxRateError(c *gin.Context, err error) {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == errDuplicateEntry {
+		c.JSON(http.StatusConflict, gin.H{"error": "a tax rate for this region and tax class already exists"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
+
+// List tax rates, optionally for one region or tax class
+func GetTaxRates(c *gin.Context) {
+	var conditions []string
+	var args []interface{}
+	if region := c.Query("region"); region != "" {
+		conditions, args = append(conditions, "region = ?"), append(args, normalizeRegion(region))
+	}
+	if taxClass := c.Query("tax_class"); taxClass != "" {
+		conditions, args = append(conditions, "tax_class = ?"), append(args, taxClass)
+	}
+	query := "SELECT " + taxRateColumns + " FROM tax_rates"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY region, tax_class"
+
+	rows, err := config.DB.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	rates := []models.TaxRate{}
+	for rows.Next() {
+		var rate models.TaxRate
+		if err := scanTaxRate(rows, &rate); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		rates = append(rates, rate)
+	}
+
+	if err = rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": rates})
+}
+
+func CreateTaxRate(c *gin.Context) {
+	var req models.TaxRateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := config.DB.Exec(
+		"INSERT INTO tax_rates (region, tax_class, name, rate, inclusive) VALUES (?, ?, ?, ?, ?)",
+		normalizeRegion(req.Region), strings.TrimSpace(req.TaxClass), req.Name, req.Rate, req.Inclusive,
+	)
+	if err != nil {
+		respondTaxRateError(c, err)
+		return
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var rate models.TaxRate
+	if err := scanTaxRate(config.DB.QueryRow("SELECT "+taxRateColumns+" FROM tax_rates WHERE id = ?", id), &rate); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, rate)
+}
+
+// Replace a tax rate. Orders keep the rate they were placed with.
+func UpdateTaxRate(c *gin.Context) {
+	var req models.TaxRateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var rate models.TaxRate
+	err := scanTaxRate(config.DB.QueryRow("SELECT "+taxRateColumns+" FROM tax_rates WHERE id = ?", c.Param("id")), &rate)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "tax rate not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	rate.Region = normalizeRegion(req.Region)
+	rate.TaxClass = strings.TrimSpace(req.TaxClass)
+	rate.Name = req.Name
+	rate.Rate = req.Rate
+	rate.Inclusive = req.Inclusive
+	_, err = config.DB.Exec(
+		"UPDATE tax_rates SET region = ?, tax_class = ?, name = ?, rate = ?, inclusive = ? WHERE id = ?",
+		rate.Region, rate.TaxClass, rate.Name, rate.Rate, rate.Inclusive, rate.ID,
+	)
+	if err != nil {
+		respondTaxRateError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, rate)
+}
+
+func DeleteTaxRate(c *gin.Context) {
+	result, err := config.DB.Exec("DELETE FROM tax_rates WHERE id = ?", c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if affected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "tax rate not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Tax rate deleted successfully"})
+}
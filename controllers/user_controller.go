@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/mail"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/umesh/ginapi/config"
@@ -13,7 +15,7 @@ import (
 
 func GetUsers(c *gin.Context) {
 	rows, err := config.DB.Query(`
-        SELECT id, name, email, created_at, updated_at 
+        SELECT id, name, email, role, created_at, updated_at 
         FROM users
     `)
 	if err != nil {
@@ -29,6 +31,7 @@ func GetUsers(c *gin.Context) {
 			&user.ID,
 			&user.Name,
 			&user.Email,
+			&user.Role,
 			&user.CreatedAt,
 			&user.UpdatedAt,
 		)
@@ -56,13 +59,14 @@ func GetUsersByID(c *gin.Context) {
 
 	var user models.User
 	err := config.DB.QueryRow(`
-        SELECT id, name, email, created_at, updated_at 
+        SELECT id, name, email, role, created_at, updated_at 
         FROM users 
         WHERE id = ?`, id,
 	).Scan(
 		&user.ID,
 		&user.Name,
 		&user.Email,
+		&user.Role,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -131,13 +135,14 @@ func CreateUser(c *gin.Context) {
 
 	newUser := models.User{}
 	err = config.DB.QueryRow(`
-        SELECT id, name, email, created_at, updated_at 
+        SELECT id, name, email, role, created_at, updated_at 
         FROM users 
         WHERE id = ?`, id,
 	).Scan(
 		&newUser.ID,
 		&newUser.Name,
 		&newUser.Email,
+		&newUser.Role,
 		&newUser.CreatedAt,
 		&newUser.UpdatedAt,
 	)
@@ -168,16 +173,10 @@ func UpdateUser(c *gin.Context) {
 		return
 	}
 
-	var user models.User
-	if err := c.ShouldBindJSON(&user); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
-	var currentUser models.User
+	var current models.UserPatch
 	err := config.DB.QueryRow(`
-        SELECT email FROM users WHERE id = ?`, id,
-	).Scan(&currentUser.Email)
+        SELECT name, email FROM users WHERE id = ?`, id,
+	).Scan(&current.Name, &current.Email)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
@@ -187,7 +186,27 @@ func UpdateUser(c *gin.Context) {
 		return
 	}
 
-	if user.Email != currentUser.Email {
+	var user models.UserPatch
+	if !applyRequestPatch(c, current, &user, "name", "email") {
+		return
+	}
+
+	fieldErrors := map[string]string{}
+	if strings.TrimSpace(user.Name) == "" {
+		fieldErrors["name"] = "must not be empty"
+	}
+	if _, err := mail.ParseAddress(user.Email); err != nil {
+		fieldErrors["email"] = "must be a valid email address"
+	}
+	if user.Password != "" && len(user.Password) < 8 {
+		fieldErrors["password"] = "must be at least 8 characters"
+	}
+	if len(fieldErrors) > 0 {
+		respondWithFieldErrors(c, fieldErrors)
+		return
+	}
+
+	if user.Email != current.Email {
 		var count int
 		err := config.DB.QueryRow(`
             SELECT COUNT(*) FROM users 
@@ -204,39 +223,37 @@ func UpdateUser(c *gin.Context) {
 		}
 	}
 
-	var hashedPassword string
+	//Only write the columns that actually changed
+	var sets []string
+	var args []interface{}
+	if user.Name != current.Name {
+		sets, args = append(sets, "name = ?"), append(args, user.Name)
+	}
+	if user.Email != current.Email {
+		sets, args = append(sets, "email = ?"), append(args, user.Email)
+	}
 	if user.Password != "" {
-		hashedPassword = hashPassword(user.Password)
-	} else {
-		err := config.DB.QueryRow(`
-            SELECT password FROM users WHERE id = ?`, id,
-		).Scan(&hashedPassword)
+		sets, args = append(sets, "password = ?"), append(args, hashPassword(user.Password))
+	}
+
+	if len(sets) > 0 {
+		_, err = config.DB.Exec("UPDATE users SET "+strings.Join(sets, ", ")+" WHERE id = ?", append(args, id)...)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 	}
 
-	_, err = config.DB.Exec(`
-        UPDATE users 
-        SET name = ?, email = ?, password = ? 
-        WHERE id = ?`,
-		user.Name, user.Email, hashedPassword, id,
-	)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
 	updatedUser := models.User{}
 	err = config.DB.QueryRow(`
-        SELECT id, name, email, created_at, updated_at 
+        SELECT id, name, email, role, created_at, updated_at 
         FROM users 
         WHERE id = ?`, id,
 	).Scan(
 		&updatedUser.ID,
 		&updatedUser.Name,
 		&updatedUser.Email,
+		&updatedUser.Role,
 		&updatedUser.CreatedAt,
 		&updatedUser.UpdatedAt,
 	)
@@ -0,0 +1,705 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/umesh/ginapi/config"
+	"github.com/umesh/ginapi/models"
+)
+
+// Load the option definitions of a product together with their values
+func loadProductOptions(productID uint) ([]models.ProductOption, error) {
+	rows, err := config.DB.Query(`
+		SELECT o.id, o.product_id, o.name, v.id, v.value
+		FROM product_options o
+		LEFT JOIN product_option_values v ON v.option_id = o.id
+		WHERE o.product_id = ?
+		ORDER BY o.id, v.id`,
+		productID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var options []models.ProductOption
+	for rows.Next() {
+		var option models.ProductOption
+		var valueID sql.NullInt64
+		var value sql.NullString
+		if err := rows.Scan(&option.ID, &option.ProductID, &option.Name, &valueID, &value); err != nil {
+			return nil, err
+		}
+
+		if len(options) == 0 || options[len(options)-1].ID != option.ID {
+			option.Values = []models.ProductOptionValue{}
+			options = append(options, option)
+		}
+		if valueID.Valid {
+			last := &options[len(options)-1]
+			last.Values = append(last.Values, models.ProductOptionValue{
+				ID:       uint(valueID.Int64),
+				OptionID: option.ID,
+				Value:    value.String,
+			})
+		}
+	}
+
+	return options, rows.Err()
+}
+
+// Load the variants of a product with the option values that identify them
+func loadProductVariants(productID uint) ([]models.ProductVariant, error) {
+	rows, err := config.DB.Query(`
+		SELECT id, product_id, sku, COALESCE(barcode, ''), price, quantity,
+		       `+variantReservedStock+`
+		FROM product_variants
+		WHERE product_id = ? AND deleted_at IS NULL
+		ORDER BY id`,
+		productID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var variants []models.ProductVariant
+	index := map[uint]int{}
+	for rows.Next() {
+		var variant models.ProductVariant
+		var price sql.NullFloat64
+		if err := rows.Scan(
+			&variant.ID,
+			&variant.ProductID,
+			&variant.SKU,
+			&variant.Barcode,
+			&price,
+			&variant.Quantity,
+			&variant.Reserved,
+		); err != nil {
+			return nil, err
+		}
+		variant.Available = variant.Quantity - variant.Reserved
+		if price.Valid {
+			variant.Price = &price.Float64
+		}
+		variant.Options = []models.ProductOptionValue{}
+		index[variant.ID] = len(variants)
+		variants = append(variants, variant)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(variants) == 0 {
+		return variants, nil
+	}
+
+	valueRows, err := config.DB.Query(`
+		SELECT vo.variant_id, v.id, v.option_id, v.value
+		FROM product_variant_options vo
+		JOIN product_variants pv ON pv.id = vo.variant_id
+		JOIN product_option_values v ON v.id = vo.option_value_id
+		WHERE pv.product_id = ? AND pv.deleted_at IS NULL
+		ORDER BY v.option_id`,
+		productID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer valueRows.Close()
+
+	for valueRows.Next() {
+		var variantID uint
+		var value models.ProductOptionValue
+		if err := valueRows.Scan(&variantID, &value.ID, &value.OptionID, &value.Value); err != nil {
+			return nil, err
+		}
+		if i, ok := index[variantID]; ok {
+			variants[i].Options = append(variants[i].Options, value)
+		}
+	}
+
+	return variants, valueRows.Err()
+}
+
+// Check that every option value belongs to the product and that no option is used twice
+func validateOptionValues(tx *sql.Tx, productID uint, valueIDs []uint) error {
+	seen := map[uint]bool{}
+	for _, valueID := range valueIDs {
+		var optionID uint
+		err := tx.QueryRow(`
+			SELECT v.option_id
+			FROM product_option_values v
+			JOIN product_options o ON o.id = v.option_id
+			WHERE v.id = ? AND o.product_id = ?`,
+			valueID, productID,
+		).Scan(&optionID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return errors.New("option value " + strconv.Itoa(int(valueID)) + " does not belong to this product")
+		}
+		if err != nil {
+			return err
+		}
+		if seen[optionID] {
+			return errors.New("a variant can only have one value per option")
+		}
+		seen[optionID] = true
+	}
+	return nil
+}
+
+func parseProductID(c *gin.Context) (uint, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid product ID"})
+		return 0, false
+	}
+
+	var count int
+	err = config.DB.QueryRow("SELECT COUNT(*) FROM products WHERE id = ?", id).Scan(&count)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return 0, false
+	}
+	if count == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product does not exist"})
+		return 0, false
+	}
+
+	return uint(id), true
+}
+
+// Emit product.updated for a change to one of the product's variants, once
+// bumpProductVersion has run in the same transaction. data says what changed
+// and gets the product's id and new version added.
+func emitVariantChange(tx *sql.Tx, productID uint, data gin.H) error {
+	var version int
+	if err := tx.QueryRow("SELECT version FROM products WHERE id = ?", productID).Scan(&version); err != nil {
+		return err
+	}
+	data["id"] = productID
+	data["version"] = version
+	return emitEvent(tx, models.EventProductUpdated, data)
+}
+
+func GetProductOptions(c *gin.Context) {
+	productID, ok := parseProductID(c)
+	if !ok {
+		return
+	}
+
+	options, err := loadProductOptions(productID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": options})
+}
+
+func CreateProductOption(c *gin.Context) {
+	productID, ok := parseProductID(c)
+	if !ok {
+		return
+	}
+
+	var req models.CreateOptionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	var count int
+	err = tx.QueryRow(
+		"SELECT COUNT(*) FROM product_options WHERE product_id = ? AND name = ?",
+		productID, req.Name,
+	).Scan(&count)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if count > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "option with this name already exists"})
+		return
+	}
+
+	result, err := tx.Exec(
+		"INSERT INTO product_options (product_id, name) VALUES (?, ?)",
+		productID, req.Name,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	optionID, err := result.LastInsertId()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	option := models.ProductOption{
+		ID:        uint(optionID),
+		ProductID: productID,
+		Name:      req.Name,
+		Values:    []models.ProductOptionValue{},
+	}
+	seen := map[string]bool{}
+	for _, value := range req.Values {
+		value = strings.TrimSpace(value)
+		if value == "" || seen[value] {
+			continue
+		}
+		seen[value] = true
+
+		result, err := tx.Exec(
+			"INSERT INTO product_option_values (option_id, value) VALUES (?, ?)",
+			optionID, value,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		valueID, err := result.LastInsertId()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		option.Values = append(option.Values, models.ProductOptionValue{
+			ID:       uint(valueID),
+			OptionID: option.ID,
+			Value:    value,
+		})
+	}
+
+	if err := bumpProductVersion(tx, productID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, option)
+}
+
+func GetProductVariants(c *gin.Context) {
+	productID, ok := parseProductID(c)
+	if !ok {
+		return
+	}
+
+	variants, err := loadProductVariants(productID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": variants})
+}
+
+func CreateProductVariant(c *gin.Context) {
+	productID, ok := parseProductID(c)
+	if !ok {
+		return
+	}
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	var req models.VariantRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var count int
+	err := config.DB.QueryRow("SELECT COUNT(*) FROM product_variants WHERE sku = ?", req.SKU).Scan(&count)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if count > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "variant with this SKU already exists"})
+		return
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if err := validateOptionValues(tx, productID, req.OptionValueIDs); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO product_variants (product_id, sku, barcode, price, quantity)
+		VALUES (?, ?, ?, ?, ?)`,
+		productID, req.SKU, req.Barcode, req.Price, req.Quantity,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	variantID, err := result.LastInsertId()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	for _, valueID := range req.OptionValueIDs {
+		_, err := tx.Exec(
+			"INSERT INTO product_variant_options (variant_id, option_value_id) VALUES (?, ?)",
+			variantID, valueID,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	id := uint(variantID)
+	err = recordMovement(tx, models.InventoryMovement{
+		ProductID:      productID,
+		VariantID:      &id,
+		QuantityChange: req.Quantity,
+		Reason:         models.MovementRestock,
+		Reference:      "variant:create",
+		UserID:         &userID,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := bumpProductVersion(tx, productID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	variant := models.ProductVariant{
+		ID:        uint(variantID),
+		ProductID: productID,
+		SKU:       req.SKU,
+		Barcode:   req.Barcode,
+		Price:     req.Price,
+		Quantity:  req.Quantity,
+	}
+	if err := emitVariantChange(tx, productID, gin.H{"variant_created": variant}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, variant)
+}
+
+// Variant fields a patch can change, with the current values to patch
+func loadVariantPatch(tx *sql.Tx, productID uint, variantID string) (uint, models.VariantPatch, error) {
+	var id uint
+	var variant models.VariantPatch
+	var price sql.NullFloat64
+	err := tx.QueryRow(`
+		SELECT id, sku, COALESCE(barcode, ''), price, quantity
+		FROM product_variants
+		WHERE id = ? AND product_id = ? AND deleted_at IS NULL FOR UPDATE`,
+		variantID, productID,
+	).Scan(&id, &variant.SKU, &variant.Barcode, &price, &variant.Quantity)
+	if err != nil {
+		return id, variant, err
+	}
+	if price.Valid {
+		variant.Price = &price.Float64
+	}
+
+	rows, err := tx.Query("SELECT option_value_id FROM product_variant_options WHERE variant_id = ? ORDER BY option_value_id", id)
+	if err != nil {
+		return id, variant, err
+	}
+	defer rows.Close()
+
+	variant.OptionValueIDs = []uint{}
+	for rows.Next() {
+		var valueID uint
+		if err := rows.Scan(&valueID); err != nil {
+			return id, variant, err
+		}
+		variant.OptionValueIDs = append(variant.OptionValueIDs, valueID)
+	}
+	return id, variant, rows.Err()
+}
+
+// Report whether two lists hold the same IDs, in any order
+func sameIDs(a, b []uint) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := map[uint]int{}
+	for _, id := range a {
+		counts[id]++
+	}
+	for _, id := range b {
+		if counts[id] == 0 {
+			return false
+		}
+		counts[id]--
+	}
+	return true
+}
+
+// Patch a variant. Variants are part of their product, so the If-Match
+// header must name the current version of the product.
+func UpdateProductVariant(c *gin.Context) {
+	productID, ok := parseProductID(c)
+	if !ok {
+		return
+	}
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	var version int
+	if err := tx.QueryRow("SELECT version FROM products WHERE id = ? FOR UPDATE", productID).Scan(&version); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	id, current, err := loadVariantPatch(tx, productID, c.Param("variantId"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "variant not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	if !checkIfMatch(c, version) {
+		return
+	}
+
+	var variant models.VariantPatch
+	if !applyRequestPatch(c, current, &variant, "sku", "quantity") {
+		return
+	}
+
+	fieldErrors := map[string]string{}
+	if variant.SKU == "" {
+		fieldErrors["sku"] = "must not be empty"
+	} else if variant.SKU != current.SKU {
+		var count int
+		err = tx.QueryRow("SELECT COUNT(*) FROM product_variants WHERE sku = ? AND id != ?", variant.SKU, id).Scan(&count)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if count > 0 {
+			fieldErrors["sku"] = "variant with this SKU already exists"
+		}
+	}
+	if variant.Price != nil && *variant.Price < 0 {
+		fieldErrors["price"] = "must not be negative"
+	}
+	if variant.Quantity < 0 {
+		fieldErrors["quantity"] = "must not be negative"
+	} else if variant.Quantity < current.Quantity {
+		assigned, err := assignedStock(tx, productID, &id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if variant.Quantity < assigned {
+			fieldErrors["quantity"] = fmt.Sprintf("must not be below the %d units held at warehouses", assigned)
+		}
+	}
+	if len(fieldErrors) > 0 {
+		respondWithFieldErrors(c, fieldErrors)
+		return
+	}
+
+	optionsChanged := !sameIDs(variant.OptionValueIDs, current.OptionValueIDs)
+	if optionsChanged {
+		if err := validateOptionValues(tx, productID, variant.OptionValueIDs); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if variant.SKU == current.SKU && variant.Barcode == current.Barcode && equalFloatPtr(variant.Price, current.Price) &&
+		variant.Quantity == current.Quantity && !optionsChanged {
+		c.Header("ETag", productETag(version))
+		c.JSON(http.StatusOK, gin.H{"message": "Variant is already up to date"})
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE product_variants
+		SET sku = ?, barcode = ?, price = ?, quantity = ?
+		WHERE id = ?`,
+		variant.SKU, variant.Barcode, variant.Price, variant.Quantity, id,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = recordMovement(tx, models.InventoryMovement{
+		ProductID:      productID,
+		VariantID:      &id,
+		QuantityChange: variant.Quantity - current.Quantity,
+		Reason:         models.MovementAdjustment,
+		Reference:      "variant:update",
+		UserID:         &userID,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if optionsChanged {
+		if _, err := tx.Exec("DELETE FROM product_variant_options WHERE variant_id = ?", id); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		for _, valueID := range variant.OptionValueIDs {
+			_, err := tx.Exec(
+				"INSERT INTO product_variant_options (variant_id, option_value_id) VALUES (?, ?)",
+				id, valueID,
+			)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+	}
+
+	if err := bumpProductVersion(tx, productID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = emitVariantChange(tx, productID, gin.H{"variant_updated": models.ProductVariant{
+		ID:        id,
+		ProductID: productID,
+		SKU:       variant.SKU,
+		Barcode:   variant.Barcode,
+		Price:     variant.Price,
+		Quantity:  variant.Quantity,
+	}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if variant.Quantity != current.Quantity {
+		go func() {
+			if err := checkLowStock(productID); err != nil {
+				log.Printf("stock alert check for product %d failed: %v", productID, err)
+			}
+		}()
+	}
+
+	c.Header("ETag", productETag(version+1))
+	c.JSON(http.StatusOK, gin.H{"message": "Variant updated successfully"})
+}
+
+// Archive a variant. It can no longer be bought or changed, while the orders,
+// stock ledger and warehouse records that point at it are kept. Like updates,
+// it needs If-Match with the current version of the product.
+func DeleteProductVariant(c *gin.Context) {
+	productID, ok := parseProductID(c)
+	if !ok {
+		return
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	var version int
+	if err := tx.QueryRow("SELECT version FROM products WHERE id = ? FOR UPDATE", productID).Scan(&version); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var id uint
+	err = tx.QueryRow(
+		"SELECT id FROM product_variants WHERE id = ? AND product_id = ? AND deleted_at IS NULL FOR UPDATE",
+		c.Param("variantId"), productID,
+	).Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "variant not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	if !checkIfMatch(c, version) {
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE product_variants SET deleted_at = NOW() WHERE id = ?", id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := bumpProductVersion(tx, productID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := emitVariantChange(tx, productID, gin.H{"variant_deleted": id}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("ETag", productETag(version+1))
+	c.JSON(http.StatusOK, gin.H{"message": "Variant deleted successfully"})
+}
@@ -0,0 +1,696 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/umesh/ginapi/config"
+	"github.com/umesh/ginapi/models"
+)
+
+var errInsufficientLocationStock = errors.New("not enough stock at the warehouse")
+
+// warehouse_stock keys a product without variants as variant 0
+func variantKey(variantID *uint) uint {
+	if variantID == nil {
+		return 0
+	}
+	return *variantID
+}
+
+// Read and lock the total stock of a product or variant. Archived variants
+// are not found.
+func lockStockTotal(tx *sql.Tx, productID uint, variantID *uint) (int, error) {
+	var quantity int
+	var err error
+	if variantID != nil {
+		err = tx.QueryRow(
+			"SELECT quantity FROM product_variants WHERE id = ? AND product_id = ? AND deleted_at IS NULL FOR UPDATE",
+			*variantID, productID,
+		).Scan(&quantity)
+	} else {
+		err = tx.QueryRow("SELECT quantity FROM products WHERE id = ? FOR UPDATE", productID).Scan(&quantity)
+	}
+	return quantity, err
+}
+
+// Stock of a product or variant held at warehouses, out of its total
+func assignedStock(q queryer, productID uint, variantID *uint) (int, error) {
+	var assigned int
+	err := q.QueryRow(
+		"SELECT COALESCE(SUM(quantity), 0) FROM warehouse_stock WHERE product_id = ? AND variant_key = ?",
+		productID, variantKey(variantID),
+	).Scan(&assigned)
+	return assigned, err
+}
+
+// Add change to the stock of a product or variant at a warehouse. Returns
+// errInsufficientLocationStock rather than going below zero.
+func changeWarehouseStock(tx *sql.Tx, warehouseID, productID uint, variantID *uint, change int) error {
+	var quantity int
+	err := tx.QueryRow(`
+		SELECT quantity FROM warehouse_stock
+		WHERE warehouse_id = ? AND product_id = ? AND variant_key = ? FOR UPDATE`,
+		warehouseID, productID, variantKey(variantID),
+	).Scan(&quantity)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if quantity+change < 0 {
+		return errInsufficientLocationStock
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO warehouse_stock (warehouse_id, product_id, variant_id, quantity)
+		VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE quantity = quantity + VALUES(quantity)`,
+		warehouseID, productID, variantID, change,
+	)
+	return err
+}
+
+func activeWarehouseExists(q queryer, warehouseID uint) (bool, error) {
+	var count int
+	err := q.QueryRow("SELECT COUNT(*) FROM warehouses WHERE id = ? AND active = TRUE", warehouseID).Scan(&count)
+	return count > 0, err
+}
+
+// Great-circle distance in kilometres
+func distanceKm(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthRadius = 6371
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRad(lat2 - lat1)
+	dLon := toRad(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return earthRadius * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+// Decide which warehouses the units of an order item come from and take them
+// out of those locations. Active warehouses are used in strategy order, and
+// whatever they cannot cover comes from unassigned stock. total is the locked
+// stock level of the product or variant.
+func allocateStock(tx *sql.Tx, productID uint, variantID *uint, total, quantity int, strategy string, latitude, longitude *float64) ([]models.OrderItemAllocation, error) {
+	rows, err := tx.Query(`
+		SELECT ws.warehouse_id, ws.quantity, w.active, w.latitude, w.longitude
+		FROM warehouse_stock ws
+		JOIN warehouses w ON w.id = ws.warehouse_id
+		WHERE ws.product_id = ? AND ws.variant_key = ?
+		FOR UPDATE`,
+		productID, variantKey(variantID),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	type location struct {
+		warehouseID uint
+		quantity    int
+		distance    float64
+	}
+	var candidates []location
+	assigned := 0
+	for rows.Next() {
+		var loc location
+		var active bool
+		var lat, lon sql.NullFloat64
+		if err := rows.Scan(&loc.warehouseID, &loc.quantity, &active, &lat, &lon); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		assigned += loc.quantity
+		if !active || loc.quantity <= 0 {
+			continue
+		}
+		//Warehouses without coordinates go after every located one
+		loc.distance = math.Inf(1)
+		if lat.Valid && lon.Valid && latitude != nil && longitude != nil {
+			loc.distance = distanceKm(*latitude, *longitude, lat.Float64, lon.Float64)
+		}
+		candidates = append(candidates, loc)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if strategy == models.AllocateNearest && candidates[i].distance != candidates[j].distance {
+			return candidates[i].distance < candidates[j].distance
+		}
+		if candidates[i].quantity != candidates[j].quantity {
+			return candidates[i].quantity > candidates[j].quantity
+		}
+		return candidates[i].warehouseID < candidates[j].warehouseID
+	})
+
+	var allocations []models.OrderItemAllocation
+	remaining := quantity
+	for _, loc := range candidates {
+		if remaining == 0 {
+			break
+		}
+		take := loc.quantity
+		if take > remaining {
+			take = remaining
+		}
+		if err := changeWarehouseStock(tx, loc.warehouseID, productID, variantID, -take); err != nil {
+			return nil, err
+		}
+		warehouseID := loc.warehouseID
+		allocations = append(allocations, models.OrderItemAllocation{WarehouseID: &warehouseID, Quantity: take})
+		remaining -= take
+	}
+
+	if remaining > 0 {
+		if remaining > total-assigned {
+			return nil, errInsufficientLocationStock
+		}
+		allocations = append(allocations, models.OrderItemAllocation{Quantity: remaining})
+	}
+	return allocations, nil
+}
+
+func recordAllocations(tx *sql.Tx, orderItemID int64, allocations []models.OrderItemAllocation) error {
+	for _, allocation := range allocations {
+		_, err := tx.Exec(
+			"INSERT INTO order_item_allocations (order_item_id, warehouse_id, quantity) VALUES (?, ?, ?)",
+			orderItemID, allocation.WarehouseID, allocation.Quantity,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Attach the warehouse allocations to order items with a single query
+func loadOrderItemAllocations(items []models.OrderItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+
+	index := make(map[uint]int, len(items))
+	args := make([]interface{}, len(items))
+	for i, item := range items {
+		index[item.ID] = i
+		args[i] = item.ID
+	}
+
+	rows, err := config.DB.Query(`
+		SELECT order_item_id, warehouse_id, quantity FROM order_item_allocations
+		WHERE order_item_id IN (?`+strings.Repeat(", ?", len(items)-1)+`)
+		ORDER BY id`,
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var itemID uint
+		var allocation models.OrderItemAllocation
+		if err := rows.Scan(&itemID, &allocation.WarehouseID, &allocation.Quantity); err != nil {
+			return err
+		}
+		i := index[itemID]
+		items[i].Allocations = append(items[i].Allocations, allocation)
+	}
+	return rows.Err()
+}
+
+func GetWarehouses(c *gin.Context) {
+	query := `
+		SELECT id, code, name, COALESCE(address, ''), latitude, longitude, active, created_at
+		FROM warehouses`
+	if c.Query("active") == "true" {
+		query += " WHERE active = TRUE"
+	}
+	query += " ORDER BY name"
+
+	rows, err := config.DB.Query(query)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	warehouses := []models.Warehouse{}
+	for rows.Next() {
+		var warehouse models.Warehouse
+		if err := rows.Scan(
+			&warehouse.ID,
+			&warehouse.Code,
+			&warehouse.Name,
+			&warehouse.Address,
+			&warehouse.Latitude,
+			&warehouse.Longitude,
+			&warehouse.Active,
+			&warehouse.CreatedAt,
+		); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		warehouses = append(warehouses, warehouse)
+	}
+
+	if err = rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": warehouses})
+}
+
+func CreateWarehouse(c *gin.Context) {
+	var req models.WarehouseRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var count int
+	if err := config.DB.QueryRow("SELECT COUNT(*) FROM warehouses WHERE code = ?", req.Code).Scan(&count); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "a warehouse with this code already exists"})
+		return
+	}
+
+	active := true
+	if req.Active != nil {
+		active = *req.Active
+	}
+
+	result, err := config.DB.Exec(`
+		INSERT INTO warehouses (code, name, address, latitude, longitude, active)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		req.Code, req.Name, nullableString(req.Address), req.Latitude, req.Longitude, active,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, models.Warehouse{
+		ID:        uint(id),
+		Code:      req.Code,
+		Name:      req.Name,
+		Address:   req.Address,
+		Latitude:  req.Latitude,
+		Longitude: req.Longitude,
+		Active:    active,
+	})
+}
+
+// Inactive warehouses keep their stock but are skipped when allocating orders
+func UpdateWarehouse(c *gin.Context) {
+	var req models.WarehouseRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var warehouse models.Warehouse
+	err := config.DB.QueryRow("SELECT id, active, created_at FROM warehouses WHERE id = ?", c.Param("id")).
+		Scan(&warehouse.ID, &warehouse.Active, &warehouse.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "warehouse not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	var count int
+	err = config.DB.QueryRow("SELECT COUNT(*) FROM warehouses WHERE code = ? AND id != ?", req.Code, warehouse.ID).Scan(&count)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "a warehouse with this code already exists"})
+		return
+	}
+
+	if req.Active != nil {
+		warehouse.Active = *req.Active
+	}
+
+	_, err = config.DB.Exec(`
+		UPDATE warehouses
+		SET code = ?, name = ?, address = ?, latitude = ?, longitude = ?, active = ?
+		WHERE id = ?`,
+		req.Code, req.Name, nullableString(req.Address), req.Latitude, req.Longitude, warehouse.Active, warehouse.ID,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	warehouse.Code = req.Code
+	warehouse.Name = req.Name
+	warehouse.Address = req.Address
+	warehouse.Latitude = req.Latitude
+	warehouse.Longitude = req.Longitude
+	c.JSON(http.StatusOK, warehouse)
+}
+
+// Everything held at one warehouse
+func GetWarehouseStock(c *gin.Context) {
+	var warehouseID uint
+	err := config.DB.QueryRow("SELECT id FROM warehouses WHERE id = ?", c.Param("id")).Scan(&warehouseID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "warehouse not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	rows, err := config.DB.Query(`
+		SELECT ws.warehouse_id, w.code, ws.product_id, p.name, ws.variant_id, ws.quantity
+		FROM warehouse_stock ws
+		JOIN warehouses w ON w.id = ws.warehouse_id
+		JOIN products p ON p.id = ws.product_id
+		WHERE ws.warehouse_id = ? AND ws.quantity > 0
+		ORDER BY p.name, ws.variant_key`,
+		warehouseID,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	stock := []models.WarehouseStock{}
+	for rows.Next() {
+		var level models.WarehouseStock
+		if err := rows.Scan(
+			&level.WarehouseID,
+			&level.WarehouseCode,
+			&level.ProductID,
+			&level.ProductName,
+			&level.VariantID,
+			&level.Quantity,
+		); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		stock = append(stock, level)
+	}
+
+	if err = rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": stock})
+}
+
+// Stock of a product, or of one of its variants, at every warehouse
+func GetStockLocations(c *gin.Context) {
+	productID, ok := parseProductID(c)
+	if !ok {
+		return
+	}
+
+	locations := models.StockLocations{ProductID: productID, Locations: []models.WarehouseStock{}}
+	var err error
+	if value := c.Query("variant_id"); value != "" {
+		variantID, convErr := strconv.Atoi(value)
+		if convErr != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid variant ID"})
+			return
+		}
+		id := uint(variantID)
+		locations.VariantID = &id
+		err = config.DB.QueryRow(
+			"SELECT quantity FROM product_variants WHERE id = ? AND product_id = ?",
+			variantID, productID,
+		).Scan(&locations.Total)
+	} else {
+		err = config.DB.QueryRow("SELECT quantity FROM products WHERE id = ?", productID).Scan(&locations.Total)
+	}
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "variant not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	rows, err := config.DB.Query(`
+		SELECT ws.warehouse_id, w.code, ws.product_id, p.name, ws.variant_id, ws.quantity
+		FROM warehouse_stock ws
+		JOIN warehouses w ON w.id = ws.warehouse_id
+		JOIN products p ON p.id = ws.product_id
+		WHERE ws.product_id = ? AND ws.variant_key = ?
+		ORDER BY w.name`,
+		productID, variantKey(locations.VariantID),
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	assigned := 0
+	for rows.Next() {
+		var level models.WarehouseStock
+		if err := rows.Scan(
+			&level.WarehouseID,
+			&level.WarehouseCode,
+			&level.ProductID,
+			&level.ProductName,
+			&level.VariantID,
+			&level.Quantity,
+		); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		assigned += level.Quantity
+		locations.Locations = append(locations.Locations, level)
+	}
+
+	if err = rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	locations.Unassigned = locations.Total - assigned
+	c.JSON(http.StatusOK, locations)
+}
+
+// Move stock between warehouses, or between a warehouse and the unassigned
+// stock. The total of the product does not change.
+func CreateStockTransfer(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	var req models.CreateTransferRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.FromWarehouseID == nil && req.ToWarehouseID == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from_warehouse_id or to_warehouse_id is required"})
+		return
+	}
+	if req.FromWarehouseID != nil && req.ToWarehouseID != nil && *req.FromWarehouseID == *req.ToWarehouseID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cannot transfer stock to the same warehouse"})
+		return
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	//Locking the total serialises transfers with orders and stock movements
+	total, err := lockStockTotal(tx, req.ProductID, req.VariantID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "product not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	if req.ToWarehouseID != nil {
+		exists, err := activeWarehouseExists(tx, *req.ToWarehouseID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "destination warehouse not found"})
+			return
+		}
+	}
+
+	if req.FromWarehouseID != nil {
+		err = changeWarehouseStock(tx, *req.FromWarehouseID, req.ProductID, req.VariantID, -req.Quantity)
+		if errors.Is(err, errInsufficientLocationStock) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "not enough stock at the source warehouse"})
+			return
+		}
+	} else {
+		var assigned int
+		assigned, err = assignedStock(tx, req.ProductID, req.VariantID)
+		if err == nil && total-assigned < req.Quantity {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("only %d units are not held at a warehouse", total-assigned),
+			})
+			return
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.ToWarehouseID != nil {
+		if err := changeWarehouseStock(tx, *req.ToWarehouseID, req.ProductID, req.VariantID, req.Quantity); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO stock_transfers (product_id, variant_id, from_warehouse_id, to_warehouse_id, quantity, user_id, note)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		req.ProductID, req.VariantID, req.FromWarehouseID, req.ToWarehouseID, req.Quantity, userID, nullableString(req.Note),
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, models.StockTransfer{
+		ID:              uint(id),
+		ProductID:       req.ProductID,
+		VariantID:       req.VariantID,
+		FromWarehouseID: req.FromWarehouseID,
+		ToWarehouseID:   req.ToWarehouseID,
+		Quantity:        req.Quantity,
+		UserID:          &userID,
+		Note:            req.Note,
+	})
+}
+
+func GetStockTransfers(c *gin.Context) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit < 1 {
+		limit = 20
+	}
+
+	var conditions []string
+	var args []interface{}
+	if productID := c.Query("product_id"); productID != "" {
+		conditions, args = append(conditions, "product_id = ?"), append(args, productID)
+	}
+	if warehouseID := c.Query("warehouse_id"); warehouseID != "" {
+		conditions = append(conditions, "(from_warehouse_id = ? OR to_warehouse_id = ?)")
+		args = append(args, warehouseID, warehouseID)
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var total int
+	err = config.DB.QueryRow("SELECT COUNT(*) FROM stock_transfers "+where, args...).Scan(&total)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	rows, err := config.DB.Query(`
+		SELECT id, product_id, variant_id, from_warehouse_id, to_warehouse_id, quantity,
+		       user_id, COALESCE(note, ''), created_at
+		FROM stock_transfers `+where+`
+		ORDER BY created_at DESC, id DESC
+		LIMIT ? OFFSET ?`,
+		append(args, limit, (page-1)*limit)...,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	transfers := []models.StockTransfer{}
+	for rows.Next() {
+		var transfer models.StockTransfer
+		if err := rows.Scan(
+			&transfer.ID,
+			&transfer.ProductID,
+			&transfer.VariantID,
+			&transfer.FromWarehouseID,
+			&transfer.ToWarehouseID,
+			&transfer.Quantity,
+			&transfer.UserID,
+			&transfer.Note,
+			&transfer.CreatedAt,
+		); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		transfers = append(transfers, transfer)
+	}
+
+	if err = rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": transfers,
+		"pagination": gin.H{
+			"total":       total,
+			"page":        page,
+			"limit":       limit,
+			"total_pages": int(math.Ceil(float64(total) / float64(limit))),
+		},
+	})
+}
@@ -0,0 +1,702 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/umesh/ginapi/config"
+	"github.com/umesh/ginapi/models"
+	"github.com/umesh/ginapi/utils"
+)
+
+// Retry schedule: the wait doubles after each failed attempt, starting at
+// webhookRetryDelay and capped at webhookMaxRetryDelay. A delivery that fails
+// webhookMaxAttempts times is dead.
+const (
+	webhookMaxAttempts   = 8
+	webhookRetryDelay    = 30 * time.Second
+	webhookMaxRetryDelay = 6 * time.Hour
+	webhookBatchSize     = 20
+	// Claimed deliveries are pushed this far ahead so other dispatchers skip
+	// them while they are being sent
+	webhookClaimLease = 2 * time.Minute
+)
+
+var webhookEvents = map[string]bool{
+	models.EventOrderCreated:        true,
+	models.EventOrderStatusChanged:  true,
+	models.EventProductCreated:      true,
+	models.EventProductUpdated:      true,
+	models.EventProductDeleted:      true,
+	models.EventProductRestored:     true,
+	models.EventProductStockChanged: true,
+	models.EventAll:                 true,
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// Wakes the dispatcher early, e.g. after a manual redelivery
+var webhookWake = make(chan struct{}, 1)
+
+// The body of every webhook
+type webhookEvent struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// Queue an event for every active subscription to it. Called with the
+// transaction of the change, the deliveries only exist if that change commits.
+func emitEvent(q execer, eventType string, data interface{}) error {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+	event := webhookEvent{
+		ID:        "evt_" + hex.EncodeToString(buf),
+		Type:      eventType,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+		Data:      data,
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.Exec(`
+		INSERT INTO webhook_deliveries (subscription_id, event_id, event_type, payload)
+		SELECT DISTINCT s.id, ?, ?, ?
+		FROM webhook_subscriptions s
+		JOIN webhook_subscription_events e ON e.subscription_id = s.id
+		WHERE s.active = TRUE AND e.event_type IN (?, ?)`,
+		event.ID, eventType, payload, eventType, models.EventAll,
+	)
+	return err
+}
+
+// Wait before the next attempt after the given number of failed attempts.
+// The wait starts at first and doubles each time, up to limit.
+func retryBackoff(attempts int, first, limit time.Duration) time.Duration {
+	delay := first
+	for i := 1; i < attempts && delay < limit; i++ {
+		delay *= 2
+	}
+	if delay > limit {
+		delay = limit
+	}
+	return delay
+}
+
+// StartWebhookDispatcher sends due webhook deliveries on the given interval
+func StartWebhookDispatcher(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := dispatchWebhooks(); err != nil {
+				log.Printf("webhook dispatcher failed: %v", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-webhookWake:
+			}
+		}
+	}()
+}
+
+func wakeWebhookDispatcher() {
+	select {
+	case webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+type dueDelivery struct {
+	id        uint
+	eventID   string
+	eventType string
+	payload   string
+	attempts  int
+	url       string
+	secret    string
+}
+
+func dispatchWebhooks() error {
+	for {
+		due, err := claimDueDeliveries()
+		if err != nil {
+			return err
+		}
+		for _, delivery := range due {
+			if err := sendDelivery(delivery); err != nil {
+				log.Printf("webhook delivery %d: %v", delivery.id, err)
+			}
+		}
+		if len(due) < webhookBatchSize {
+			return nil
+		}
+	}
+}
+
+// Take a batch of due deliveries. Rows locked by another dispatcher are skipped.
+func claimDueDeliveries() ([]dueDelivery, error) {
+	tx, err := config.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT d.id, d.event_id, d.event_type, d.payload, d.attempts, s.url, s.secret
+		FROM webhook_deliveries d
+		JOIN webhook_subscriptions s ON s.id = d.subscription_id
+		WHERE d.status = ? AND d.next_attempt_at <= NOW() AND s.active = TRUE
+		ORDER BY d.next_attempt_at, d.id
+		LIMIT ?
+		FOR UPDATE OF d SKIP LOCKED`,
+		models.DeliveryPending, webhookBatchSize,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var due []dueDelivery
+	for rows.Next() {
+		var delivery dueDelivery
+		if err := rows.Scan(
+			&delivery.id,
+			&delivery.eventID,
+			&delivery.eventType,
+			&delivery.payload,
+			&delivery.attempts,
+			&delivery.url,
+			&delivery.secret,
+		); err != nil {
+			return nil, err
+		}
+		due = append(due, delivery)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	if len(due) == 0 {
+		return nil, nil
+	}
+
+	args := []interface{}{int(webhookClaimLease.Seconds())}
+	for _, delivery := range due {
+		args = append(args, delivery.id)
+	}
+	_, err = tx.Exec(
+		"UPDATE webhook_deliveries SET next_attempt_at = NOW() + INTERVAL ? SECOND WHERE id IN (?"+strings.Repeat(", ?", len(due)-1)+")",
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return due, tx.Commit()
+}
+
+// Make one attempt at a delivery and record its outcome
+func sendDelivery(delivery dueDelivery) error {
+	started := time.Now()
+	var statusCode *int
+	var failure string
+
+	req, err := http.NewRequest(http.MethodPost, delivery.url, strings.NewReader(delivery.payload))
+	if err == nil {
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(utils.WebhookEventHeader, delivery.eventType)
+		req.Header.Set(utils.WebhookDeliveryHeader, delivery.eventID)
+		req.Header.Set(utils.WebhookSignatureHeader, utils.SignWebhook(delivery.secret, started, []byte(delivery.payload)))
+
+		var resp *http.Response
+		resp, err = webhookClient.Do(req)
+		if err == nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+			statusCode = &resp.StatusCode
+			if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+				failure = fmt.Sprintf("unexpected status %d", resp.StatusCode)
+			}
+		}
+	}
+	if err != nil {
+		failure = err.Error()
+	}
+	duration := time.Since(started)
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		"INSERT INTO webhook_attempts (delivery_id, status_code, error, duration_ms) VALUES (?, ?, ?, ?)",
+		delivery.id, statusCode, nullableString(truncateText(failure, 500)), duration.Milliseconds(),
+	)
+	if err != nil {
+		return err
+	}
+
+	attempts := delivery.attempts + 1
+	switch {
+	case failure == "":
+		_, err = tx.Exec(
+			"UPDATE webhook_deliveries SET status = ?, attempts = ?, next_attempt_at = NULL, delivered_at = NOW() WHERE id = ?",
+			models.DeliveryDelivered, attempts, delivery.id,
+		)
+	case attempts >= webhookMaxAttempts:
+		_, err = tx.Exec(
+			"UPDATE webhook_deliveries SET status = ?, attempts = ?, next_attempt_at = NULL WHERE id = ?",
+			models.DeliveryDead, attempts, delivery.id,
+		)
+	default:
+		_, err = tx.Exec(
+			"UPDATE webhook_deliveries SET attempts = ?, next_attempt_at = NOW() + INTERVAL ? SECOND WHERE id = ?",
+			attempts, int(retryBackoff(attempts, webhookRetryDelay, webhookMaxRetryDelay).Seconds()), delivery.id,
+		)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func validateWebhookEvents(events []string) string {
+	for _, event := range events {
+		if !webhookEvents[event] {
+			return fmt.Sprintf("unknown event %q", event)
+		}
+	}
+	return ""
+}
+
+func saveWebhookEvents(tx *sql.Tx, subscriptionID uint, events []string) error {
+	if _, err := tx.Exec("DELETE FROM webhook_subscription_events WHERE subscription_id = ?", subscriptionID); err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, event := range events {
+		if seen[event] {
+			continue
+		}
+		seen[event] = true
+		_, err := tx.Exec(
+			"INSERT INTO webhook_subscription_events (subscription_id, event_type) VALUES (?, ?)",
+			subscriptionID, event,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func loadWebhookSubscriptions(id interface{}) ([]models.WebhookSubscription, error) {
+	query := "SELECT id, url, active, created_at FROM webhook_subscriptions"
+	var args []interface{}
+	if id != nil {
+		query, args = query+" WHERE id = ?", append(args, id)
+	}
+	rows, err := config.DB.Query(query+" ORDER BY id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subscriptions := []models.WebhookSubscription{}
+	index := map[uint]int{}
+	for rows.Next() {
+		subscription := models.WebhookSubscription{Events: []string{}}
+		if err := rows.Scan(&subscription.ID, &subscription.URL, &subscription.Active, &subscription.CreatedAt); err != nil {
+			return nil, err
+		}
+		index[subscription.ID] = len(subscriptions)
+		subscriptions = append(subscriptions, subscription)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	eventRows, err := config.DB.Query("SELECT subscription_id, event_type FROM webhook_subscription_events ORDER BY event_type")
+	if err != nil {
+		return nil, err
+	}
+	defer eventRows.Close()
+
+	for eventRows.Next() {
+		var subscriptionID uint
+		var event string
+		if err := eventRows.Scan(&subscriptionID, &event); err != nil {
+			return nil, err
+		}
+		if i, ok := index[subscriptionID]; ok {
+			subscriptions[i].Events = append(subscriptions[i].Events, event)
+		}
+	}
+	return subscriptions, eventRows.Err()
+}
+
+func GetWebhookSubscriptions(c *gin.Context) {
+	subscriptions, err := loadWebhookSubscriptions(nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": subscriptions})
+}
+
+func GetWebhookSubscription(c *gin.Context) {
+	subscriptions, err := loadWebhookSubscriptions(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(subscriptions) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "webhook subscription not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, subscriptions[0])
+}
+
+// Subscribe a URL to events. The signing secret is generated unless given
+// and is only returned here.
+func CreateWebhookSubscription(c *gin.Context) {
+	var req models.WebhookSubscriptionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if message := validateWebhookEvents(req.Events); message != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": message})
+		return
+	}
+
+	secret := req.Secret
+	if secret == "" {
+		token, err := newCartToken()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		secret = "whsec_" + token
+	}
+	active := true
+	if req.Active != nil {
+		active = *req.Active
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"INSERT INTO webhook_subscriptions (url, secret, active) VALUES (?, ?, ?)",
+		req.URL, secret, active,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := saveWebhookEvents(tx, uint(id), req.Events); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	subscriptions, err := loadWebhookSubscriptions(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	subscription := subscriptions[0]
+	subscription.Secret = secret
+
+	c.JSON(http.StatusCreated, subscription)
+}
+
+// Replace the URL and events of a subscription. The secret is only changed
+// when a new one is given.
+func UpdateWebhookSubscription(c *gin.Context) {
+	var req models.WebhookSubscriptionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if message := validateWebhookEvents(req.Events); message != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": message})
+		return
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	var subscriptionID uint
+	var active bool
+	err = tx.QueryRow("SELECT id, active FROM webhook_subscriptions WHERE id = ? FOR UPDATE", c.Param("id")).Scan(&subscriptionID, &active)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "webhook subscription not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	if req.Active != nil {
+		active = *req.Active
+	}
+
+	sets := []string{"url = ?", "active = ?"}
+	args := []interface{}{req.URL, active}
+	if req.Secret != "" {
+		sets, args = append(sets, "secret = ?"), append(args, req.Secret)
+	}
+	args = append(args, subscriptionID)
+	if _, err := tx.Exec("UPDATE webhook_subscriptions SET "+strings.Join(sets, ", ")+" WHERE id = ?", args...); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := saveWebhookEvents(tx, subscriptionID, req.Events); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	subscriptions, err := loadWebhookSubscriptions(subscriptionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, subscriptions[0])
+}
+
+// Remove a subscription together with its deliveries and their log
+func DeleteWebhookSubscription(c *gin.Context) {
+	result, err := config.DB.Exec("DELETE FROM webhook_subscriptions WHERE id = ?", c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if affected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "webhook subscription not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Webhook subscription deleted successfully"})
+}
+
+const webhookDeliveryColumns = `id, subscription_id, event_id, event_type, payload, status, attempts,
+	next_attempt_at, delivered_at, created_at`
+
+func scanWebhookDelivery(row interface{ Scan(...interface{}) error }, delivery *models.WebhookDelivery) error {
+	return row.Scan(
+		&delivery.ID,
+		&delivery.SubscriptionID,
+		&delivery.EventID,
+		&delivery.EventType,
+		&delivery.Payload,
+		&delivery.Status,
+		&delivery.Attempts,
+		&delivery.NextAttemptAt,
+		&delivery.DeliveredAt,
+		&delivery.CreatedAt,
+	)
+}
+
+func loadWebhookDelivery(id interface{}) (models.WebhookDelivery, error) {
+	var delivery models.WebhookDelivery
+	err := scanWebhookDelivery(config.DB.QueryRow("SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries WHERE id = ?", id), &delivery)
+	if err != nil {
+		return delivery, err
+	}
+
+	rows, err := config.DB.Query(`
+		SELECT id, status_code, error, duration_ms, created_at
+		FROM webhook_attempts
+		WHERE delivery_id = ?
+		ORDER BY id`,
+		delivery.ID,
+	)
+	if err != nil {
+		return delivery, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var attempt models.WebhookAttempt
+		if err := rows.Scan(&attempt.ID, &attempt.StatusCode, &attempt.Error, &attempt.DurationMs, &attempt.CreatedAt); err != nil {
+			return delivery, err
+		}
+		delivery.Log = append(delivery.Log, attempt)
+	}
+	return delivery, rows.Err()
+}
+
+// Delivery log, newest first. Filters are subscription_id, status and event_type;
+// status=dead lists the dead letters.
+func GetWebhookDeliveries(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+	offset := (page - 1) * limit
+
+	var conditions []string
+	var args []interface{}
+	if value := c.Query("subscription_id"); value != "" {
+		conditions, args = append(conditions, "subscription_id = ?"), append(args, value)
+	}
+	if value := c.Query("status"); value != "" {
+		conditions, args = append(conditions, "status = ?"), append(args, value)
+	}
+	if value := c.Query("event_type"); value != "" {
+		conditions, args = append(conditions, "event_type = ?"), append(args, value)
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var total int
+	if err := config.DB.QueryRow("SELECT COUNT(*) FROM webhook_deliveries "+where, args...).Scan(&total); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	rows, err := config.DB.Query(
+		"SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries "+where+" ORDER BY id DESC LIMIT ? OFFSET ?",
+		append(args, limit, offset)...,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []models.WebhookDelivery{}
+	for rows.Next() {
+		var delivery models.WebhookDelivery
+		if err := scanWebhookDelivery(rows, &delivery); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	if err = rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": deliveries,
+		"pagination": gin.H{
+			"total":       total,
+			"page":        page,
+			"limit":       limit,
+			"total_pages": (total + limit - 1) / limit,
+		},
+	})
+}
+
+// A delivery with the log of its attempts
+func GetWebhookDelivery(c *gin.Context) {
+	delivery, err := loadWebhookDelivery(c.Param("id"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "webhook delivery not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, delivery)
+}
+
+// Send a delivery again, e.g. a dead letter once the receiver is fixed. It
+// starts over with a full set of attempts; the old ones stay in its log.
+// Deliveries still pending are left to the dispatcher.
+func RedeliverWebhook(c *gin.Context) {
+	result, err := config.DB.Exec(
+		"UPDATE webhook_deliveries SET status = ?, attempts = 0, next_attempt_at = NOW() WHERE id = ? AND status != ?",
+		models.DeliveryPending, c.Param("id"), models.DeliveryPending,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		var count int
+		if err := config.DB.QueryRow("SELECT COUNT(*) FROM webhook_deliveries WHERE id = ?", c.Param("id")).Scan(&count); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if count == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "webhook delivery not found"})
+			return
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": "webhook delivery is still pending"})
+		return
+	}
+	wakeWebhookDispatcher()
+
+	delivery, err := loadWebhookDelivery(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, delivery)
+}
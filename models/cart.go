@@ -0,0 +1,48 @@
+package models
+
+import "time"
+
+// Cart prices and stock are read live each time the cart is shown; Valid is
+// false while any item could not be checked out as it stands
+type Cart struct {
+	ID        uint       `json:"id"`
+	Token     string     `json:"token,omitempty"`
+	Items     []CartItem `json:"items"`
+	Subtotal  float64    `json:"subtotal"`
+	Valid     bool       `json:"valid"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+type CartItem struct {
+	ID        uint    `json:"id"`
+	ProductID uint    `json:"product_id"`
+	VariantID *uint   `json:"variant_id,omitempty"`
+	Name      string  `json:"name"`
+	Quantity  int     `json:"quantity"`
+	UnitPrice float64 `json:"unit_price"`
+	LineTotal float64 `json:"line_total"`
+	Available int     `json:"available"`
+	// Why the item cannot be checked out, if it cannot
+	Problem string `json:"problem,omitempty"`
+}
+
+type CartItemRequest struct {
+	ProductID uint  `json:"product_id" binding:"required"`
+	VariantID *uint `json:"variant_id"`
+	Quantity  int   `json:"quantity" binding:"required,min=1"`
+}
+
+type UpdateCartItemRequest struct {
+	Quantity int `json:"quantity" binding:"required,min=1"`
+}
+
+// Everything CreateOrderRequest takes apart from the items, which come from the cart
+type CheckoutRequest struct {
+	CouponCode     string   `json:"coupon_code"`
+	Region         string   `json:"region" binding:"max=50"`
+	ShippingMethod string   `json:"shipping_method" binding:"max=50"`
+	ReservationID  *uint    `json:"reservation_id"`
+	Allocation     string   `json:"allocation" binding:"omitempty,oneof=nearest most_stock"`
+	Latitude       *float64 `json:"latitude" binding:"omitempty,min=-90,max=90"`
+	Longitude      *float64 `json:"longitude" binding:"omitempty,min=-180,max=180"`
+}
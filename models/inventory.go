@@ -0,0 +1,62 @@
+package models
+
+import "time"
+
+// Reasons recorded against every stock change
+const (
+	MovementSale       = "sale"
+	MovementRestock    = "restock"
+	MovementAdjustment = "adjustment"
+	MovementReturn     = "return"
+	// Stock put back when an order is cancelled
+	MovementCancellation = "cancellation"
+)
+
+type InventoryMovement struct {
+	ID             uint      `json:"id"`
+	ProductID      uint      `json:"product_id"`
+	VariantID      *uint     `json:"variant_id,omitempty"`
+	WarehouseID    *uint     `json:"warehouse_id,omitempty"`
+	QuantityChange int       `json:"quantity_change"`
+	QuantityAfter  int       `json:"quantity_after"`
+	Reason         string    `json:"reason"`
+	Reference      string    `json:"reference"`
+	UnitCost       float64   `json:"unit_cost"`
+	UserID         *uint     `json:"user_id"`
+	Note           string    `json:"note"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+type CreateMovementRequest struct {
+	ProductID      uint   `json:"product_id" binding:"required"`
+	VariantID      *uint  `json:"variant_id"`
+	WarehouseID    *uint  `json:"warehouse_id"`
+	QuantityChange int    `json:"quantity_change" binding:"required"`
+	Reason         string `json:"reason" binding:"required,oneof=restock adjustment return"`
+	Reference      string `json:"reference"`
+	Note           string `json:"note"`
+}
+
+type StockSnapshot struct {
+	ProductID uint      `json:"product_id"`
+	VariantID *uint     `json:"variant_id,omitempty"`
+	At        time.Time `json:"at"`
+	Quantity  int       `json:"quantity"`
+}
+
+type StockAlert struct {
+	ID              uint       `json:"id"`
+	ProductID       uint       `json:"product_id"`
+	ProductName     string     `json:"product_name"`
+	Quantity        int        `json:"quantity"`
+	ReorderPoint    int        `json:"reorder_point"`
+	ReorderQuantity int        `json:"reorder_quantity"`
+	Status          string     `json:"status"`
+	CreatedAt       time.Time  `json:"created_at"`
+	ResolvedAt      *time.Time `json:"resolved_at"`
+}
+
+type ReorderSettingsRequest struct {
+	ReorderPoint    *int `json:"reorder_point" binding:"omitempty,min=0"`
+	ReorderQuantity *int `json:"reorder_quantity" binding:"omitempty,min=1"`
+}
@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// Seller details printed on invoices
+type Seller struct {
+	Name    string
+	Address string
+	Email   string
+	TaxID   string
+}
+
+// Number comes from a gap-free sequence and the rendered PDF is kept, so an
+// invoice never changes once issued
+type Invoice struct {
+	ID       uint      `json:"id"`
+	OrderID  uint      `json:"order_id"`
+	Number   string    `json:"number"`
+	IssuedAt time.Time `json:"issued_at"`
+}
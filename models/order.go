@@ -2,28 +2,126 @@ package models
 
 import "time"
 
+// Order lifecycle: pending → paid → processing → shipped → delivered, with
+// cancelled and refunded as the ways out
+const (
+	OrderPending    = "pending"
+	OrderPaid       = "paid"
+	OrderProcessing = "processing"
+	OrderShipped    = "shipped"
+	OrderDelivered  = "delivered"
+	OrderCancelled  = "cancelled"
+	OrderRefunded   = "refunded"
+)
+
 type Order struct {
-	ID          uint        `json:"id"`
-	UserID      uint        `json:"user_id"`
-	TotalAmount float64     `json:"total_amount"`
-	Status      string      `json:"status"`
-	CreatedAt   time.Time   `json:"created_at"`
-	OrderItems  []OrderItem `json:"order_items"`
+	ID     uint `json:"id"`
+	UserID uint `json:"user_id"`
+	// Items at their list prices, before discounts and exclusive tax
+	Subtotal       float64 `json:"subtotal"`
+	DiscountAmount float64 `json:"discount_amount"`
+	// Tax on the order, whether included in the prices or added to them
+	TaxAmount float64 `json:"tax_amount"`
+	TaxRegion string  `json:"tax_region,omitempty"`
+	// Name of the chosen shipping method and its fee
+	ShippingMethod string  `json:"shipping_method,omitempty"`
+	ShippingAmount float64 `json:"shipping_amount"`
+	// Grand total payable: Subtotal less DiscountAmount plus exclusive tax and shipping
+	TotalAmount float64 `json:"total_amount"`
+	// Paid back so far; RefundStatus is partial or full once anything is
+	RefundedAmount float64    `json:"refunded_amount"`
+	RefundStatus   string     `json:"refund_status,omitempty"`
+	Status         string     `json:"status"`
+	CreatedAt      time.Time  `json:"created_at"`
+	CancelReason   *string    `json:"cancel_reason,omitempty"`
+	CancelledAt    *time.Time `json:"cancelled_at,omitempty"`
+	// Only filled in for admins
+	Customer   *OrderCustomer      `json:"customer,omitempty"`
+	OrderItems []OrderItem         `json:"order_items,omitempty"`
+	Discounts  []OrderDiscount     `json:"discounts,omitempty"`
+	History    []OrderStatusChange `json:"history,omitempty"`
 }
 
 type OrderItem struct {
 	ID         uint    `json:"id"`
 	OrderID    uint    `json:"order_id"`
 	ProductID  uint    `json:"product_id"`
+	VariantID  *uint   `json:"variant_id,omitempty"`
 	Quantity   int     `json:"quantity"`
 	UnitPrice  float64 `json:"unit_price"`
 	TotalPrice float64 `json:"total_price"`
-	Product    Product `json:"product"`
+	// Share of the order discounts allocated to this line
+	DiscountAmount float64 `json:"discount_amount"`
+	// Tax charged on the line after its discount, at the rate in effect when ordered
+	TaxClass     string  `json:"tax_class"`
+	TaxRate      float64 `json:"tax_rate"`
+	TaxAmount    float64 `json:"tax_amount"`
+	TaxInclusive bool    `json:"tax_inclusive"`
+	// Purchase rate at the time of sale, kept for margin reports and not shown to customers
+	UnitCost    float64               `json:"-"`
+	Allocations []OrderItemAllocation `json:"allocations,omitempty"`
+	Product     Product               `json:"product"`
+}
+
+type OrderItemRequest struct {
+	ProductID uint  `json:"product_id" binding:"required"`
+	VariantID *uint `json:"variant_id"`
+	Quantity  int   `json:"quantity" binding:"required,min=1"`
 }
 
 type CreateOrderRequest struct {
-	Items []struct {
-		ProductID uint `json:"product_id" binding:"required"`
-		Quantity  int  `json:"quantity" binding:"required,min=1"`
-	} `json:"items" binding:"required,min=1"`
+	Items      []OrderItemRequest `json:"items" binding:"required,min=1"`
+	CouponCode string             `json:"coupon_code"`
+	// Region the order is delivered to, such as a country or state code. It
+	// picks the tax rates and is needed to ship with ShippingMethod.
+	Region         string `json:"region" binding:"max=50"`
+	ShippingMethod string `json:"shipping_method" binding:"max=50"`
+	// Reservation made during checkout; its held stock is used for this order
+	ReservationID *uint `json:"reservation_id"`
+	// Warehouse allocation strategy; nearest needs the delivery coordinates
+	Allocation string   `json:"allocation" binding:"omitempty,oneof=nearest most_stock"`
+	Latitude   *float64 `json:"latitude" binding:"omitempty,min=-90,max=90"`
+	Longitude  *float64 `json:"longitude" binding:"omitempty,min=-180,max=180"`
+}
+
+// FromStatus is empty for the entry written when the order is placed
+type OrderStatusChange struct {
+	ID         uint      `json:"id"`
+	OrderID    uint      `json:"order_id"`
+	FromStatus string    `json:"from_status,omitempty"`
+	ToStatus   string    `json:"to_status"`
+	Note       string    `json:"note,omitempty"`
+	UserID     *uint     `json:"user_id"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type OrderTransitionRequest struct {
+	Status string `json:"status" binding:"required"`
+	Note   string `json:"note" binding:"max=255"`
+}
+
+type CancelOrderRequest struct {
+	Reason string `json:"reason" binding:"required,max=255"`
+}
+
+// Who placed an order
+type OrderCustomer struct {
+	ID    uint   `json:"id"`
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// Move many orders to one status. Each order is changed on its own, so one
+// that cannot make the move does not hold back the rest.
+type BulkOrderStatusRequest struct {
+	OrderIDs []uint `json:"order_ids" binding:"required,min=1,max=500"`
+	Status   string `json:"status" binding:"required,oneof=pending paid processing shipped delivered cancelled"`
+	Note     string `json:"note" binding:"max=255"`
+}
+
+type BulkOrderStatusResult struct {
+	OrderID uint   `json:"order_id"`
+	From    string `json:"from,omitempty"`
+	Status  string `json:"status,omitempty"`
+	Error   string `json:"error,omitempty"`
 }
@@ -0,0 +1,61 @@
+package models
+
+import "time"
+
+// Payment statuses follow the provider's intent status until the payment
+// is refunded in full
+const (
+	PaymentRequiresCapture = "requires_capture"
+	PaymentProcessing      = "processing"
+	PaymentSucceeded       = "succeeded"
+	PaymentFailed          = "failed"
+	PaymentRefunded        = "refunded"
+)
+
+type Payment struct {
+	ID             uint            `json:"id"`
+	OrderID        uint            `json:"order_id"`
+	Provider       string          `json:"provider"`
+	ProviderRef    string          `json:"provider_ref"`
+	Amount         float64         `json:"amount"`
+	RefundedAmount float64         `json:"refunded_amount"`
+	Status         string          `json:"status"`
+	FailureReason  string          `json:"failure_reason,omitempty"`
+	Refunds        []PaymentRefund `json:"refunds,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	UpdatedAt      time.Time       `json:"updated_at"`
+}
+
+// Refunds are recorded as pending and sent to the provider afterwards. One
+// the provider keeps refusing is failed until an admin retries it.
+const (
+	RefundPending   = "pending"
+	RefundSucceeded = "succeeded"
+	RefundFailed    = "failed"
+)
+
+type PaymentRefund struct {
+	ID            uint      `json:"id"`
+	PaymentID     uint      `json:"payment_id"`
+	OrderID       uint      `json:"order_id,omitempty"`
+	ProviderRef   string    `json:"provider_ref,omitempty"`
+	Amount        float64   `json:"amount"`
+	Reason        string    `json:"reason,omitempty"`
+	Status        string    `json:"status"`
+	Attempts      int       `json:"attempts"`
+	FailureReason string    `json:"failure_reason,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// Method is passed to the provider as is; the mock provider takes
+// mock_success, mock_failure or mock_delayed
+type CreatePaymentRequest struct {
+	Method string `json:"method"`
+}
+
+// Amount defaults to everything not yet refunded
+type RefundPaymentRequest struct {
+	Amount *float64 `json:"amount" binding:"omitempty,gt=0"`
+	Reason string   `json:"reason" binding:"max=255"`
+}
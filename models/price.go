@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+// A price entry takes effect at StartsAt and lasts until EndsAt or until a later
+// entry starts. Nil rates leave the previous value of that rate in effect.
+type ProductPrice struct {
+	ID           uint       `json:"id"`
+	ProductID    uint       `json:"product_id"`
+	Price        float64    `json:"price"`
+	SalesRate    *float64   `json:"sales_rate"`
+	PurchaseRate *float64   `json:"purchase_rate"`
+	StartsAt     time.Time  `json:"starts_at"`
+	EndsAt       *time.Time `json:"ends_at"`
+	Status       string     `json:"status"`
+	CreatedBy    *uint      `json:"created_by"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+type SchedulePriceRequest struct {
+	Price        float64    `json:"price" binding:"required,gt=0"`
+	SalesRate    *float64   `json:"sales_rate" binding:"omitempty,gte=0"`
+	PurchaseRate *float64   `json:"purchase_rate" binding:"omitempty,gte=0"`
+	StartsAt     time.Time  `json:"starts_at" binding:"required"`
+	EndsAt       *time.Time `json:"ends_at"`
+}
@@ -1,11 +1,56 @@
 package models
 
+import "time"
+
 type Product struct {
-	ID           uint    `json:"id"`
-	Name         string  `json:"name"`
-	Price        float64 `json:"price"`
-	Quantity     int     `json:"quantity"`
+	ID       uint    `json:"id"`
+	Name     string  `json:"name"`
+	SKU      string  `json:"sku"`
+	Category string  `json:"category"`
+	Price    float64 `json:"price"`
+	Quantity int     `json:"quantity"`
+	// Units held by checkout reservations and the on-hand quantity left after them
+	Reserved     int     `json:"reserved"`
+	Available    int     `json:"available"`
 	Image        string  `json:"image"`
 	SalesRate    float64 `json:"sales_rate"`
 	PurchaseRate float64 `json:"purchase_rate"`
+	// Picks the tax rates that apply to the product, standard when empty
+	TaxClass string `json:"tax_class"`
+	// Shipping weight in kg and dimensions in cm, nil when not known
+	Weight *float64 `json:"weight"`
+	Length *float64 `json:"length"`
+	Width  *float64 `json:"width"`
+	Height *float64 `json:"height"`
+	// Stock level at or below which a reorder alert is raised, nil when not tracked
+	ReorderPoint    *int `json:"reorder_point"`
+	ReorderQuantity *int `json:"reorder_quantity"`
+	// Set when the product is archived; archived products are kept for order history
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// Incremented on every write, exposed as the ETag for optimistic concurrency
+	Version int `json:"version"`
+	// Aggregated from approved reviews
+	RatingAverage float64          `json:"rating_average"`
+	RatingCount   int              `json:"rating_count"`
+	Options       []ProductOption  `json:"options,omitempty"`
+	Variants      []ProductVariant `json:"variants,omitempty"`
+}
+
+// Fields of a product that PATCH /products/:id can change
+type ProductPatch struct {
+	Name            string   `json:"name"`
+	SKU             string   `json:"sku"`
+	Category        string   `json:"category"`
+	Price           float64  `json:"price"`
+	Quantity        int      `json:"quantity"`
+	Image           string   `json:"image"`
+	SalesRate       float64  `json:"sales_rate"`
+	PurchaseRate    float64  `json:"purchase_rate"`
+	TaxClass        string   `json:"tax_class"`
+	Weight          *float64 `json:"weight"`
+	Length          *float64 `json:"length"`
+	Width           *float64 `json:"width"`
+	Height          *float64 `json:"height"`
+	ReorderPoint    *int     `json:"reorder_point"`
+	ReorderQuantity *int     `json:"reorder_quantity"`
 }
@@ -0,0 +1,59 @@
+package models
+
+import "time"
+
+// Kinds of discount a promotion gives
+const (
+	PromotionPercentage = "percentage"
+	PromotionFixed      = "fixed"
+	PromotionBuyXGetY   = "buy_x_get_y"
+)
+
+// A promotion with a Code is a coupon the customer enters at checkout; one
+// without is applied automatically to every order it qualifies for. Scoped
+// promotions only discount items in ProductIDs or Categories.
+type Promotion struct {
+	ID           uint       `json:"id"`
+	Code         *string    `json:"code"`
+	Name         string     `json:"name"`
+	Type         string     `json:"type"`
+	Value        float64    `json:"value"`
+	BuyQuantity  *int       `json:"buy_quantity"`
+	GetQuantity  *int       `json:"get_quantity"`
+	MinSpend     *float64   `json:"min_spend"`
+	UsageLimit   *int       `json:"usage_limit"`
+	PerUserLimit *int       `json:"per_user_limit"`
+	UsedCount    int        `json:"used_count"`
+	StartsAt     *time.Time `json:"starts_at"`
+	EndsAt       *time.Time `json:"ends_at"`
+	Active       bool       `json:"active"`
+	ProductIDs   []uint     `json:"product_ids"`
+	Categories   []string   `json:"categories"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+type PromotionRequest struct {
+	Code         *string    `json:"code" binding:"omitempty,min=1,max=50"`
+	Name         string     `json:"name" binding:"required,max=255"`
+	Type         string     `json:"type" binding:"required,oneof=percentage fixed buy_x_get_y"`
+	Value        float64    `json:"value" binding:"gte=0"`
+	BuyQuantity  *int       `json:"buy_quantity" binding:"omitempty,min=1"`
+	GetQuantity  *int       `json:"get_quantity" binding:"omitempty,min=1"`
+	MinSpend     *float64   `json:"min_spend" binding:"omitempty,gte=0"`
+	UsageLimit   *int       `json:"usage_limit" binding:"omitempty,min=1"`
+	PerUserLimit *int       `json:"per_user_limit" binding:"omitempty,min=1"`
+	StartsAt     *time.Time `json:"starts_at"`
+	EndsAt       *time.Time `json:"ends_at"`
+	Active       *bool      `json:"active"`
+	ProductIDs   []uint     `json:"product_ids"`
+	Categories   []string   `json:"categories"`
+}
+
+// A discount line stored against an order
+type OrderDiscount struct {
+	ID          uint    `json:"id"`
+	PromotionID uint    `json:"promotion_id"`
+	Code        string  `json:"code,omitempty"`
+	Description string  `json:"description"`
+	Amount      float64 `json:"amount"`
+}
@@ -0,0 +1,16 @@
+package models
+
+// One row of a margin report. Revenue is what the items sold for before
+// discounts, without any tax included in their prices; the margin is taken
+// on NetRevenue, after discounts.
+type MarginRow struct {
+	Key           string  `json:"key"`
+	Label         string  `json:"label"`
+	QuantitySold  int     `json:"quantity_sold"`
+	Revenue       float64 `json:"revenue"`
+	Discounts     float64 `json:"discounts"`
+	NetRevenue    float64 `json:"net_revenue"`
+	Cost          float64 `json:"cost"`
+	GrossMargin   float64 `json:"gross_margin"`
+	MarginPercent float64 `json:"margin_percent"`
+}
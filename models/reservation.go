@@ -0,0 +1,37 @@
+package models
+
+import "time"
+
+// Reservation states. Only active, unexpired reservations hold stock.
+const (
+	ReservationActive   = "active"
+	ReservationConsumed = "consumed"
+	ReservationReleased = "released"
+	ReservationExpired  = "expired"
+)
+
+type Reservation struct {
+	ID        uint              `json:"id"`
+	UserID    uint              `json:"user_id"`
+	Status    string            `json:"status"`
+	ExpiresAt time.Time         `json:"expires_at"`
+	OrderID   *uint             `json:"order_id"`
+	Items     []ReservationItem `json:"items"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+type ReservationItem struct {
+	ProductID uint  `json:"product_id"`
+	VariantID *uint `json:"variant_id,omitempty"`
+	Quantity  int   `json:"quantity"`
+}
+
+type CreateReservationRequest struct {
+	Items []struct {
+		ProductID uint  `json:"product_id" binding:"required"`
+		VariantID *uint `json:"variant_id"`
+		Quantity  int   `json:"quantity" binding:"required,min=1"`
+	} `json:"items" binding:"required,min=1"`
+	// How long to hold the stock; defaults to the configured reservation TTL
+	Minutes int `json:"minutes" binding:"omitempty,min=1,max=120"`
+}
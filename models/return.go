@@ -0,0 +1,67 @@
+package models
+
+import "time"
+
+// Return states: requested → approved or rejected; approved → received, or
+// refunded when a refund was queued against the order's payments
+const (
+	ReturnRequested = "requested"
+	ReturnApproved  = "approved"
+	ReturnRejected  = "rejected"
+	ReturnReceived  = "received"
+	ReturnRefunded  = "refunded"
+)
+
+// Condition of returned goods when they arrive
+const (
+	ReturnResellable = "resellable"
+	ReturnDamaged    = "damaged"
+)
+
+type Return struct {
+	ID        uint   `json:"id"`
+	OrderID   uint   `json:"order_id"`
+	UserID    uint   `json:"user_id"`
+	Status    string `json:"status"`
+	Reason    string `json:"reason"`
+	AdminNote string `json:"admin_note,omitempty"`
+	// Worked out when the goods are received; RefundedAmount is what was paid back
+	RefundAmount   *float64     `json:"refund_amount"`
+	RefundedAmount float64      `json:"refunded_amount"`
+	Items          []ReturnItem `json:"items"`
+	CreatedAt      time.Time    `json:"created_at"`
+	UpdatedAt      time.Time    `json:"updated_at"`
+}
+
+type ReturnItem struct {
+	ID           uint     `json:"id"`
+	OrderItemID  uint     `json:"order_item_id"`
+	ProductID    uint     `json:"product_id"`
+	VariantID    *uint    `json:"variant_id,omitempty"`
+	Quantity     int      `json:"quantity"`
+	Reason       string   `json:"reason,omitempty"`
+	Condition    *string  `json:"condition"`
+	RefundAmount *float64 `json:"refund_amount"`
+}
+
+type CreateReturnRequest struct {
+	Reason string `json:"reason" binding:"required,max=255"`
+	Items  []struct {
+		OrderItemID uint   `json:"order_item_id" binding:"required"`
+		Quantity    int    `json:"quantity" binding:"required,min=1"`
+		Reason      string `json:"reason" binding:"max=255"`
+	} `json:"items" binding:"required,min=1,dive"`
+}
+
+type ReturnDecisionRequest struct {
+	Status string `json:"status" binding:"required,oneof=approved rejected"`
+	Note   string `json:"note" binding:"max=255"`
+}
+
+// Items left out are received as resellable
+type ReceiveReturnRequest struct {
+	Items []struct {
+		ReturnItemID uint   `json:"return_item_id" binding:"required"`
+		Condition    string `json:"condition" binding:"required,oneof=resellable damaged"`
+	} `json:"items" binding:"dive"`
+}
@@ -0,0 +1,32 @@
+package models
+
+import "time"
+
+// Moderation states of a review; only approved reviews are public
+const (
+	ReviewPending  = "pending"
+	ReviewApproved = "approved"
+	ReviewRejected = "rejected"
+)
+
+type Review struct {
+	ID             uint       `json:"id"`
+	ProductID      uint       `json:"product_id"`
+	UserID         uint       `json:"user_id"`
+	UserName       string     `json:"user_name"`
+	Rating         int        `json:"rating"`
+	Title          string     `json:"title"`
+	Body           string     `json:"body"`
+	Photos         []string   `json:"photos"`
+	Status         string     `json:"status"`
+	ModerationNote string     `json:"moderation_note,omitempty"`
+	ModeratedAt    *time.Time `json:"moderated_at,omitempty"`
+	HelpfulCount   int        `json:"helpful_count"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+type ModerateReviewRequest struct {
+	Status string `json:"status" binding:"required,oneof=pending approved rejected"`
+	Note   string `json:"note"`
+}
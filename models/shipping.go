@@ -0,0 +1,65 @@
+package models
+
+import "time"
+
+// A zone listing this region catches every region not listed by another zone
+const ShippingRegionDefault = "*"
+
+// Destination regions that share shipping rates. A region belongs to one zone.
+type ShippingZone struct {
+	ID        uint      `json:"id"`
+	Name      string    `json:"name"`
+	Regions   []string  `json:"regions"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ShippingZoneRequest struct {
+	Name    string   `json:"name" binding:"required,max=100"`
+	Regions []string `json:"regions" binding:"required,min=1,dive,required,max=50"`
+}
+
+// A shipping method customers choose at checkout by its Code. Inactive
+// methods are not offered but stay on the orders that used them.
+type ShippingMethod struct {
+	ID        uint           `json:"id"`
+	Code      string         `json:"code"`
+	Name      string         `json:"name"`
+	Active    bool           `json:"active"`
+	Rates     []ShippingRate `json:"rates"`
+	CreatedAt time.Time      `json:"created_at"`
+}
+
+// A rate applies to parcels sent to its zone whose chargeable weight (kg) and
+// value fall in its ranges. Minimums are inclusive, maximums exclusive and a
+// nil maximum has no limit. The fee is Fee plus FeePerKg for every kg.
+type ShippingRate struct {
+	ID        uint     `json:"id"`
+	ZoneID    uint     `json:"zone_id" binding:"required"`
+	MinWeight float64  `json:"min_weight" binding:"gte=0"`
+	MaxWeight *float64 `json:"max_weight" binding:"omitempty,gt=0"`
+	MinValue  float64  `json:"min_value" binding:"gte=0"`
+	MaxValue  *float64 `json:"max_value" binding:"omitempty,gt=0"`
+	Fee       float64  `json:"fee" binding:"gte=0"`
+	FeePerKg  float64  `json:"fee_per_kg" binding:"gte=0"`
+}
+
+type ShippingMethodRequest struct {
+	Code   string         `json:"code" binding:"required,max=50"`
+	Name   string         `json:"name" binding:"required,max=100"`
+	Active *bool          `json:"active"`
+	Rates  []ShippingRate `json:"rates" binding:"required,min=1,dive"`
+}
+
+// Items to quote, or the caller's cart when Items is empty
+type ShippingQuoteRequest struct {
+	Region string             `json:"region" binding:"required,max=50"`
+	Items  []OrderItemRequest `json:"items" binding:"dive"`
+}
+
+// What a shipping method would cost for a parcel
+type ShippingQuote struct {
+	MethodID uint    `json:"method_id"`
+	Code     string  `json:"code"`
+	Name     string  `json:"name"`
+	Fee      float64 `json:"fee"`
+}
@@ -0,0 +1,43 @@
+package models
+
+import "time"
+
+// Tax class of products that do not name one
+const DefaultTaxClass = "standard"
+
+// Region of the fallback rates, used when an order's region has no rate of
+// its own for a tax class
+const TaxRegionDefault = "*"
+
+// A tax rate for one region and product tax class. Rate is a percentage.
+// Inclusive rates are already part of the price; exclusive ones are added
+// on top of it.
+type TaxRate struct {
+	ID        uint      `json:"id"`
+	Region    string    `json:"region"`
+	TaxClass  string    `json:"tax_class"`
+	Name      string    `json:"name"`
+	Rate      float64   `json:"rate"`
+	Inclusive bool      `json:"inclusive"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type TaxRateRequest struct {
+	Region    string  `json:"region" binding:"required,max=50"`
+	TaxClass  string  `json:"tax_class" binding:"required,max=50"`
+	Name      string  `json:"name" binding:"required,max=100"`
+	Rate      float64 `json:"rate" binding:"gte=0,lte=100"`
+	Inclusive bool    `json:"inclusive"`
+}
+
+// One row of the tax summary. TaxableAmount is the net sales the tax was
+// charged on, without the tax itself.
+type TaxSummaryRow struct {
+	Region        string  `json:"region"`
+	TaxClass      string  `json:"tax_class"`
+	Rate          float64 `json:"rate"`
+	Inclusive     bool    `json:"inclusive"`
+	OrderCount    int     `json:"order_count"`
+	TaxableAmount float64 `json:"taxable_amount"`
+	TaxAmount     float64 `json:"tax_amount"`
+}
@@ -2,11 +2,18 @@ package models
 
 import "time"
 
+// Roles stored in users.role and carried in the JWT claims
+const (
+	RoleCustomer = "customer"
+	RoleAdmin    = "admin"
+)
+
 type User struct {
 	ID        uint      `json:"id"`
 	Name      string    `json:"name"`
 	Email     string    `json:"email"`
 	Password  string    `json:"password"`
+	Role      string    `json:"role"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
@@ -14,9 +21,19 @@ type User struct {
 type LoginRequest struct {
 	Email    string `json:"email" binding:"required,email"`
 	Password string `json:"password" binding:"required,min=8"`
+	// Token of a guest cart to merge into the user's cart
+	CartToken string `json:"cart_token"`
 }
 
 type AuthResponse struct {
 	Token string `json:"token"`
 	User  User   `json:"user"`
 }
+
+// Fields of a user that PATCH /users/:id can change. Password is write-only,
+// so it is absent from the current document and set with a merge patch or an "add" operation.
+type UserPatch struct {
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Password string `json:"password,omitempty"`
+}
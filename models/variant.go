@@ -0,0 +1,49 @@
+package models
+
+type ProductOption struct {
+	ID        uint                 `json:"id"`
+	ProductID uint                 `json:"product_id"`
+	Name      string               `json:"name"`
+	Values    []ProductOptionValue `json:"values"`
+}
+
+type ProductOptionValue struct {
+	ID       uint   `json:"id"`
+	OptionID uint   `json:"option_id"`
+	Value    string `json:"value"`
+}
+
+// Price is nil when the variant sells at the parent product price
+type ProductVariant struct {
+	ID        uint                 `json:"id"`
+	ProductID uint                 `json:"product_id"`
+	SKU       string               `json:"sku"`
+	Barcode   string               `json:"barcode"`
+	Price     *float64             `json:"price"`
+	Quantity  int                  `json:"quantity"`
+	Reserved  int                  `json:"reserved"`
+	Available int                  `json:"available"`
+	Options   []ProductOptionValue `json:"options"`
+}
+
+type CreateOptionRequest struct {
+	Name   string   `json:"name" binding:"required"`
+	Values []string `json:"values" binding:"required,min=1"`
+}
+
+type VariantRequest struct {
+	SKU            string   `json:"sku" binding:"required"`
+	Barcode        string   `json:"barcode"`
+	Price          *float64 `json:"price" binding:"omitempty,min=0"`
+	Quantity       int      `json:"quantity" binding:"min=0"`
+	OptionValueIDs []uint   `json:"option_value_ids"`
+}
+
+// The fields of a variant that a patch can change
+type VariantPatch struct {
+	SKU            string   `json:"sku"`
+	Barcode        string   `json:"barcode"`
+	Price          *float64 `json:"price"`
+	Quantity       int      `json:"quantity"`
+	OptionValueIDs []uint   `json:"option_value_ids"`
+}
@@ -0,0 +1,77 @@
+package models
+
+import "time"
+
+// How CreateOrder picks the warehouses an item ships from
+const (
+	AllocateMostStock = "most_stock"
+	AllocateNearest   = "nearest"
+)
+
+type Warehouse struct {
+	ID        uint      `json:"id"`
+	Code      string    `json:"code"`
+	Name      string    `json:"name"`
+	Address   string    `json:"address"`
+	Latitude  *float64  `json:"latitude"`
+	Longitude *float64  `json:"longitude"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type WarehouseRequest struct {
+	Code      string   `json:"code" binding:"required,max=50"`
+	Name      string   `json:"name" binding:"required,max=255"`
+	Address   string   `json:"address"`
+	Latitude  *float64 `json:"latitude" binding:"omitempty,min=-90,max=90"`
+	Longitude *float64 `json:"longitude" binding:"omitempty,min=-180,max=180"`
+	Active    *bool    `json:"active"`
+}
+
+type WarehouseStock struct {
+	WarehouseID   uint   `json:"warehouse_id"`
+	WarehouseCode string `json:"warehouse_code"`
+	ProductID     uint   `json:"product_id"`
+	ProductName   string `json:"product_name"`
+	VariantID     *uint  `json:"variant_id,omitempty"`
+	Quantity      int    `json:"quantity"`
+}
+
+// Stock of a product or variant split by location. Unassigned is the part of
+// the total that is not held at any warehouse.
+type StockLocations struct {
+	ProductID  uint             `json:"product_id"`
+	VariantID  *uint            `json:"variant_id,omitempty"`
+	Total      int              `json:"total"`
+	Unassigned int              `json:"unassigned"`
+	Locations  []WarehouseStock `json:"locations"`
+}
+
+// A nil warehouse on either side stands for the unassigned stock
+type StockTransfer struct {
+	ID              uint      `json:"id"`
+	ProductID       uint      `json:"product_id"`
+	VariantID       *uint     `json:"variant_id,omitempty"`
+	FromWarehouseID *uint     `json:"from_warehouse_id"`
+	ToWarehouseID   *uint     `json:"to_warehouse_id"`
+	Quantity        int       `json:"quantity"`
+	UserID          *uint     `json:"user_id"`
+	Note            string    `json:"note"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+type CreateTransferRequest struct {
+	ProductID       uint   `json:"product_id" binding:"required"`
+	VariantID       *uint  `json:"variant_id"`
+	FromWarehouseID *uint  `json:"from_warehouse_id"`
+	ToWarehouseID   *uint  `json:"to_warehouse_id"`
+	Quantity        int    `json:"quantity" binding:"required,min=1"`
+	Note            string `json:"note"`
+}
+
+// Units of an order item taken from one warehouse, or from unassigned stock
+// when WarehouseID is nil
+type OrderItemAllocation struct {
+	WarehouseID *uint `json:"warehouse_id"`
+	Quantity    int   `json:"quantity"`
+}
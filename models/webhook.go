@@ -0,0 +1,65 @@
+package models
+
+import "time"
+
+// Events sent to webhook subscribers. A subscription to * gets all of them.
+const (
+	EventOrderCreated        = "order.created"
+	EventOrderStatusChanged  = "order.status_changed"
+	EventProductCreated      = "product.created"
+	EventProductUpdated      = "product.updated"
+	EventProductDeleted      = "product.deleted"
+	EventProductRestored     = "product.restored"
+	EventProductStockChanged = "product.stock_changed"
+	EventAll                 = "*"
+)
+
+// Delivery statuses. Deliveries that fail every attempt are dead and are
+// only sent again when redelivered by hand.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+// Secret is only shown when the subscription is created
+type WebhookSubscription struct {
+	ID        uint      `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type WebhookSubscriptionRequest struct {
+	URL    string   `json:"url" binding:"required,url,max=500"`
+	Events []string `json:"events" binding:"required,min=1,dive,required"`
+	// Generated when empty
+	Secret string `json:"secret" binding:"omitempty,min=16,max=255"`
+	Active *bool  `json:"active"`
+}
+
+// One event sent to one subscription, with its attempts so far
+type WebhookDelivery struct {
+	ID             uint             `json:"id"`
+	SubscriptionID uint             `json:"subscription_id"`
+	EventID        string           `json:"event_id"`
+	EventType      string           `json:"event_type"`
+	Payload        string           `json:"payload"`
+	Status         string           `json:"status"`
+	Attempts       int              `json:"attempts"`
+	NextAttemptAt  *time.Time       `json:"next_attempt_at,omitempty"`
+	DeliveredAt    *time.Time       `json:"delivered_at,omitempty"`
+	CreatedAt      time.Time        `json:"created_at"`
+	Log            []WebhookAttempt `json:"log,omitempty"`
+}
+
+// A single try at sending a delivery. StatusCode is nil when no response came back.
+type WebhookAttempt struct {
+	ID         uint      `json:"id"`
+	StatusCode *int      `json:"status_code"`
+	Error      *string   `json:"error,omitempty"`
+	DurationMs int       `json:"duration_ms"`
+	CreatedAt  time.Time `json:"created_at"`
+}
@@ -15,6 +15,25 @@ func SetupRouter() *gin.Engine {
 	{
 		public.POST("/login", controllers.Login)
 		public.POST("/users", controllers.CreateUser)
+		//Signed by the payment provider instead of a user token
+		public.POST("/payments/webhook", controllers.PaymentWebhook)
+	}
+
+	//Cart routes work for guests with a cart token as well as for signed-in users
+	cart := r.Group("/api/cart")
+	cart.Use(controllers.OptionalAuthMiddleware())
+	{
+		cart.GET("/", controllers.GetCart)
+		cart.POST("/items", controllers.AddCartItem)
+		cart.PATCH("/items/:itemId", controllers.UpdateCartItem)
+		cart.DELETE("/items/:itemId", controllers.RemoveCartItem)
+	}
+
+	//Quotes work for a guest cart as well as for a signed-in user's cart or a list of items
+	shippingQuote := r.Group("/api/shipping")
+	shippingQuote.Use(controllers.OptionalAuthMiddleware())
+	{
+		shippingQuote.POST("/quote", controllers.GetShippingQuote)
 	}
 
 	//Protected Route only accessible with the jwt token
@@ -32,10 +51,89 @@ func SetupRouter() *gin.Engine {
 		{
 			products.GET("/", controllers.GetProducts)
 			products.GET("/search", controllers.SearchProducts)
+			products.GET("/export", controllers.ExportProducts)
+			products.POST("/import", controllers.AdminMiddleware(), controllers.ImportProducts)
+			products.GET("/import/:jobId", controllers.GetImportJob)
 			products.GET("/:id", controllers.GetProductByID)
-			products.POST("/", controllers.CreateProduct)
-			products.PATCH("/:id", controllers.UpdateProduct)
-			products.DELETE("/:id", controllers.DeleteProduct)
+			products.POST("/", controllers.AdminMiddleware(), controllers.CreateProduct)
+			products.PATCH("/:id", controllers.AdminMiddleware(), controllers.UpdateProduct)
+			products.DELETE("/:id", controllers.AdminMiddleware(), controllers.DeleteProduct)
+			products.POST("/:id/restore", controllers.AdminMiddleware(), controllers.RestoreProduct)
+			products.PUT("/:id/reorder", controllers.AdminMiddleware(), controllers.UpdateReorderSettings)
+			products.GET("/:id/prices", controllers.GetProductPrices)
+			products.POST("/:id/prices", controllers.AdminMiddleware(), controllers.SchedulePrice)
+			products.DELETE("/:id/prices/:priceId", controllers.AdminMiddleware(), controllers.CancelScheduledPrice)
+			products.GET("/:id/options", controllers.GetProductOptions)
+			products.POST("/:id/options", controllers.AdminMiddleware(), controllers.CreateProductOption)
+			products.GET("/:id/variants", controllers.GetProductVariants)
+			products.POST("/:id/variants", controllers.AdminMiddleware(), controllers.CreateProductVariant)
+			products.PATCH("/:id/variants/:variantId", controllers.AdminMiddleware(), controllers.UpdateProductVariant)
+			products.DELETE("/:id/variants/:variantId", controllers.AdminMiddleware(), controllers.DeleteProductVariant)
+			products.GET("/:id/reviews", controllers.GetProductReviews)
+			products.POST("/:id/reviews", controllers.CreateProductReview)
+		}
+
+		reviews := protected.Group("/reviews")
+		{
+			reviews.PUT("/:id/moderation", controllers.AdminMiddleware(), controllers.ModerateReview)
+			reviews.DELETE("/:id", controllers.DeleteReview)
+			reviews.POST("/:id/helpful", controllers.VoteReviewHelpful)
+			reviews.DELETE("/:id/helpful", controllers.RemoveReviewVote)
+		}
+
+		promotions := protected.Group("/promotions")
+		promotions.Use(controllers.AdminMiddleware())
+		{
+			promotions.GET("/", controllers.GetPromotions)
+			promotions.POST("/", controllers.CreatePromotion)
+			promotions.GET("/:id", controllers.GetPromotionByID)
+			promotions.PUT("/:id", controllers.UpdatePromotion)
+			promotions.DELETE("/:id", controllers.DeletePromotion)
+		}
+
+		reports := protected.Group("/reports")
+		reports.Use(controllers.AdminMiddleware())
+		{
+			reports.GET("/margins/products", controllers.GetProductMargins)
+			reports.GET("/margins/categories", controllers.GetCategoryMargins)
+			reports.GET("/margins/periods", controllers.GetPeriodMargins)
+			reports.GET("/tax", controllers.GetTaxSummary)
+		}
+
+		shipping := protected.Group("/shipping")
+		shipping.Use(controllers.AdminMiddleware())
+		{
+			shipping.GET("/zones", controllers.GetShippingZones)
+			shipping.POST("/zones", controllers.CreateShippingZone)
+			shipping.PUT("/zones/:id", controllers.UpdateShippingZone)
+			shipping.DELETE("/zones/:id", controllers.DeleteShippingZone)
+			shipping.GET("/methods", controllers.GetShippingMethods)
+			shipping.POST("/methods", controllers.CreateShippingMethod)
+			shipping.GET("/methods/:id", controllers.GetShippingMethod)
+			shipping.PUT("/methods/:id", controllers.UpdateShippingMethod)
+			shipping.DELETE("/methods/:id", controllers.DeleteShippingMethod)
+		}
+
+		webhooks := protected.Group("/webhooks")
+		webhooks.Use(controllers.AdminMiddleware())
+		{
+			webhooks.GET("/", controllers.GetWebhookSubscriptions)
+			webhooks.POST("/", controllers.CreateWebhookSubscription)
+			webhooks.GET("/deliveries", controllers.GetWebhookDeliveries)
+			webhooks.GET("/deliveries/:id", controllers.GetWebhookDelivery)
+			webhooks.POST("/deliveries/:id/redeliver", controllers.RedeliverWebhook)
+			webhooks.GET("/:id", controllers.GetWebhookSubscription)
+			webhooks.PUT("/:id", controllers.UpdateWebhookSubscription)
+			webhooks.DELETE("/:id", controllers.DeleteWebhookSubscription)
+		}
+
+		taxRates := protected.Group("/tax-rates")
+		taxRates.Use(controllers.AdminMiddleware())
+		{
+			taxRates.GET("/", controllers.GetTaxRates)
+			taxRates.POST("/", controllers.CreateTaxRate)
+			taxRates.PUT("/:id", controllers.UpdateTaxRate)
+			taxRates.DELETE("/:id", controllers.DeleteTaxRate)
 		}
 
 		venues := protected.Group("/venues")
@@ -43,11 +141,60 @@ func SetupRouter() *gin.Engine {
 			venues.GET("/", controllers.GetVenues)
 			venues.POST("/", controllers.CreateVenue)
 		}
+		warehouses := protected.Group("/warehouses")
+		{
+			warehouses.GET("/", controllers.GetWarehouses)
+			warehouses.POST("/", controllers.AdminMiddleware(), controllers.CreateWarehouse)
+			warehouses.GET("/transfers", controllers.GetStockTransfers)
+			warehouses.POST("/transfers", controllers.AdminMiddleware(), controllers.CreateStockTransfer)
+			warehouses.PUT("/:id", controllers.AdminMiddleware(), controllers.UpdateWarehouse)
+			warehouses.GET("/:id/stock", controllers.GetWarehouseStock)
+		}
+		inventory := protected.Group("/inventory")
+		{
+			inventory.GET("/movements", controllers.GetInventoryMovements)
+			inventory.POST("/movements", controllers.AdminMiddleware(), controllers.CreateInventoryMovement)
+			inventory.GET("/products/:id/stock", controllers.GetStockAt)
+			inventory.GET("/products/:id/locations", controllers.GetStockLocations)
+			inventory.GET("/alerts", controllers.GetStockAlerts)
+		}
+		reservations := protected.Group("/reservations")
+		{
+			reservations.POST("/", controllers.CreateReservation)
+			reservations.GET("/:id", controllers.GetReservation)
+			reservations.DELETE("/:id", controllers.ReleaseReservation)
+		}
+		protected.POST("/payments/:id/refund", controllers.AdminMiddleware(), controllers.RefundPayment)
+		protected.GET("/payments/refunds", controllers.AdminMiddleware(), controllers.GetRefunds)
+		protected.POST("/payments/refunds/:id/retry", controllers.AdminMiddleware(), controllers.RetryRefund)
+		returns := protected.Group("/returns")
+		{
+			returns.GET("/", controllers.AdminMiddleware(), controllers.GetReturns)
+			returns.GET("/:id", controllers.GetReturn)
+			returns.PUT("/:id/decision", controllers.AdminMiddleware(), controllers.DecideReturn)
+			returns.POST("/:id/receive", controllers.AdminMiddleware(), controllers.ReceiveReturn)
+		}
+		protected.POST("/cart/checkout", controllers.CheckoutCart)
 		orders := protected.Group("/orders")
 		{
 			orders.POST("/", controllers.CreateOrder)
 			orders.GET("/", controllers.GetUserOrders)
 			orders.GET("/:id", controllers.GetOrderByID)
+			orders.GET("/:id/history", controllers.GetOrderHistory)
+			orders.POST("/:id/transitions", controllers.CreateOrderTransition)
+			orders.POST("/:id/cancel", controllers.CancelOrder)
+			orders.GET("/:id/payments", controllers.GetOrderPayments)
+			orders.GET("/:id/invoice.pdf", controllers.GetOrderInvoice)
+			orders.GET("/:id/returns", controllers.GetOrderReturns)
+			orders.POST("/:id/returns", controllers.CreateReturn)
+			orders.POST("/:id/payments", controllers.CreatePayment)
+		}
+		adminOrders := protected.Group("/admin/orders")
+		adminOrders.Use(controllers.AdminMiddleware())
+		{
+			adminOrders.GET("/", controllers.GetAdminOrders)
+			adminOrders.GET("/:id", controllers.GetOrderByID)
+			adminOrders.POST("/bulk-status", controllers.BulkUpdateOrderStatus)
 		}
 	}
 
@@ -0,0 +1,307 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrInvalidPatch means the patch document itself is malformed
+	ErrInvalidPatch = errors.New("invalid patch document")
+	// ErrPatchTestFailed means a JSON Patch "test" operation did not match
+	ErrPatchTestFailed = errors.New("patch test operation failed")
+)
+
+// MergePatch applies an RFC 7396 JSON Merge Patch to a JSON document
+func MergePatch(document, patch []byte) ([]byte, error) {
+	var target, changes interface{}
+	if err := json.Unmarshal(document, &target); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(patch, &changes); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+	}
+	return json.Marshal(mergeValue(target, changes))
+}
+
+func mergeValue(target, patch interface{}) interface{} {
+	changes, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	result, ok := target.(map[string]interface{})
+	if !ok {
+		result = map[string]interface{}{}
+	}
+	for key, value := range changes {
+		if value == nil {
+			delete(result, key)
+		} else {
+			result[key] = mergeValue(result[key], value)
+		}
+	}
+	return result
+}
+
+type patchOperation struct {
+	Op    string           `json:"op"`
+	Path  *string          `json:"path"`
+	From  *string          `json:"from"`
+	Value *json.RawMessage `json:"value"`
+}
+
+// ApplyJSONPatch applies an RFC 6902 JSON Patch to a JSON document. The
+// operations are applied in order and the whole patch fails if any one does.
+func ApplyJSONPatch(document, patch []byte) ([]byte, error) {
+	var doc interface{}
+	if err := json.Unmarshal(document, &doc); err != nil {
+		return nil, err
+	}
+
+	var operations []patchOperation
+	if err := json.Unmarshal(patch, &operations); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+	}
+
+	for i, op := range operations {
+		if op.Path == nil {
+			return nil, fmt.Errorf("%w: operation %d has no path", ErrInvalidPatch, i)
+		}
+		path, err := parsePointer(*op.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		var value interface{}
+		switch op.Op {
+		case "add", "replace", "test":
+			if op.Value == nil {
+				return nil, fmt.Errorf("%w: operation %d (%s) has no value", ErrInvalidPatch, i, op.Op)
+			}
+			if err := json.Unmarshal(*op.Value, &value); err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+			}
+		}
+
+		var from []string
+		switch op.Op {
+		case "move", "copy":
+			if op.From == nil {
+				return nil, fmt.Errorf("%w: operation %d (%s) has no from", ErrInvalidPatch, i, op.Op)
+			}
+			if from, err = parsePointer(*op.From); err != nil {
+				return nil, err
+			}
+		}
+
+		switch op.Op {
+		case "add":
+			doc, err = addValue(doc, path, value, false)
+		case "replace":
+			doc, err = addValue(doc, path, value, true)
+		case "remove":
+			doc, _, err = removeValue(doc, path)
+		case "move":
+			if len(from) < len(path) && isPrefix(from, path) {
+				return nil, fmt.Errorf("%w: cannot move %s into itself", ErrInvalidPatch, *op.From)
+			}
+			var moved interface{}
+			if doc, moved, err = removeValue(doc, from); err == nil {
+				doc, err = addValue(doc, path, moved, false)
+			}
+		case "copy":
+			var copied interface{}
+			if copied, err = getValue(doc, from); err == nil {
+				copied, err = deepCopy(copied)
+				if err == nil {
+					doc, err = addValue(doc, path, copied, false)
+				}
+			}
+		case "test":
+			var current interface{}
+			if current, err = getValue(doc, path); err == nil && !reflect.DeepEqual(current, value) {
+				err = fmt.Errorf("%w: value at %s does not match", ErrPatchTestFailed, *op.Path)
+			}
+		default:
+			return nil, fmt.Errorf("%w: unknown operation %q", ErrInvalidPatch, op.Op)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(doc)
+}
+
+// Split a JSON Pointer (RFC 6901) into its unescaped reference tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("%w: path %q must start with /", ErrInvalidPatch, pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func isPrefix(prefix, path []string) bool {
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func arrayIndex(token string, length int, allowEnd bool) (int, error) {
+	if allowEnd && token == "-" {
+		return length, nil
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	max := length - 1
+	if allowEnd {
+		max = length
+	}
+	if index > max {
+		return 0, fmt.Errorf("array index %d out of range", index)
+	}
+	return index, nil
+}
+
+func getValue(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("path member %q does not exist", token)
+			}
+			doc = value
+		case []interface{}:
+			index, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[index]
+		default:
+			return nil, fmt.Errorf("cannot descend into %q", token)
+		}
+	}
+	return doc, nil
+}
+
+// Add (or with replace, overwrite an existing) value and return the new document
+func addValue(doc interface{}, path []string, value interface{}, replace bool) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	token, last := path[0], len(path) == 1
+
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		child, exists := node[token]
+		if last {
+			if replace && !exists {
+				return nil, fmt.Errorf("path member %q does not exist", token)
+			}
+			node[token] = value
+			return node, nil
+		}
+		if !exists {
+			return nil, fmt.Errorf("path member %q does not exist", token)
+		}
+		updated, err := addValue(child, path[1:], value, replace)
+		if err != nil {
+			return nil, err
+		}
+		node[token] = updated
+		return node, nil
+	case []interface{}:
+		index, err := arrayIndex(token, len(node), last && !replace)
+		if err != nil {
+			return nil, err
+		}
+		if last {
+			if replace {
+				node[index] = value
+				return node, nil
+			}
+			node = append(node, nil)
+			copy(node[index+1:], node[index:])
+			node[index] = value
+			return node, nil
+		}
+		updated, err := addValue(node[index], path[1:], value, replace)
+		if err != nil {
+			return nil, err
+		}
+		node[index] = updated
+		return node, nil
+	default:
+		return nil, fmt.Errorf("cannot descend into %q", token)
+	}
+}
+
+// Remove a value and return the new document together with the removed value
+func removeValue(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, errors.New("cannot remove the whole document")
+	}
+	token, last := path[0], len(path) == 1
+
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		child, exists := node[token]
+		if !exists {
+			return nil, nil, fmt.Errorf("path member %q does not exist", token)
+		}
+		if last {
+			delete(node, token)
+			return node, child, nil
+		}
+		updated, removed, err := removeValue(child, path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		node[token] = updated
+		return node, removed, nil
+	case []interface{}:
+		index, err := arrayIndex(token, len(node), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		if last {
+			removed := node[index]
+			return append(node[:index], node[index+1:]...), removed, nil
+		}
+		updated, removed, err := removeValue(node[index], path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		node[index] = updated
+		return node, removed, nil
+	default:
+		return nil, nil, fmt.Errorf("cannot descend into %q", token)
+	}
+}
+
+func deepCopy(value interface{}) (interface{}, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var copied interface{}
+	err = json.Unmarshal(data, &copied)
+	return copied, err
+}
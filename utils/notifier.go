@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// Notifier delivers a short message with a JSON serialisable payload to whoever needs to act on it
+type Notifier interface {
+	Notify(subject string, payload interface{}) error
+}
+
+// LogNotifier writes notifications to the application log
+type LogNotifier struct{}
+
+func (LogNotifier) Notify(subject string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	log.Printf("%s: %s", subject, body)
+	return nil
+}
+
+// WebhookNotifier posts the subject and payload as JSON to a URL
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+func (n WebhookNotifier) Notify(subject string, payload interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"subject": subject,
+		"data":    payload,
+	})
+	if err != nil {
+		return err
+	}
+
+	client := n.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Post(n.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// EmailNotifier sends a plain text email through an SMTP server
+type EmailNotifier struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+	To       []string
+}
+
+func (n EmailNotifier) Notify(subject string, payload interface{}) error {
+	body, err := json.MarshalIndent(payload, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	message := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
+		n.From, strings.Join(n.To, ", "), subject, body)
+
+	var auth smtp.Auth
+	if n.Username != "" {
+		auth = smtp.PlainAuth("", n.Username, n.Password, n.Host)
+	}
+	return smtp.SendMail(n.Host+":"+n.Port, auth, n.From, n.To, []byte(message))
+}
+
+// NewNotifierFromEnv builds a notifier from <prefix>_NOTIFIER (log, webhook or email).
+// Webhooks read <prefix>_WEBHOOK_URL; email reads the SMTP_* settings and
+// <prefix>_EMAIL_TO. Anything missing falls back to the log notifier.
+func NewNotifierFromEnv(prefix string) Notifier {
+	switch os.Getenv(prefix + "_NOTIFIER") {
+	case "webhook":
+		if url := os.Getenv(prefix + "_WEBHOOK_URL"); url != "" {
+			return WebhookNotifier{URL: url}
+		}
+		log.Printf("%s_WEBHOOK_URL is not set, falling back to log notifications", prefix)
+	case "email":
+		to := os.Getenv(prefix + "_EMAIL_TO")
+		if os.Getenv("SMTP_HOST") != "" && to != "" {
+			port := os.Getenv("SMTP_PORT")
+			if port == "" {
+				port = "587"
+			}
+			return EmailNotifier{
+				Host:     os.Getenv("SMTP_HOST"),
+				Port:     port,
+				Username: os.Getenv("SMTP_USER"),
+				Password: os.Getenv("SMTP_PASSWORD"),
+				From:     os.Getenv("SMTP_FROM"),
+				To:       strings.Split(to, ","),
+			}
+		}
+		log.Printf("SMTP_HOST or %s_EMAIL_TO is not set, falling back to log notifications", prefix)
+	}
+	return LogNotifier{}
+}
@@ -0,0 +1,233 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Statuses a provider reports for a payment intent
+const (
+	IntentRequiresCapture = "requires_capture"
+	IntentProcessing      = "processing"
+	IntentSucceeded       = "succeeded"
+	IntentFailed          = "failed"
+)
+
+// Webhook event types
+const (
+	EventPaymentSucceeded = "payment.succeeded"
+	EventPaymentFailed    = "payment.failed"
+)
+
+// ErrInvalidSignature means a webhook did not come from the provider
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// PaymentIntent is the provider's view of a payment
+type PaymentIntent struct {
+	ID     string
+	Status string
+	// Reason given by the provider when Status is failed
+	FailureReason string
+}
+
+// PaymentEvent is a verified webhook sent by a provider
+type PaymentEvent struct {
+	ID            string  `json:"id"`
+	Type          string  `json:"type"`
+	IntentID      string  `json:"intent_id"`
+	Amount        float64 `json:"amount"`
+	FailureReason string  `json:"failure_reason,omitempty"`
+}
+
+// PaymentProvider takes payments through an outside gateway. Amounts are in
+// the store currency; reference names the order the payment is for.
+type PaymentProvider interface {
+	Name() string
+	CreateIntent(amount float64, reference, method string) (PaymentIntent, error)
+	Capture(intentID string, amount float64) (PaymentIntent, error)
+	// Refund returns the provider's reference for the refund. Calls with the
+	// same key are one refund, so a retry cannot pay it back twice.
+	Refund(intentID string, amount float64, key string) (string, error)
+	// VerifyWebhook checks the signature of a webhook and parses its event
+	VerifyWebhook(body []byte, header http.Header) (PaymentEvent, error)
+}
+
+// Payment methods understood by the mock provider
+const (
+	MockMethodSuccess = "mock_success"
+	MockMethodFailure = "mock_failure"
+	MockMethodDelayed = "mock_delayed"
+)
+
+const mockSignatureHeader = "X-Mock-Signature"
+
+// MockPaymentProvider settles payments without any outside service. The
+// method picks the outcome: mock_success settles at once, mock_failure is
+// declined and mock_delayed settles after SettlementDelay. Outcomes are sent
+// as signed webhooks to WebhookURL, like a real gateway would.
+type MockPaymentProvider struct {
+	Secret          string
+	WebhookURL      string
+	SettlementDelay time.Duration
+	Client          *http.Client
+}
+
+func (MockPaymentProvider) Name() string {
+	return "mock"
+}
+
+func mockID(prefix string) string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return prefix + hex.EncodeToString(buf)
+}
+
+// The mock keeps no state, so the outcome travels in the intent ID
+func (MockPaymentProvider) CreateIntent(amount float64, reference, method string) (PaymentIntent, error) {
+	if method == "" {
+		method = MockMethodSuccess
+	}
+	switch method {
+	case MockMethodSuccess, MockMethodFailure, MockMethodDelayed:
+	default:
+		return PaymentIntent{}, fmt.Errorf("unknown mock payment method %q", method)
+	}
+	if amount <= 0 {
+		return PaymentIntent{}, errors.New("amount must be greater than zero")
+	}
+	return PaymentIntent{ID: mockID("pi_" + method + "_"), Status: IntentRequiresCapture}, nil
+}
+
+func (p MockPaymentProvider) Capture(intentID string, amount float64) (PaymentIntent, error) {
+	intent := PaymentIntent{ID: intentID}
+	switch {
+	case strings.HasPrefix(intentID, "pi_"+MockMethodSuccess+"_"):
+		intent.Status = IntentSucceeded
+		p.send(0, PaymentEvent{Type: EventPaymentSucceeded, IntentID: intentID, Amount: amount})
+	case strings.HasPrefix(intentID, "pi_"+MockMethodDelayed+"_"):
+		intent.Status = IntentProcessing
+		p.send(p.SettlementDelay, PaymentEvent{Type: EventPaymentSucceeded, IntentID: intentID, Amount: amount})
+	case strings.HasPrefix(intentID, "pi_"+MockMethodFailure+"_"):
+		intent.Status = IntentFailed
+		intent.FailureReason = "card declined"
+		p.send(0, PaymentEvent{Type: EventPaymentFailed, IntentID: intentID, Amount: amount, FailureReason: intent.FailureReason})
+	default:
+		return intent, fmt.Errorf("unknown payment intent %q", intentID)
+	}
+	return intent, nil
+}
+
+// The reference comes from the key, so a retried refund gets the same one
+func (MockPaymentProvider) Refund(intentID string, amount float64, key string) (string, error) {
+	if strings.HasPrefix(intentID, "pi_"+MockMethodFailure+"_") {
+		return "", errors.New("payment was never captured")
+	}
+	sum := sha256.Sum256([]byte(intentID + "/" + key))
+	return "re_" + hex.EncodeToString(sum[:8]), nil
+}
+
+// Sign returns the signature the mock puts on a webhook body, for sending
+// hand-made events while testing
+func (p MockPaymentProvider) Sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(p.Secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (p MockPaymentProvider) VerifyWebhook(body []byte, header http.Header) (PaymentEvent, error) {
+	var event PaymentEvent
+	expected := p.Sign(body)
+	if !hmac.Equal([]byte(expected), []byte(header.Get(mockSignatureHeader))) {
+		return event, ErrInvalidSignature
+	}
+	err := json.Unmarshal(body, &event)
+	return event, err
+}
+
+// Post the event to the webhook URL after delay
+func (p MockPaymentProvider) send(delay time.Duration, event PaymentEvent) {
+	if p.WebhookURL == "" {
+		return
+	}
+	event.ID = mockID("evt_")
+
+	go func() {
+		time.Sleep(delay)
+
+		body, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("mock payment webhook %s failed: %v", event.ID, err)
+			return
+		}
+		req, err := http.NewRequest(http.MethodPost, p.WebhookURL, bytes.NewReader(body))
+		if err != nil {
+			log.Printf("mock payment webhook %s failed: %v", event.ID, err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(mockSignatureHeader, p.Sign(body))
+
+		client := p.Client
+		if client == nil {
+			client = &http.Client{Timeout: 10 * time.Second}
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Printf("mock payment webhook %s failed: %v", event.ID, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("mock payment webhook %s got status %d", event.ID, resp.StatusCode)
+		}
+	}()
+}
+
+// NewPaymentProviderFromEnv builds the provider named by PAYMENT_PROVIDER.
+// Only the mock is built in. It settles every payment, so it is refused
+// unless ALLOW_MOCK_PAYMENTS=true marks a development or test setup. It reads
+// MOCK_PAYMENT_SECRET, which is required, MOCK_PAYMENT_WEBHOOK_URL and
+// MOCK_PAYMENT_SETTLEMENT_DELAY.
+func NewPaymentProviderFromEnv() (PaymentProvider, error) {
+	switch provider := os.Getenv("PAYMENT_PROVIDER"); provider {
+	case "mock":
+	case "":
+		return nil, errors.New("PAYMENT_PROVIDER is required")
+	default:
+		return nil, fmt.Errorf("unknown PAYMENT_PROVIDER %q", provider)
+	}
+	if os.Getenv("ALLOW_MOCK_PAYMENTS") != "true" {
+		return nil, errors.New("the mock payment provider is only for development and tests, set ALLOW_MOCK_PAYMENTS=true to use it")
+	}
+
+	mock := MockPaymentProvider{
+		Secret:          os.Getenv("MOCK_PAYMENT_SECRET"),
+		WebhookURL:      os.Getenv("MOCK_PAYMENT_WEBHOOK_URL"),
+		SettlementDelay: 30 * time.Second,
+	}
+	if mock.Secret == "" {
+		return nil, errors.New("MOCK_PAYMENT_SECRET is required")
+	}
+	if mock.WebhookURL == "" {
+		mock.WebhookURL = "http://localhost:8080/api/payments/webhook"
+	}
+	if value := os.Getenv("MOCK_PAYMENT_SETTLEMENT_DELAY"); value != "" {
+		delay, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MOCK_PAYMENT_SETTLEMENT_DELAY %q", value)
+		}
+		mock.SettlementDelay = delay
+	}
+	return mock, nil
+}
@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// A4 in PDF points
+const (
+	PDFPageWidth  = 595.0
+	PDFPageHeight = 842.0
+)
+
+// PDF builds a plain text-and-lines PDF document with the standard Helvetica
+// fonts, so no font files are needed. Output depends only on what was drawn,
+// which keeps documents byte-identical when rendered from the same data.
+type PDF struct {
+	pages []*bytes.Buffer
+}
+
+func NewPDF() *PDF {
+	p := &PDF{}
+	p.AddPage()
+	return p
+}
+
+// AddPage starts a new page; drawing goes to the newest page
+func (p *PDF) AddPage() {
+	p.pages = append(p.pages, &bytes.Buffer{})
+}
+
+func (p *PDF) page() *bytes.Buffer {
+	return p.pages[len(p.pages)-1]
+}
+
+// Text draws text with its baseline starting at x, y. The origin is the
+// bottom left corner of the page.
+func (p *PDF) Text(x, y, size float64, bold bool, text string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(p.page(), "BT /%s %.2f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, y, pdfEscape(text))
+}
+
+// TextRight draws text so that it ends at x
+func (p *PDF) TextRight(x, y, size float64, bold bool, text string) {
+	p.Text(x-TextWidth(text, size), y, size, bold, text)
+}
+
+// Line draws a thin line between two points
+func (p *PDF) Line(x1, y1, x2, y2 float64) {
+	fmt.Fprintf(p.page(), "0.5 w %.2f %.2f m %.2f %.2f l S\n", x1, y1, x2, y2)
+}
+
+// TextWidth estimates the width of text in Helvetica. Digits and the
+// punctuation used in amounts are exact, which is what right alignment needs.
+func TextWidth(text string, size float64) float64 {
+	var units int
+	for _, r := range text {
+		switch {
+		case r >= '0' && r <= '9':
+			units += 556
+		case r == ' ' || r == '.' || r == ',' || r == ':':
+			units += 278
+		case r == '-':
+			units += 333
+		case r >= 'A' && r <= 'Z':
+			units += 667
+		case r == 'i' || r == 'j' || r == 'l':
+			units += 222
+		default:
+			units += 556
+		}
+	}
+	return float64(units) * size / 1000
+}
+
+// Escape text for a PDF string, replacing characters outside Latin-1
+func pdfEscape(text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 32:
+			b.WriteByte(' ')
+		case r < 128:
+			b.WriteRune(r)
+		case r < 256:
+			fmt.Fprintf(&b, "\\%03o", r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+// Bytes renders the document
+func (p *PDF) Bytes() []byte {
+	var out bytes.Buffer
+	var offsets []int
+
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	out.WriteString("%PDF-1.4\n")
+
+	//Objects 1-4 are the catalog, page tree and fonts; each page then takes two
+	pageCount := len(p.pages)
+	kids := make([]string, pageCount)
+	for i := range p.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), pageCount))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+
+	for i, page := range p.pages {
+		object(fmt.Sprintf(
+			"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			PDFPageWidth, PDFPageHeight, 6+2*i,
+		))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", page.Len(), page.String()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	return out.Bytes()
+}
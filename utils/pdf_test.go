@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPDFEscape(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"Invoice INV-0001", "Invoice INV-0001"},
+		{"Total (incl. tax)", `Total \(incl. tax\)`},
+		{`C:\path`, `C:\\path`},
+		{"line\nbreak\ttab", "line break tab"},
+		{"Café £5", `Caf\351 \2435`},
+		{"ÿ", `\377`},
+		{"€ 5", "? 5"},
+		{"日本", "??"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := pdfEscape(tt.text); got != tt.want {
+			t.Errorf("pdfEscape(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestPDFBytesAreStable(t *testing.T) {
+	render := func() []byte {
+		pdf := NewPDF()
+		pdf.Text(50, 800, 12, true, "Invoice (copy)")
+		pdf.TextRight(545, 800, 10, false, "12.50")
+		pdf.Line(50, 790, 545, 790)
+		pdf.AddPage()
+		pdf.Text(50, 800, 10, false, "Page two")
+		return pdf.Bytes()
+	}
+
+	first := render()
+	if !bytes.HasPrefix(first, []byte("%PDF-")) {
+		t.Fatalf("document does not start with a PDF header: %q", first[:16])
+	}
+	if !bytes.Contains(first, []byte(`(Invoice \(copy\)) Tj`)) {
+		t.Error("escaped text is missing from the page content")
+	}
+	if !bytes.HasSuffix(bytes.TrimSpace(first), []byte("%%EOF")) {
+		t.Error("document does not end with the EOF marker")
+	}
+	if !bytes.Equal(first, render()) {
+		t.Error("rendering the same content twice gave different bytes")
+	}
+}
@@ -0,0 +1,302 @@
+package utils
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Limits on what an XLSX upload may unpack to. The archive is compressed, so
+// a small upload could otherwise inflate into an unbounded amount of memory.
+const (
+	maxXLSXSize    = 100 << 20
+	maxXLSXRows    = 1048576
+	maxXLSXColumns = 16384
+)
+
+// ErrSpreadsheetTooLarge means an upload unpacks to more than is allowed
+var ErrSpreadsheetTooLarge = errors.New("spreadsheet is too large")
+
+// ReadSpreadsheet returns every row of a CSV or XLSX upload, picking the
+// parser from the file extension. Only the first worksheet of an XLSX file is
+// read; rows left out of its sheet are returned empty so each row stays at its
+// position in the sheet.
+func ReadSpreadsheet(filename string, r io.Reader) ([][]string, error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".csv":
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = -1
+		reader.TrimLeadingSpace = true
+		return reader.ReadAll()
+	case ".xlsx":
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		return readXLSX(data)
+	default:
+		return nil, errors.New("unsupported file type, expected .csv or .xlsx")
+	}
+}
+
+type xlsxRelationships struct {
+	Relationships []struct {
+		ID     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+type xlsxWorkbook struct {
+	Sheets []struct {
+		RelID string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+type xlsxText struct {
+	Text string `xml:"t"`
+	Runs []struct {
+		Text string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (t xlsxText) String() string {
+	if len(t.Runs) == 0 {
+		return t.Text
+	}
+	var sb strings.Builder
+	for _, run := range t.Runs {
+		sb.WriteString(run.Text)
+	}
+	return sb.String()
+}
+
+type xlsxSharedStrings struct {
+	Items []xlsxText `xml:"si"`
+}
+
+type xlsxSheet struct {
+	Rows []struct {
+		// One based row number, absent in some writers
+		Index int `xml:"r,attr"`
+		Cells []struct {
+			Ref    string   `xml:"r,attr"`
+			Type   string   `xml:"t,attr"`
+			Value  string   `xml:"v"`
+			Inline xlsxText `xml:"is"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+func readXLSX(data []byte) ([][]string, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid xlsx file: %w", err)
+	}
+
+	files := map[string]*zip.File{}
+	for _, f := range archive.File {
+		files[f.Name] = f
+	}
+
+	//Every part read shares one budget of uncompressed bytes
+	budget := &limitedReader{n: maxXLSXSize}
+	decode := func(name string, v interface{}) error {
+		f, ok := files[name]
+		if !ok {
+			return fmt.Errorf("invalid xlsx file: missing %s", name)
+		}
+		if f.UncompressedSize64 > uint64(budget.n) {
+			return ErrSpreadsheetTooLarge
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		budget.r = rc
+		err = xml.NewDecoder(budget).Decode(v)
+		if budget.n <= 0 {
+			return ErrSpreadsheetTooLarge
+		}
+		return err
+	}
+
+	sheetPath := "xl/worksheets/sheet1.xml"
+	var workbook xlsxWorkbook
+	var rels xlsxRelationships
+	if decode("xl/workbook.xml", &workbook) == nil && decode("xl/_rels/workbook.xml.rels", &rels) == nil && len(workbook.Sheets) > 0 {
+		for _, rel := range rels.Relationships {
+			if rel.ID == workbook.Sheets[0].RelID {
+				sheetPath = path.Join("xl", strings.TrimPrefix(rel.Target, "/xl/"))
+				break
+			}
+		}
+	}
+
+	var shared xlsxSharedStrings
+	if _, ok := files["xl/sharedStrings.xml"]; ok {
+		if err := decode("xl/sharedStrings.xml", &shared); err != nil {
+			return nil, err
+		}
+	}
+
+	var sheet xlsxSheet
+	if err := decode(sheetPath, &sheet); err != nil {
+		return nil, err
+	}
+
+	rows := make([][]string, 0, len(sheet.Rows))
+	for _, sheetRow := range sheet.Rows {
+		if sheetRow.Index > maxXLSXRows {
+			return nil, ErrSpreadsheetTooLarge
+		}
+		for len(rows) < sheetRow.Index-1 {
+			rows = append(rows, nil)
+		}
+
+		var row []string
+		for i, cell := range sheetRow.Cells {
+			col := i
+			if cell.Ref != "" {
+				col = columnIndex(cell.Ref)
+			}
+			if col >= maxXLSXColumns {
+				return nil, ErrSpreadsheetTooLarge
+			}
+			for len(row) <= col {
+				row = append(row, "")
+			}
+
+			switch cell.Type {
+			case "s":
+				index, err := strconv.Atoi(cell.Value)
+				if err != nil || index < 0 || index >= len(shared.Items) {
+					return nil, fmt.Errorf("invalid shared string reference in cell %s", cell.Ref)
+				}
+				row[col] = shared.Items[index].String()
+			case "inlineStr":
+				row[col] = cell.Inline.String()
+			default:
+				row[col] = cell.Value
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// Reads from r until n bytes have been read in total, then fails
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		return 0, ErrSpreadsheetTooLarge
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// Convert the letters of a cell reference such as "AB12" into a zero based column
+func columnIndex(ref string) int {
+	col := 0
+	for _, r := range ref {
+		if r < 'A' || r > 'Z' {
+			break
+		}
+		col = col*26 + int(r-'A'+1)
+	}
+	return col - 1
+}
+
+func columnName(index int) string {
+	name := ""
+	for index >= 0 {
+		name = string(rune('A'+index%26)) + name
+		index = index/26 - 1
+	}
+	return name
+}
+
+// XLSXWriter streams rows into a single sheet workbook. Cells are written as
+// inline strings, so rows can be sent as they are read without buffering.
+type XLSXWriter struct {
+	archive *zip.Writer
+	sheet   io.Writer
+	row     int
+}
+
+func NewXLSXWriter(w io.Writer) (*XLSXWriter, error) {
+	archive := zip.NewWriter(w)
+
+	parts := []struct{ name, body string }{
+		{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`},
+		{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`},
+		{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="Sheet1" sheetId="1" r:id="rId1"/></sheets></workbook>`},
+		{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`},
+	}
+	for _, part := range parts {
+		f, err := archive.Create(part.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(f, part.body); err != nil {
+			return nil, err
+		}
+	}
+
+	sheet, err := archive.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.WriteString(sheet, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	if err != nil {
+		return nil, err
+	}
+
+	return &XLSXWriter{archive: archive, sheet: sheet}, nil
+}
+
+func (x *XLSXWriter) Write(record []string) error {
+	x.row++
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `<row r="%d">`, x.row)
+	for i, value := range record {
+		fmt.Fprintf(&sb, `<c r="%s%d" t="inlineStr"><is><t xml:space="preserve">`, columnName(i), x.row)
+		if err := xml.EscapeText(&sb, []byte(value)); err != nil {
+			return err
+		}
+		sb.WriteString(`</t></is></c>`)
+	}
+	sb.WriteString(`</row>`)
+	_, err := io.WriteString(x.sheet, sb.String())
+	return err
+}
+
+// Close finishes the sheet and the zip archive. It does not close the underlying writer.
+func (x *XLSXWriter) Close() error {
+	if _, err := io.WriteString(x.sheet, `</sheetData></worksheet>`); err != nil {
+		return err
+	}
+	return x.archive.Close()
+}
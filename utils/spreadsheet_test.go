@@ -0,0 +1,151 @@
+package utils
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Build an XLSX file from its parts, for sheets the writer cannot produce
+func buildXLSX(t *testing.T, parts map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for name, body := range parts {
+		f, err := archive.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestXLSXRoundTrip(t *testing.T) {
+	records := [][]string{
+		{"name", "sku", "price"},
+		{"Tea & Biscuits", "TB-1", "4.50"},
+		{"<Mug>", "", "12"},
+		{"  spaced  ", "émoji ☕", "0"},
+	}
+
+	var buf bytes.Buffer
+	writer, err := NewXLSXWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range records {
+		if err := writer.Write(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ReadSpreadsheet("products.xlsx", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, records) {
+		t.Errorf("got %q, want %q", got, records)
+	}
+}
+
+func TestReadXLSXKeepsRowAndColumnPositions(t *testing.T) {
+	data := buildXLSX(t, map[string]string{
+		"xl/sharedStrings.xml": `<sst xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+			`<si><t>name</t></si><si><r><t>Rich </t></r><r><t>text</t></r></si></sst>`,
+		"xl/worksheets/sheet1.xml": `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>` +
+			`<row r="1"><c r="A1" t="s"><v>0</v></c><c r="C1"><v>7</v></c></row>` +
+			`<row r="4"><c r="B4" t="s"><v>1</v></c></row>` +
+			`</sheetData></worksheet>`,
+	})
+
+	got, err := ReadSpreadsheet("products.xlsx", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"name", "", "7"},
+		nil,
+		nil,
+		{"", "Rich text"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestReadXLSXRejectsOversizedParts(t *testing.T) {
+	//Compresses to almost nothing but unpacks past the limit
+	sheet := `<worksheet><sheetData><row r="1"><c r="A1"><v>` +
+		strings.Repeat("0", maxXLSXSize) + `</v></c></row></sheetData></worksheet>`
+	data := buildXLSX(t, map[string]string{"xl/worksheets/sheet1.xml": sheet})
+
+	_, err := ReadSpreadsheet("products.xlsx", bytes.NewReader(data))
+	if !errors.Is(err, ErrSpreadsheetTooLarge) {
+		t.Fatalf("got error %v, want %v", err, ErrSpreadsheetTooLarge)
+	}
+}
+
+func TestReadXLSXRejectsBadSharedString(t *testing.T) {
+	data := buildXLSX(t, map[string]string{
+		"xl/sharedStrings.xml": `<sst><si><t>only</t></si></sst>`,
+		"xl/worksheets/sheet1.xml": `<worksheet><sheetData>` +
+			`<row r="1"><c r="A1" t="s"><v>3</v></c></row></sheetData></worksheet>`,
+	})
+
+	if _, err := ReadSpreadsheet("products.xlsx", bytes.NewReader(data)); err == nil {
+		t.Fatal("expected an error for a shared string out of range")
+	}
+}
+
+func TestReadSpreadsheetCSV(t *testing.T) {
+	got, err := ReadSpreadsheet("products.CSV", strings.NewReader("name,price\n\"Tea, green\", 4.5\nMug\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{"name", "price"}, {"Tea, green", "4.5"}, {"Mug"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestReadSpreadsheetUnsupportedType(t *testing.T) {
+	if _, err := ReadSpreadsheet("products.xls", strings.NewReader("")); err == nil {
+		t.Fatal("expected an error for an .xls file")
+	}
+}
+
+func TestColumnNames(t *testing.T) {
+	tests := []struct {
+		index int
+		name  string
+	}{
+		{0, "A"},
+		{25, "Z"},
+		{26, "AA"},
+		{51, "AZ"},
+		{52, "BA"},
+		{701, "ZZ"},
+		{702, "AAA"},
+		{16383, "XFD"},
+	}
+	for _, tt := range tests {
+		if got := columnName(tt.index); got != tt.name {
+			t.Errorf("columnName(%d) = %q, want %q", tt.index, got, tt.name)
+		}
+		if got := columnIndex(tt.name + "12"); got != tt.index {
+			t.Errorf("columnIndex(%q) = %d, want %d", tt.name+"12", got, tt.index)
+		}
+	}
+}